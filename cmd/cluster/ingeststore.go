@@ -8,9 +8,18 @@ import (
 	"os"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/clients"
 	"github.com/SimonRichardson/cluster/pkg/cluster"
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/ingester"
 	"github.com/SimonRichardson/cluster/pkg/members"
+	"github.com/SimonRichardson/cluster/pkg/placement"
+	"github.com/SimonRichardson/cluster/pkg/queue"
+	"github.com/SimonRichardson/cluster/pkg/store"
+	"github.com/SimonRichardson/cluster/pkg/topic"
 	"github.com/SimonRichardson/gexec"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -19,8 +28,38 @@ import (
 )
 
 const (
-	defaultMembers             = "real"
-	defaultMetricsRegistration = true
+	defaultMembers                     = "real"
+	defaultMetricsRegistration         = true
+	defaultFilesystem                  = "local"
+	defaultQueue                       = "real"
+	defaultStore                       = "real"
+	defaultIngestPath                  = "data/ingest"
+	defaultStorePath                   = "data/store"
+	defaultIngestDurability            = "none"
+	defaultIngestSegmentFlushSize      = 16 * 1024 * 1024
+	defaultIngestSegmentFlushRecords   = 0
+	defaultIngestSegmentFlushAge       = 3 * time.Second
+	defaultIngestSegmentIdleTimeout    = 0
+	defaultIngestSegmentPendingTimeout = time.Minute
+	defaultIngestRetryAfter            = 5 * time.Second
+	defaultStoreQueryTimeout           = 10 * time.Second
+	defaultStoreCompactTargetSize      = 128 * 1024 * 1024
+	defaultStoreCompactConcurrency     = 1
+	defaultStoreCompactInterval        = 10 * time.Second
+	defaultStoreRetentionAge           = 7 * 24 * time.Hour
+	defaultStoreRetentionBytes         = 0
+	defaultStoreRetentionInterval      = time.Minute
+	defaultStoreReplicationFactor      = 2
+	defaultStoreRepairInterval         = time.Minute
+	defaultStoreRepairTimeout          = time.Minute
+	defaultQueueCompression            = "none"
+	defaultQueueMaxAttempts            = 10
+	defaultQueueMaxSegments            = 0
+	defaultQueueMaxBytes               = 0
+	defaultQueueMinFreeBytes           = 0
+	defaultQueueMemoryBudget           = 64 * 1024 * 1024
+	defaultStoreCompression            = "none"
+	defaultTransportCompression        = "none"
 )
 
 func runIngestStore(args []string) error {
@@ -30,12 +69,48 @@ func runIngestStore(args []string) error {
 
 		debug               = flagset.Bool("debug", false, "debug logging")
 		apiAddr             = flagset.String("api", defaultAPIAddr, "listen address for query API")
+		fastAddr            = flagset.String("ingest.fast", defaultFastAddr, "listen address for fast (streaming) writes")
+		durableAddr         = flagset.String("ingest.durable", defaultDurableAddr, "listen address for durable (streaming, fsync before ack) writes")
+		ingestDurability    = flagset.String("ingest.durability", defaultIngestDurability, "default durability of API writes: none, flush, fsync")
 		membersType         = flagset.String("members", defaultMembers, "real, nop")
 		metricsRegistration = flagset.Bool("metrics.registration", defaultMetricsRegistration, "Registration of metrics on launch")
-		clusterPeers        = stringslice{}
+		filesystemType      = flagset.String("filesystem", defaultFilesystem, "local, virtual, nop")
+		queueType           = flagset.String("queue", defaultQueue, "real, hybrid, virtual, nop")
+		storeType           = flagset.String("store", defaultStore, "real, virtual, nop")
+		ingestPath          = flagset.String("ingest.path", defaultIngestPath, "path holding segment files for ingest tier")
+		storePath           = flagset.String("store.path", defaultStorePath, "path holding segment files for storage tier")
+
+		segmentFlushSize      = flagset.Int("ingest.segment-flush-size", defaultIngestSegmentFlushSize, "flush segments after they grow to this size")
+		segmentFlushRecords   = flagset.Int("ingest.segment-flush-records", defaultIngestSegmentFlushRecords, "flush segments after they hold this many records (0 disables)")
+		segmentFlushAge       = flagset.Duration("ingest.segment-flush-age", defaultIngestSegmentFlushAge, "flush segments after they are active for this long")
+		segmentIdleTimeout    = flagset.Duration("ingest.segment-idle-timeout", defaultIngestSegmentIdleTimeout, "flush segments after they go this long without a write (0 disables)")
+		segmentPendingTimeout = flagset.Duration("ingest.segment-pending-timeout", defaultIngestSegmentPendingTimeout, "pending segments that are claimed but uncommitted are failed after this long")
+		retryAfter            = flagset.Duration("ingest.retry-after", defaultIngestRetryAfter, "how long writers are asked to back off for when the ingest queue is full")
+		storeQueryTimeout     = flagset.Duration("store.query-timeout", defaultStoreQueryTimeout, "how long to wait for each store peer to answer a fan-out query")
+		compactTargetSize     = flagset.Int("store.compact-target-size", defaultStoreCompactTargetSize, "merge adjacent small segments until they reach this size, as held on disk")
+		compactConcurrency    = flagset.Int("store.compact-concurrency", defaultStoreCompactConcurrency, "maximum number of compactions happening at the same time")
+		compactInterval       = flagset.Duration("store.compact-interval", defaultStoreCompactInterval, "how often to compact segments")
+		retentionAge          = flagset.Duration("store.retention.age", defaultStoreRetentionAge, "purge segments once they were stored longer than this ago (0 disables)")
+		retentionBytes        = flagset.Int64("store.retention.bytes", defaultStoreRetentionBytes, "purge the oldest segments once the store holds more than this many bytes (0 disables)")
+		retentionInterval     = flagset.Duration("store.retention.interval", defaultStoreRetentionInterval, "how often to purge segments")
+		replicationFactor     = flagset.Int("store.replication-factor", defaultStoreReplicationFactor, "number of store peers each segment should be held by")
+		repairInterval        = flagset.Duration("store.repair.interval", defaultStoreRepairInterval, "how often to repair under-replicated segments")
+		repairTimeout         = flagset.Duration("store.repair.timeout", defaultStoreRepairTimeout, "how long to wait for a store peer when repairing segments")
+		queueCompression      = flagset.String("queue.compression", defaultQueueCompression, "compression of ingest segments on disk: none, gzip, snappy")
+		queueMaxAttempts      = flagset.Int("queue.max-attempts", defaultQueueMaxAttempts, "dead-letter segments after they fail this many times (0 disables)")
+		queueMaxSegments      = flagset.Int("queue.max-segments", defaultQueueMaxSegments, "reject ingest writes once the queue holds this many segments, not counting dead segments (0 disables)")
+		queueMaxBytes         = flagset.Int64("queue.max-bytes", defaultQueueMaxBytes, "reject new ingest segments once the queue holds this many bytes, before compression; a soft limit, as the active segment can grow past it (0 disables)")
+		queueMinFreeBytes     = flagset.Int64("queue.min-free-bytes", defaultQueueMinFreeBytes, "reject ingest writes once the queue filesystem has less than this many bytes free (0 disables)")
+		queueMemoryBudget     = flagset.Int64("queue.memory-budget", defaultQueueMemoryBudget, "bytes of segments the hybrid queue holds in memory before spilling to disk")
+		storeCompression      = flagset.String("store.compression", defaultStoreCompression, "compression of store segments on disk: none, gzip, snappy")
+		transportCompression  = flagset.String("transport.compression", defaultTransportCompression, "compression of segments sent between peers: none, gzip, snappy")
+
+		clusterPeers = stringslice{}
+		topicFlags   = topicslice{}
 	)
 
 	flagset.Var(&clusterPeers, "peer", "cluster peer host:port (repeatable)")
+	flagset.Var(&topicFlags, "topic", "named topic name[,retention.age=duration][,retention.bytes=n], consumed in the order given (repeatable)")
 
 	var envArgs []string
 	flagset.VisitAll(func(flag *flag.Flag) {
@@ -79,18 +154,109 @@ func runIngestStore(args []string) error {
 		Name:      "writer_records_written_total",
 		Help:      "The total number of records written.",
 	})
+	ingestSegmentRotations := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "ingest_segment_rotations_total",
+		Help:      "The total number of active segments rotated by reason.",
+	}, []string{"reason"})
+	ingestFailedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "ingest_failed_segments_total",
+		Help:      "The total number of segments failed by consumers.",
+	})
+	ingestCommittedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "ingest_committed_segments_total",
+		Help:      "The total number of segments committed by consumers.",
+	})
+	ingestCommittedBytes := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "ingest_committed_bytes_total",
+		Help:      "The total number of bytes committed by consumers.",
+	})
+	ingestCorruptSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "ingest_corrupt_segments_total",
+		Help:      "The total number of segments failing their checksum when read by consumers.",
+	})
+	storeReplicatedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_replicated_segments_total",
+		Help:      "The total number of segments replicated to this store.",
+	})
+	storeReplicatedBytes := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_replicated_bytes_total",
+		Help:      "The total number of bytes replicated to this store.",
+	})
+	storeCorruptSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_corrupt_segments_total",
+		Help:      "The total number of segments failing their checksum on this store.",
+	})
+	storeCompactions := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_compactions_total",
+		Help:      "The total number of compactions on this store.",
+	})
+	storeCompactedBytesReclaimed := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_compacted_bytes_reclaimed_total",
+		Help:      "The total number of bytes reclaimed by compaction on this store.",
+	})
+	storePurgedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_purged_segments_total",
+		Help:      "The total number of segments purged by retention on this store.",
+	})
+	storePurgedBytes := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_purged_bytes_total",
+		Help:      "The total number of bytes purged by retention on this store.",
+	})
+	storeUnderReplicatedSegments := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cluster",
+		Name:      "store_under_replicated_segments",
+		Help:      "The number of segments on this store held by fewer peers than the replication factor, by topic.",
+	}, []string{"topic"})
+	storeRepairedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cluster",
+		Name:      "store_repaired_segments_total",
+		Help:      "The total number of segments copied to other stores by repair.",
+	})
 	apiDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "cluster",
 		Name:      "api_request_duration_seconds",
 		Help:      "API request duration in seconds.",
 		Buckets:   prometheus.DefBuckets,
 	}, []string{"method", "path", "status_code"})
+	compressionRatio := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cluster",
+		Name:      "compression_ratio",
+		Help:      "Compressed size of segments as a ratio of their uncompressed size.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"tier"})
 	if *metricsRegistration {
 		prometheus.MustRegister(
 			connectedClients,
 			writerBytes,
 			writerRecords,
+			ingestSegmentRotations,
+			ingestFailedSegments,
+			ingestCommittedSegments,
+			ingestCommittedBytes,
+			ingestCorruptSegments,
+			storeReplicatedSegments,
+			storeReplicatedBytes,
+			storeCorruptSegments,
+			storeCompactions,
+			storeCompactedBytesReclaimed,
+			storePurgedSegments,
+			storePurgedBytes,
+			storeUnderReplicatedSegments,
+			storeRepairedSegments,
 			apiDuration,
+			compressionRatio,
 		)
 	}
 
@@ -105,6 +271,46 @@ func runIngestStore(args []string) error {
 	}
 	level.Info(logger).Log("API", fmt.Sprintf("%s://%s", apiNetwork, apiAddress))
 
+	fastNetwork, fastAddress, _, _, err := parseAddr(*fastAddr, defaultFastPort)
+	if err != nil {
+		return err
+	}
+
+	fastListener, err := net.Listen(fastNetwork, fastAddress)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("ingest_fast", fmt.Sprintf("%s://%s", fastNetwork, fastAddress))
+
+	durableNetwork, durableAddress, _, _, err := parseAddr(*durableAddr, defaultDurablePort)
+	if err != nil {
+		return err
+	}
+
+	durableListener, err := net.Listen(durableNetwork, durableAddress)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("ingest_durable", fmt.Sprintf("%s://%s", durableNetwork, durableAddress))
+
+	apiDurability, err := ingester.ParseDurability(*ingestDurability)
+	if err != nil {
+		return err
+	}
+
+	queueEncoding, err := compression.Parse(*queueCompression)
+	if err != nil {
+		return err
+	}
+	storeEncoding, err := compression.Parse(*storeCompression)
+	if err != nil {
+		return err
+	}
+	transportEncoding, err := compression.Parse(*transportCompression)
+	if err != nil {
+		return err
+	}
+
 	// Create peer.
 	var mem members.Members
 	switch strings.ToLower(*membersType) {
@@ -126,13 +332,10 @@ func runIngestStore(args []string) error {
 		return errors.Errorf("invalid -members %q", *membersType)
 	}
 
-	peer, err := cluster.NewPeer(
+	peer := cluster.NewPeer(
 		mem,
 		log.With(logger, "component", "peer"),
 	)
-	if err != nil {
-		return err
-	}
 	if *metricsRegistration {
 		clusterSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Namespace: "cluster",
@@ -142,6 +345,170 @@ func runIngestStore(args []string) error {
 		prometheus.MustRegister(clusterSize)
 	}
 
+	// Create the filesystem.
+	var filesys fs.Filesystem
+	{
+		fsConfig, err := fs.Build(
+			fs.With(*filesystemType),
+		)
+		if err != nil {
+			return err
+		}
+		if filesys, err = fs.New(fsConfig); err != nil {
+			return err
+		}
+	}
+
+	// The default topic always exists, taking the store wide retention, with
+	// any named topics following it.
+	topics := append([]topicFlag{{
+		name:           topic.Default,
+		retentionAge:   retentionAge,
+		retentionBytes: retentionBytes,
+	}}, topicFlags...)
+
+	var (
+		ingestTopics    []ingester.Topic
+		storeLogs       = make(map[string]store.Log, len(topics))
+		storeCompactors []*store.Compactor
+		storeReapers    []*store.Reaper
+		storeRepairers  []*store.Repairer
+
+		repairClient = clients.NewHTTPClient(&http.Client{
+			Timeout: *repairTimeout,
+		}, transportEncoding)
+	)
+	for _, t := range topics {
+		topicLogger := log.With(logger, "topic", t.name)
+
+		// Create the ingest queue.
+		var ingestQueue queue.Queue
+		{
+			queueConfig, err := queue.Build(
+				queue.With(*queueType),
+				queue.WithFilesystem(filesys),
+				queue.WithRoot(topic.Root(*ingestPath, t.name)),
+				queue.WithCompression(queueEncoding, compressionRatio.WithLabelValues("queue")),
+				queue.WithMaxAttempts(*queueMaxAttempts),
+				queue.WithMemoryBudget(*queueMemoryBudget),
+				queue.WithQuota(queue.Quota{
+					MaxSegments:  *queueMaxSegments,
+					MaxBytes:     *queueMaxBytes,
+					MinFreeBytes: *queueMinFreeBytes,
+				}),
+			)
+			if err != nil {
+				return err
+			}
+			if ingestQueue, err = queue.New(queueConfig); err != nil {
+				return err
+			}
+		}
+		if *metricsRegistration {
+			depth := func(fn func(queue.Depth) float64) func() float64 {
+				return func() float64 { return fn(ingestQueue.Depth()) }
+			}
+			for state, fn := range map[string]func(queue.Depth) float64{
+				"active":  func(d queue.Depth) float64 { return float64(d.Active) },
+				"flushed": func(d queue.Depth) float64 { return float64(d.Flushed) },
+				"pending": func(d queue.Depth) float64 { return float64(d.Pending) },
+				"dead":    func(d queue.Depth) float64 { return float64(d.Dead) },
+			} {
+				prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+					Namespace:   "cluster",
+					Name:        "ingest_queue_segments",
+					Help:        "Number of segments held by the ingest queue, by topic and state.",
+					ConstLabels: prometheus.Labels{"topic": t.name, "state": state},
+				}, depth(fn)))
+			}
+			prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   "cluster",
+				Name:        "ingest_queue_bytes",
+				Help:        "Number of bytes held by the ingest queue, by topic.",
+				ConstLabels: prometheus.Labels{"topic": t.name},
+			}, depth(func(d queue.Depth) float64 { return float64(d.Bytes) })))
+		}
+
+		// Create the store log.
+		var storeLog store.Log
+		{
+			logConfig, err := store.Build(
+				store.With(*storeType),
+				store.WithFilesystem(filesys),
+				store.WithRoot(topic.Root(*storePath, t.name)),
+				store.WithCompression(storeEncoding, compressionRatio.WithLabelValues("store")),
+			)
+			if err != nil {
+				return err
+			}
+			if storeLog, err = store.New(logConfig); err != nil {
+				return err
+			}
+		}
+		storeLogs[t.name] = storeLog
+
+		ingestWriter := queue.NewRotatingWriter(
+			ingestQueue,
+			queue.RotationPolicy{
+				MaxBytes:    int64(*segmentFlushSize),
+				MaxRecords:  *segmentFlushRecords,
+				MaxAge:      *segmentFlushAge,
+				IdleTimeout: *segmentIdleTimeout,
+			},
+			writerBytes, writerRecords,
+			ingestSegmentRotations,
+			log.With(topicLogger, "component", "writer"),
+		)
+		ingestTopics = append(ingestTopics, ingester.Topic{
+			Name:   t.name,
+			Queue:  ingestQueue,
+			Writer: ingestWriter,
+		})
+
+		storeCompactors = append(storeCompactors, store.NewCompactor(
+			storeLog,
+			int64(*compactTargetSize),
+			*compactConcurrency,
+			*compactInterval,
+			storeCompactions, storeCompactedBytesReclaimed,
+			log.With(topicLogger, "component", "compactor"),
+		))
+
+		policy := store.RetentionPolicy{
+			MaxAge:   *retentionAge,
+			MaxBytes: *retentionBytes,
+		}
+		if t.retentionAge != nil {
+			policy.MaxAge = *t.retentionAge
+		}
+		if t.retentionBytes != nil {
+			policy.MaxBytes = *t.retentionBytes
+		}
+		storeReapers = append(storeReapers, store.NewReaper(
+			storeLog,
+			policy,
+			*retentionInterval,
+			storePurgedSegments, storePurgedBytes,
+			log.With(topicLogger, "component", "reaper"),
+		))
+
+		storeRepairers = append(storeRepairers, store.NewRepairer(
+			peer,
+			repairClient,
+			storeLog,
+			t.name,
+			placement.NewRendezvous(),
+			*replicationFactor,
+			*repairInterval,
+			storeUnderReplicatedSegments.WithLabelValues(t.name),
+			storeRepairedSegments,
+			log.With(topicLogger, "component", "repairer"),
+		))
+	}
+
+	// The streaming listeners carry no topic, so they write to the default.
+	ingestWriter := ingestTopics[0].Writer
+
 	// Execution group.
 	var g gexec.Group
 	gexec.Block(g)
@@ -154,9 +521,107 @@ func runIngestStore(args []string) error {
 			close(cancel)
 		})
 	}
+	for _, t := range ingestTopics {
+		writer := t.Writer
+		g.Add(func() error {
+			writer.Run()
+			return nil
+		}, func(error) {
+			writer.Stop()
+		})
+	}
+	for _, c := range storeCompactors {
+		compactor := c
+		g.Add(func() error {
+			compactor.Run()
+			return nil
+		}, func(error) {
+			compactor.Stop()
+		})
+	}
+	for _, r := range storeReapers {
+		reaper := r
+		g.Add(func() error {
+			reaper.Run()
+			return nil
+		}, func(error) {
+			reaper.Stop()
+		})
+	}
+	for _, r := range storeRepairers {
+		repairer := r
+		g.Add(func() error {
+			repairer.Run()
+			return nil
+		}, func(error) {
+			repairer.Stop()
+		})
+	}
+	{
+		g.Add(func() error {
+			return ingester.HandleConnections(
+				fastListener,
+				ingestWriter,
+				ingester.DurabilityNone,
+				connectedClients.WithLabelValues("fast"),
+				log.With(logger, "component", "ingest_fast"),
+			)
+		}, func(error) {
+			fastListener.Close()
+		})
+	}
 	{
 		g.Add(func() error {
+			return ingester.HandleConnections(
+				durableListener,
+				ingestWriter,
+				ingester.DurabilityFsync,
+				connectedClients.WithLabelValues("durable"),
+				log.With(logger, "component", "ingest_durable"),
+			)
+		}, func(error) {
+			durableListener.Close()
+		})
+	}
+	{
+		g.Add(func() error {
+			defer func() {
+				for _, storeLog := range storeLogs {
+					storeLog.Close()
+				}
+			}()
+
 			mux := http.NewServeMux()
+			{
+				api := ingester.NewAPI(
+					ingestTopics,
+					apiDurability,
+					*segmentPendingTimeout,
+					*retryAfter,
+					connectedClients.WithLabelValues("ingest"),
+					ingestFailedSegments,
+					ingestCommittedSegments, ingestCommittedBytes,
+					ingestCorruptSegments,
+					apiDuration,
+				)
+				defer api.Stop()
+				mux.Handle("/ingest/", http.StripPrefix("/ingest", api))
+			}
+			{
+				api := store.NewAPI(
+					peer,
+					clients.NewHTTPClient(&http.Client{
+						Timeout: *storeQueryTimeout,
+					}, transportEncoding),
+					storeLogs,
+					storeReplicatedSegments, storeReplicatedBytes,
+					storeCorruptSegments,
+					apiDuration,
+					log.With(logger, "component", "store_api"),
+				)
+				defer api.Close()
+				mux.Handle("/store/", http.StripPrefix("/store", api))
+			}
 			return http.Serve(apiListener, mux)
 		}, func(error) {
 			apiListener.Close()
@@ -15,12 +15,16 @@ import (
 var version = "dev"
 
 const (
-	defaultAPIPort = 8080
-	defaultAddr    = "0.0.0.0:0"
+	defaultAPIPort     = 8080
+	defaultFastPort    = 7651
+	defaultDurablePort = 7652
+	defaultAddr        = "0.0.0.0:0"
 )
 
 var (
-	defaultAPIAddr = fmt.Sprintf("tcp://0.0.0.0:%d", defaultAPIPort)
+	defaultAPIAddr     = fmt.Sprintf("tcp://0.0.0.0:%d", defaultAPIPort)
+	defaultFastAddr    = fmt.Sprintf("tcp://0.0.0.0:%d", defaultFastPort)
+	defaultDurableAddr = fmt.Sprintf("tcp://0.0.0.0:%d", defaultDurablePort)
 )
 
 type command func([]string) error
@@ -11,7 +11,9 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/topic"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -110,3 +112,70 @@ func (ss *stringslice) String() string {
 	}
 	return strings.Join(*ss, ", ")
 }
+
+// topicFlag describes a named topic given on the command line as
+// "name[,retention.age=duration][,retention.bytes=n]". Retention that isn't
+// given falls back to the store wide retention.
+type topicFlag struct {
+	name           string
+	retentionAge   *time.Duration
+	retentionBytes *int64
+}
+
+func parseTopicFlag(s string) (topicFlag, error) {
+	parts := strings.Split(s, ",")
+	res := topicFlag{name: parts[0]}
+	if res.name == topic.Default || !topic.Valid(res.name) {
+		return res, errors.Errorf("%s: invalid topic name %q", s, res.name)
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return res, errors.Errorf("%s: expected key=value, got %q", s, part)
+		}
+		switch kv[0] {
+		case "retention.age":
+			age, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return res, errors.Wrapf(err, "%s: retention.age", s)
+			}
+			res.retentionAge = &age
+		case "retention.bytes":
+			bytes, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return res, errors.Wrapf(err, "%s: retention.bytes", s)
+			}
+			res.retentionBytes = &bytes
+		default:
+			return res, errors.Errorf("%s: unknown topic option %q", s, kv[0])
+		}
+	}
+	return res, nil
+}
+
+type topicslice []topicFlag
+
+func (ts *topicslice) Set(s string) error {
+	t, err := parseTopicFlag(s)
+	if err != nil {
+		return err
+	}
+	for _, v := range *ts {
+		if v.name == t.name {
+			return errors.Errorf("%s: duplicate topic %q", s, t.name)
+		}
+	}
+	(*ts) = append(*ts, t)
+	return nil
+}
+
+func (ts *topicslice) String() string {
+	if len(*ts) <= 0 {
+		return "..."
+	}
+	names := make([]string, len(*ts))
+	for k, v := range *ts {
+		names[k] = v.name
+	}
+	return strings.Join(names, ", ")
+}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestParseAddr(t *testing.T) {
 	for _, testcase := range []struct {
@@ -58,3 +61,50 @@ func TestEnvName(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTopicFlag(t *testing.T) {
+	t.Run("name", func(t *testing.T) {
+		res, err := parseTopicFlag("audit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "audit", res.name; expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if res.retentionAge != nil || res.retentionBytes != nil {
+			t.Errorf("expected no retention, actual: %v, %v", res.retentionAge, res.retentionBytes)
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		res, err := parseTopicFlag("audit,retention.age=24h,retention.bytes=1024")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.retentionAge == nil || res.retentionBytes == nil {
+			t.Fatalf("expected retention, actual: %v, %v", res.retentionAge, res.retentionBytes)
+		}
+		if expected, actual := 24*time.Hour, *res.retentionAge; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := int64(1024), *res.retentionBytes; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, value := range []string{
+			"",
+			"Audit",
+			"../audit",
+			"audit,retention.age",
+			"audit,retention.age=soon",
+			"audit,retention.bytes=lots",
+			"audit,replicas=3",
+		} {
+			if _, err := parseTopicFlag(value); err == nil {
+				t.Errorf("%q: expected error", value)
+			}
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package checksum
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// New returns a CRC32C hash, which is used to checksum segments.
+func New() hash.Hash32 {
+	return crc32.New(castagnoli)
+}
+
+// Checksum returns the CRC32C checksum of the bytes.
+func Checksum(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
+
+// Format returns the checksum as a fixed width hex string.
+func Format(sum uint32) string {
+	return fmt.Sprintf("%08x", sum)
+}
+
+// Parse parses a checksum from a hex string.
+func Parse(s string) (uint32, error) {
+	sum, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse checksum %q", s)
+	}
+	return uint32(sum), nil
+}
+
+// NewReader returns a reader that checksums everything read from r, once r is
+// exhausted the checksum is verified against the expected checksum. If they
+// differ a mismatch error is returned instead of io.EOF.
+func NewReader(r io.Reader, expected uint32) io.Reader {
+	return &reader{r, New(), expected}
+}
+
+type reader struct {
+	r        io.Reader
+	hash     hash.Hash32
+	expected uint32
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if err := Verify(r.expected, r.hash.Sum32()); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Verify returns a mismatch error if the actual checksum differs from the
+// expected checksum.
+func Verify(expected, actual uint32) error {
+	if expected != actual {
+		return errMismatch{errors.Errorf("checksum mismatch: expected %s, actual %s", Format(expected), Format(actual))}
+	}
+	return nil
+}
+
+type mismatch interface {
+	Mismatch() bool
+}
+
+type errMismatch struct {
+	err error
+}
+
+func (e errMismatch) Error() string {
+	return e.err.Error()
+}
+
+func (e errMismatch) Mismatch() bool {
+	return true
+}
+
+// ErrMismatch tests to see if the error passed is a checksum mismatch error
+// or not, which signifies that the bytes have been corrupted.
+func ErrMismatch(err error) bool {
+	if err != nil {
+		if _, ok := err.(mismatch); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package checksum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/quick"
+
+	"github.com/SimonRichardson/cluster/pkg/fs"
+)
+
+func TestReader(t *testing.T) {
+	t.Parallel()
+
+	t.Run("verified", func(t *testing.T) {
+		fn := func(b []byte) bool {
+			res, err := ioutil.ReadAll(NewReader(bytes.NewReader(b), Checksum(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return bytes.Equal(b, res)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		fn := func(b []byte) bool {
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(b), Checksum(b)+1))
+			return ErrMismatch(err)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSidecar(t *testing.T) {
+	t.Parallel()
+
+	t.Run("round trip", func(t *testing.T) {
+		fn := func(sum uint32) bool {
+			fsys := fs.NewVirtualFilesystem()
+			if err := WriteSidecar(fsys, "/a.crc", sum); err != nil {
+				t.Fatal(err)
+			}
+
+			res, ok, err := ReadSidecar(fsys, "/a.crc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ok && sum == res
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, ok, err := ReadSidecar(fs.NewVirtualFilesystem(), "/a.crc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := false, ok; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		f, err := fsys.Create("/a.crc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("corrupt"))
+		f.Close()
+
+		if _, _, err := ReadSidecar(fsys, "/a.crc"); !ErrMismatch(err) {
+			t.Errorf("expected checksum mismatch, actual: %v", err)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package checksum
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/pkg/errors"
+)
+
+// WriteSidecar writes the checksum to the sidecar file, which accompanies the
+// file that was checksummed.
+func WriteSidecar(filesys fs.Filesystem, filename string, sum uint32) error {
+	f, err := filesys.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "creating sidecar %s", filename)
+	}
+	if _, err := f.Write([]byte(Format(sum) + "\n")); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing sidecar %s", filename)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "syncing sidecar %s", filename)
+	}
+	return f.Close()
+}
+
+// ReadSidecar reads the checksum from the sidecar file. If there is no sidecar
+// file, then false is returned, as the checksum isn't known.
+func ReadSidecar(filesys fs.Filesystem, filename string) (uint32, bool, error) {
+	if !filesys.Exists(filename) {
+		return 0, false, nil
+	}
+
+	f, err := filesys.Open(filename)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "opening sidecar %s", filename)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "reading sidecar %s", filename)
+	}
+	// A sidecar that can't be parsed is as good as a mismatch, as the segment
+	// can no longer be verified.
+	sum, err := Parse(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false, errMismatch{errors.Wrapf(err, "corrupt sidecar %s", filename)}
+	}
+	return sum, true, nil
+}
@@ -15,6 +15,10 @@ type Client interface {
 	// Post sends a request with a body and returns a response or an error if the
 	// request was a failure
 	Post(string, []byte) (Response, error)
+
+	// PostStream sends a request with a body streamed from the reader and
+	// returns a response or an error if the request was a failure
+	PostStream(string, io.Reader) (Response, error)
 }
 
 // Response defines a interface for retrieving the data from a request to the
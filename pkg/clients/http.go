@@ -6,22 +6,32 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/records"
 	"github.com/pkg/errors"
 )
 
 const (
-	defaultAccept      = "text/plain"
+	// Records are preferred in the binary format, as it's able to hold any
+	// payload, other responses ignore the accept header.
+	defaultAccept      = records.BinaryContentType + ", text/plain;q=0.9"
 	defaultContentType = "application/octet-stream"
 	defaultUserAgent   = "cluster (go-client)"
 )
 
 type httpClient struct {
-	client *http.Client
+	client   *http.Client
+	encoding compression.Encoding
 }
 
-// NewHTTPClient creates a new HTTPClient
-func NewHTTPClient(client *http.Client) Client {
-	return &httpClient{client}
+// NewHTTPClient creates a new HTTPClient, compressing request bodies with the
+// encoding and accepting responses compressed with it. Responses are
+// decompressed according to their content encoding.
+func NewHTTPClient(client *http.Client, encoding compression.Encoding) Client {
+	if encoding == nil {
+		encoding = compression.Identity
+	}
+	return &httpClient{client, encoding}
 }
 
 func (c *httpClient) Get(u string) (Response, error) {
@@ -32,27 +42,93 @@ func (c *httpClient) Get(u string) (Response, error) {
 
 	req.Header.Set(httpHeaderUserAgent, defaultUserAgent)
 	req.Header.Set(httpHeaderAccept, defaultAccept)
+	if c.encoding != compression.Identity {
+		req.Header.Set(httpHeaderAcceptEncoding, c.encoding.Name())
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, errors.Errorf("%s %s", http.StatusText(resp.StatusCode), resp.Status)
 	}
-	return &httpClientResponse{resp}, nil
+	return newHTTPClientResponse(resp)
 }
 
 func (c *httpClient) Post(u string, b []byte) (Response, error) {
-	resp, err := c.client.Post(u, defaultContentType, bytes.NewReader(b))
+	if len(b) == 0 || c.encoding == compression.Identity {
+		return c.post(u, bytes.NewReader(b), compression.Identity)
+	}
+
+	var buf bytes.Buffer
+	w := c.encoding.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return c.post(u, &buf, c.encoding)
+}
+
+func (c *httpClient) PostStream(u string, r io.Reader) (Response, error) {
+	if c.encoding == compression.Identity {
+		return c.post(u, r, compression.Identity)
+	}
+
+	// The body is compressed as it's sent, the pipe is closed with the error
+	// of the request if it gives up reading the body.
+	pr, pw := io.Pipe()
+	go func() {
+		w := c.encoding.NewWriter(pw)
+		_, err := io.Copy(w, r)
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	resp, err := c.post(u, pr, c.encoding)
+	pr.Close()
+	return resp, err
+}
+
+func (c *httpClient) post(u string, body io.Reader, encoding compression.Encoding) (Response, error) {
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(httpHeaderContentType, defaultContentType)
+	if encoding != compression.Identity {
+		req.Header.Set(httpHeaderContentEncoding, encoding.Name())
+	}
+
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	return &httpClientResponse{resp}, nil
+	return newHTTPClientResponse(resp)
 }
 
 type httpClientResponse struct {
 	resp *http.Response
+	body io.Reader
+}
+
+func newHTTPClientResponse(resp *http.Response) (*httpClientResponse, error) {
+	encoding, err := compression.Parse(resp.Header.Get(httpHeaderContentEncoding))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	body, err := encoding.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, errors.Wrap(err, "decompressing response")
+	}
+	return &httpClientResponse{resp, body}, nil
 }
 
 func (h *httpClientResponse) Status() int {
@@ -64,15 +140,22 @@ func (h *httpClientResponse) Bytes() ([]byte, error) {
 }
 
 func (h *httpClientResponse) Reader() io.ReadCloser {
-	return h.resp.Body
+	return readCloser{h.body, h.resp.Body}
 }
 
 func (h *httpClientResponse) Close() error {
 	return h.resp.Body.Close()
 }
 
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 const (
-	httpHeaderAccept      = "Accept"
-	httpHeaderContentType = "Content-Type"
-	httpHeaderUserAgent   = "User-Agent"
+	httpHeaderAccept          = "Accept"
+	httpHeaderAcceptEncoding  = "Accept-Encoding"
+	httpHeaderContentEncoding = "Content-Encoding"
+	httpHeaderContentType     = "Content-Type"
+	httpHeaderUserAgent       = "User-Agent"
 )
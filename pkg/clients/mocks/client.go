@@ -59,6 +59,19 @@ func (_mr *MockClientMockRecorder) Post(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Post", reflect.TypeOf((*MockClient)(nil).Post), arg0, arg1)
 }
 
+// PostStream mocks base method
+func (_m *MockClient) PostStream(_param0 string, _param1 io.Reader) (clients.Response, error) {
+	ret := _m.ctrl.Call(_m, "PostStream", _param0, _param1)
+	ret0, _ := ret[0].(clients.Response)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PostStream indicates an expected call of PostStream
+func (_mr *MockClientMockRecorder) PostStream(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "PostStream", reflect.TypeOf((*MockClient)(nil).PostStream), arg0, arg1)
+}
+
 // MockResponse is a mock of Response interface
 type MockResponse struct {
 	ctrl     *gomock.Controller
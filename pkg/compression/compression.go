@@ -0,0 +1,197 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// Encoding compresses and decompresses streams of bytes. Each encoding is
+// named after its HTTP content coding.
+type Encoding interface {
+
+	// Name returns the name of the content coding.
+	Name() string
+
+	// NewWriter returns a Writer compressing everything written to it into w.
+	NewWriter(w io.Writer) Writer
+
+	// NewReader returns a reader decompressing everything read from r.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// Writer compresses everything written to it. Closing the writer flushes any
+// pending writes, without closing the underlying writer.
+type Writer interface {
+	io.WriteCloser
+
+	// Flush writes any pending writes to the underlying writer.
+	Flush() error
+}
+
+var (
+	// Identity leaves everything uncompressed.
+	Identity Encoding = identityEncoding{}
+
+	// Gzip compresses with gzip, trading speed for a better ratio.
+	Gzip Encoding = gzipEncoding{}
+
+	// Snappy compresses with the snappy framing format, trading ratio for
+	// speed.
+	Snappy Encoding = snappyEncoding{}
+)
+
+// Parse returns the encoding for the name of the content coding, an empty
+// name being the identity.
+func Parse(name string) (Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "identity", "none":
+		return Identity, nil
+	case "gzip":
+		return Gzip, nil
+	case "snappy":
+		return Snappy, nil
+	default:
+		return nil, errUnsupportedEncoding{errors.Errorf("unsupported encoding %q", name)}
+	}
+}
+
+// Negotiate returns the encoding most preferred by the accept encoding
+// header, falling back to the identity if no compression is accepted.
+func Negotiate(acceptEncoding string) Encoding {
+	var (
+		encoding = Identity
+		best     float64
+	)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		e, err := Parse(name)
+		if err != nil || e == Identity {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best {
+			encoding, best = e, q
+		}
+	}
+	return encoding
+}
+
+// Detect returns a reader decompressing r, detecting the encoding from the
+// first bytes of r. Anything not starting with the magic bytes of a known
+// encoding is read as is, so that uncompressed streams are left untouched.
+func Detect(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(snappyMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return Gzip.NewReader(br)
+	case bytes.HasPrefix(magic, snappyMagic):
+		return Snappy.NewReader(br)
+	default:
+		return br, nil
+	}
+}
+
+type identityEncoding struct{}
+
+func (identityEncoding) Name() string { return "identity" }
+
+func (identityEncoding) NewWriter(w io.Writer) Writer {
+	return identityWriter{w}
+}
+
+func (identityEncoding) NewReader(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+type identityWriter struct {
+	io.Writer
+}
+
+func (identityWriter) Flush() error { return nil }
+func (identityWriter) Close() error { return nil }
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) Name() string { return "gzip" }
+
+func (gzipEncoding) NewWriter(w io.Writer) Writer {
+	return gzip.NewWriter(w)
+}
+
+func (gzipEncoding) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type snappyEncoding struct{}
+
+func (snappyEncoding) Name() string { return "snappy" }
+
+func (snappyEncoding) NewWriter(w io.Writer) Writer {
+	return snappy.NewBufferedWriter(w)
+}
+
+func (snappyEncoding) NewReader(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+type unsupportedEncoding interface {
+	UnsupportedEncoding() bool
+}
+
+type errUnsupportedEncoding struct {
+	err error
+}
+
+func (e errUnsupportedEncoding) Error() string {
+	return e.err.Error()
+}
+
+func (e errUnsupportedEncoding) UnsupportedEncoding() bool {
+	return true
+}
+
+// ErrUnsupportedEncoding tests to see if the error passed is an unsupported
+// encoding error or not.
+func ErrUnsupportedEncoding(err error) bool {
+	if err != nil {
+		if _, ok := err.(unsupportedEncoding); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrTruncated tests to see if the error passed is from reading a compressed
+// stream that was cut short, for example by a crash before the writer was
+// closed. Snappy can't tell a stream that was cut short from a corrupt one, so
+// both are seen as truncated.
+func ErrTruncated(err error) bool {
+	return err == io.ErrUnexpectedEOF || err == snappy.ErrCorrupt
+}
@@ -0,0 +1,190 @@
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestEncoding(t *testing.T) {
+	t.Parallel()
+
+	encodings := []Encoding{Identity, Gzip, Snappy}
+
+	compress := func(t *testing.T, encoding Encoding, p []byte) []byte {
+		var buf bytes.Buffer
+		w := encoding.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, encoding := range encodings {
+			fn := func(p []byte) bool {
+				r, err := encoding.NewReader(bytes.NewReader(compress(t, encoding, p)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return bytes.Equal(p, b)
+			}
+			if err := quick.Check(fn, nil); err != nil {
+				t.Errorf("%s: %v", encoding.Name(), err)
+			}
+		}
+	})
+
+	t.Run("detect", func(t *testing.T) {
+		input := bytes.Repeat([]byte("records\n"), 128)
+		for _, encoding := range encodings {
+			r, err := Detect(bytes.NewReader(compress(t, encoding, input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := input, b; !bytes.Equal(expected, actual) {
+				t.Errorf("%s: expected: %q, actual: %q", encoding.Name(), expected, actual)
+			}
+		}
+	})
+
+	t.Run("detect empty", func(t *testing.T) {
+		r, err := Detect(bytes.NewReader(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(b); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		for _, testcase := range []struct {
+			name     string
+			expected Encoding
+		}{
+			{"", Identity},
+			{"none", Identity},
+			{"identity", Identity},
+			{"gzip", Gzip},
+			{"GZIP", Gzip},
+			{"snappy", Snappy},
+		} {
+			encoding, err := Parse(testcase.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := testcase.expected, encoding; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected.Name(), actual.Name())
+			}
+		}
+
+		_, err := Parse("br")
+		if expected, actual := true, ErrUnsupportedEncoding(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("negotiate", func(t *testing.T) {
+		for _, testcase := range []struct {
+			acceptEncoding string
+			expected       Encoding
+		}{
+			{"", Identity},
+			{"br", Identity},
+			{"gzip", Gzip},
+			{"snappy, gzip", Snappy},
+			{"snappy;q=0.5, gzip", Gzip},
+			{"gzip;q=0", Identity},
+		} {
+			if expected, actual := testcase.expected, Negotiate(testcase.acceptEncoding); expected != actual {
+				t.Errorf("expected: %s, actual: %s, accept encoding: %q", expected.Name(), actual.Name(), testcase.acceptEncoding)
+			}
+		}
+	})
+}
+
+func TestHTTP(t *testing.T) {
+	t.Parallel()
+
+	t.Run("response", func(t *testing.T) {
+		var (
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest("GET", "/", nil)
+		)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		cw := ResponseWriter(w, r)
+		if _, err := cw.Write([]byte("records")); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := "gzip", w.Header().Get("Content-Encoding"); expected != actual {
+			t.Fatalf("expected: %q, actual: %q", expected, actual)
+		}
+		gr, err := Gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "records", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("request body", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := Snappy.NewWriter(&buf)
+		w.Write([]byte("records"))
+		w.Close()
+
+		r := httptest.NewRequest("POST", "/", &buf)
+		r.Header.Set("Content-Encoding", "snappy")
+
+		body, err := RequestBody(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "records", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("unsupported request body", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("records"))
+		r.Header.Set("Content-Encoding", "br")
+
+		_, err := RequestBody(r)
+		if expected, actual := true, ErrUnsupportedEncoding(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package compression
+
+import (
+	"io"
+	"net/http"
+)
+
+const (
+	httpHeaderAcceptEncoding  = "Accept-Encoding"
+	httpHeaderContentEncoding = "Content-Encoding"
+	httpHeaderVary            = "Vary"
+)
+
+// ResponseWriter negotiates the encoding of the response with the accept
+// encoding header of the request, returning a Writer compressing the body of
+// the response. The Writer must be closed once the body has been written.
+func ResponseWriter(w http.ResponseWriter, r *http.Request) Writer {
+	w.Header().Add(httpHeaderVary, httpHeaderAcceptEncoding)
+
+	encoding := Negotiate(r.Header.Get(httpHeaderAcceptEncoding))
+	if encoding == Identity {
+		return Identity.NewWriter(w)
+	}
+	w.Header().Set(httpHeaderContentEncoding, encoding.Name())
+	return encoding.NewWriter(w)
+}
+
+// RequestBody returns the body of the request, decompressed according to the
+// content encoding header of the request.
+func RequestBody(r *http.Request) (io.Reader, error) {
+	encoding, err := Parse(r.Header.Get(httpHeaderContentEncoding))
+	if err != nil {
+		return nil, err
+	}
+	return encoding.NewReader(r.Body)
+}
@@ -1,79 +1,150 @@
 package consumer
 
 import (
-	"bytes"
 	"fmt"
+	"hash"
 	"io"
 	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/checksum"
 	"github.com/SimonRichardson/cluster/pkg/clients"
 	"github.com/SimonRichardson/cluster/pkg/cluster"
+	"github.com/SimonRichardson/cluster/pkg/fs"
 	"github.com/SimonRichardson/cluster/pkg/ingester"
 	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/SimonRichardson/cluster/pkg/placement"
+	"github.com/SimonRichardson/cluster/pkg/records"
 	"github.com/SimonRichardson/cluster/pkg/store"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
 )
 
 const (
-	defaultWaitTime = time.Second
+	defaultWaitTime      = time.Second
+	defaultRetryAttempts = 5
+	defaultRetryBackoff  = time.Second
+	defaultBatchSize     = 32
+
+	// defaultPendingTimeout matches the default pending segment timeout of
+	// the ingesters.
+	defaultPendingTimeout = time.Minute
+
+	spoolExt = ".spool"
 )
 
 // Consumer reads segments from the queue, and replicates merged segments to
 // the rest of the cluster. It's implemented as a state machine: gather
 // segments, replicate, commit, and repeat. All failures invalidate the entire
-// batch.
+// batch. The active segment is spooled to the filesystem, so that memory use is
+// bounded regardless of the segment size. The placement decides which peers a
+// segment is replicated to. Replication succeeds once the write quorum is
+// reached, with the remaining peers replicated to in the background. Pending
+// segments are heartbeated, so that they aren't failed by the ingesters whilst
+// still being read or replicated. Topics are consumed in order of priority, with
+// each segment holding the records of a single topic.
 type Consumer struct {
 	mutex              sync.Mutex
 	peer               cluster.Peer
 	client             clients.Client
+	filesys            fs.Filesystem
+	root               string
+	topics             []string
+	topic              string
 	segmentTargetSize  int64
 	segmentTargetAge   time.Duration
 	replicationFactor  int
+	writeQuorum        int
+	placement          placement.Placement
 	gatherErrors       int
+	pendingMutex       sync.Mutex
 	pending            map[string][]string
-	active             *bytes.Buffer
+	active             *spoolFile
 	activeSince        time.Time
+	stragglers         sync.WaitGroup
 	stop               chan chan struct{}
+	quit               chan struct{}
 	consumedSegments   metrics.Counter
 	consumedBytes      metrics.Counter
 	replicatedSegments metrics.Counter
 	replicatedBytes    metrics.Counter
+	replicationLatency metrics.HistogramVec
 	gatherWaitTime     time.Duration
+	retryAttempts      int
+	retryBackoff       time.Duration
+	heartbeatInterval  time.Duration
+	batchSize          int
 	logger             log.Logger
 }
 
-// NewConsumer creates a consumer.
+// NewConsumer creates a consumer. The root is where the active segment is
+// spooled to, so it should not be shared with any other consumer. The topics
+// are ordered from the highest priority, with only the default topic consumed
+// if there are none. The write quorum is clamped to the replication factor.
+// The pending timeout is that of the ingesters, with pending segments
+// heartbeated every third of it; zero uses the default of the ingesters.
 func NewConsumer(
 	peer cluster.Peer,
 	client clients.Client,
+	filesys fs.Filesystem,
+	root string,
+	topics []string,
 	segmentTargetSize int64,
 	segmentTargetAge time.Duration,
-	replicationFactor int,
+	replicationFactor, writeQuorum int,
+	placement placement.Placement,
+	pendingTimeout time.Duration,
 	consumedSegments, consumedBytes metrics.Counter,
 	replicatedSegments, replicatedBytes metrics.Counter,
+	replicationLatency metrics.HistogramVec,
 	logger log.Logger,
 ) *Consumer {
+	if writeQuorum <= 0 || writeQuorum > replicationFactor {
+		writeQuorum = replicationFactor
+	}
+	if len(topics) == 0 {
+		topics = []string{topic.Default}
+	}
+	if pendingTimeout <= 0 {
+		pendingTimeout = defaultPendingTimeout
+	}
 	return &Consumer{
 		mutex:              sync.Mutex{},
 		peer:               peer,
 		client:             client,
+		filesys:            filesys,
+		root:               root,
+		topics:             topics,
+		topic:              topic.Default,
 		segmentTargetSize:  segmentTargetSize,
 		segmentTargetAge:   segmentTargetAge,
 		replicationFactor:  replicationFactor,
+		writeQuorum:        writeQuorum,
+		placement:          placement,
 		gatherErrors:       0,
 		pending:            map[string][]string{},
-		active:             &bytes.Buffer{},
+		active:             nil,
 		activeSince:        time.Time{},
 		stop:               make(chan chan struct{}),
+		quit:               make(chan struct{}),
 		consumedSegments:   consumedSegments,
 		consumedBytes:      consumedBytes,
 		replicatedSegments: replicatedSegments,
 		replicatedBytes:    replicatedBytes,
+		replicationLatency: replicationLatency,
 		gatherWaitTime:     defaultWaitTime,
+		retryAttempts:      defaultRetryAttempts,
+		retryBackoff:       defaultRetryBackoff,
+		heartbeatInterval:  pendingTimeout / 3,
+		batchSize:          defaultBatchSize,
 		logger:             logger,
 	}
 }
@@ -81,6 +152,18 @@ func NewConsumer(
 // Run consumes segments from ingest nodes, and replicates them to the cluster.
 // Run returns when Stop is invoked.
 func (c *Consumer) Run() {
+	if err := c.removeSpools(); err != nil {
+		level.Warn(c.logger).Log("state", "run", "during", "spool", "err", err)
+	}
+
+	// Heartbeats are sent outside of the state machine, as reading or
+	// replicating a large segment can block it for a long time.
+	heartbeat := make(chan struct{})
+	go func() {
+		defer close(heartbeat)
+		c.heartbeat()
+	}()
+
 	step := time.NewTicker(100 * time.Millisecond)
 	defer step.Stop()
 
@@ -92,13 +175,17 @@ func (c *Consumer) Run() {
 
 		case q := <-c.stop:
 			c.fail()
+			close(c.quit)
+			<-heartbeat
+			c.stragglers.Wait()
 			close(q)
 			return
 		}
 	}
 }
 
-// Stop the consumer from consuming.
+// Stop the consumer from consuming, giving up on replicating to any
+// stragglers.
 func (c *Consumer) Stop() {
 	q := make(chan struct{})
 	c.stop <- q
@@ -132,7 +219,7 @@ func (c *Consumer) gather() stateFn {
 
 	// A naïve way to break out of the gather loop in atypical conditions.
 	if c.gatherErrors > 0 && c.gatherErrors > 2*len(ingestInstances) {
-		if c.active.Len() <= 0 {
+		if c.activeSize() <= 0 {
 			// We didn't successfully consume any segments.
 			// Nothing to do but reset and try again.
 			c.gatherErrors = 0
@@ -165,69 +252,122 @@ func (c *Consumer) gather() stateFn {
 
 	// More typical exit clauses.
 	var (
-		tooBig = int64(c.active.Len()) > c.segmentTargetSize
+		tooBig = c.activeSize() > c.segmentTargetSize
 		tooOld = !c.activeSince.IsZero() && time.Since(c.activeSince) > c.segmentTargetAge
 	)
 	if tooBig || tooOld {
 		return c.replicate
 	}
 
-	// Get a segment ID from a random ingester.
-	ingestInstance := ingestInstances[rand.Intn(len(ingestInstances))]
-	nextResp, err := c.client.Get(buildIngestNextIDPath(ingestInstance))
-	if err != nil {
-		// Normal, when the ingester has no more segments to give right now.
-		// after enough of these errors, we should replicate
-		warn.Log("ingester", ingestInstance, "during", ingester.APIPathNext, "err", err)
-		c.gatherErrors++
-		return c.gather
+	// Claim a batch of segments from a random ingester, up to what's left of
+	// the target size. The topics are tried in order of priority, unless the
+	// active segment already holds the records of a topic.
+	var (
+		ingestInstance = ingestInstances[rand.Intn(len(ingestInstances))]
+		budget         = c.segmentTargetSize - c.activeSize()
+		topics         = c.topics
+		nextIDs        []string
+	)
+	if budget < 1 {
+		budget = 1
 	}
-	defer nextResp.Close()
-
-	nextRespBody, err := nextResp.Bytes()
-	if err != nil {
-		warn.Log("ingester", ingestInstance, "during", ingester.APIPathNext, "err", err)
+	if c.active != nil {
+		topics = []string{c.topic}
+	}
+	for _, name := range topics {
+		if nextIDs, err = c.claim(ingestInstance, name, budget); err != nil {
+			// Normal, when the ingester has no more segments to give right now.
+			// after enough of these errors, we should replicate
+			warn.Log("ingester", ingestInstance, "topic", name, "during", ingester.APIPathBatchNext, "err", err)
+			continue
+		}
+		c.topic = name
+		break
+	}
+	if len(nextIDs) == 0 {
 		c.gatherErrors++
 		return c.gather
 	}
-	nextID := strings.TrimSpace(string(nextRespBody))
 
-	// Mark the segment ID as pending.
-	// From this point forward, we must either commit or fail the segment.
-	// If we do neither, it will eventually time out, but we should be nice.
-	c.pending[ingestInstance] = append(c.pending[ingestInstance], nextID)
+	// Mark the segment IDs as pending.
+	// From this point forward, we must either commit or fail the segments.
+	// If we do neither, they will eventually time out, but we should be nice.
+	c.pendingMutex.Lock()
+	c.pending[ingestInstance] = append(c.pending[ingestInstance], nextIDs...)
+	c.pendingMutex.Unlock()
 
-	// Read the segment.
-	readResp, err := c.client.Get(buildIngestIDPath(ingestInstance, nextID))
+	// Read the segments.
+	readResp, err := c.client.Get(buildIngestBatchReadPath(ingestInstance, nextIDs))
 	if err != nil {
-		// Reading failed, so we can't possibly commit the segment.
+		// Reading failed, so we can't possibly commit the segments.
 		// The simplest thing to do now is to fail everything.
-		warn.Log("ingester", ingestInstance, "during", ingester.APIPathRead, "err", err)
+		warn.Log("ingester", ingestInstance, "during", ingester.APIPathBatchRead, "err", err)
 		c.gatherErrors++
 		// fail everything
 		return c.fail
 	}
 	defer readResp.Close()
 
-	// Merge the segment into our active segment.
-	var cw countingWriter
-	if _, err := mergeRecords(c.active, io.TeeReader(readResp.Reader(), &cw)); err != nil {
-		warn.Log("ingester", ingestInstance, "during", "mergeRecords", "err", err)
-		c.gatherErrors++
-		// fail everything, same as above
-		return c.fail
+	// Merge the segments into our active segment.
+	if c.active == nil {
+		if c.active, err = c.spool(); err != nil {
+			warn.Log("ingester", ingestInstance, "during", "spool", "err", err)
+			c.gatherErrors++
+			// fail everything, as the segments can't be merged
+			return c.fail
+		}
+	}
+	var (
+		frames = ingester.NewFrameReader(readResp.Reader())
+		cw     countingWriter
+	)
+	for range nextIDs {
+		_, frame, err := frames.Next()
+		if err != nil {
+			// Either the stream was cut short, or the ingester didn't hand
+			// out every segment; either way, they can't all be committed.
+			warn.Log("ingester", ingestInstance, "during", ingester.APIPathBatchRead, "err", err)
+			c.gatherErrors++
+			return c.fail
+		}
+		if _, err := records.Merge(c.active, io.TeeReader(frame, &cw)); err != nil {
+			warn.Log("ingester", ingestInstance, "during", "records.Merge", "err", err)
+			c.gatherErrors++
+			// fail everything, same as above
+			return c.fail
+		}
+		c.consumedSegments.Inc()
 	}
 	if c.activeSince.IsZero() {
 		c.activeSince = time.Now()
 	}
 
 	// Repeat!
-	c.consumedSegments.Inc()
 	c.consumedBytes.Add(float64(cw.n))
 
 	return c.gather
 }
 
+// claim a batch of segments of the topic from the ingester, returning the ids
+// of the pending segments.
+func (c *Consumer) claim(instance, name string, budget int64) ([]string, error) {
+	resp, err := c.client.Get(buildIngestBatchNextPath(instance, name, c.batchSize, budget))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	b, err := resp.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(string(b))
+	if len(ids) == 0 {
+		return nil, errors.New("no segments")
+	}
+	return ids, nil
+}
+
 func (c *Consumer) replicate() stateFn {
 	var (
 		base = log.With(c.logger, "state", "replicate")
@@ -241,41 +381,159 @@ func (c *Consumer) replicate() stateFn {
 		return c.fail
 	}
 
-	var (
-		indices    = rand.Perm(len(peers))
-		replicated = 0
-	)
 	if want, have := c.replicationFactor, len(peers); have < want {
 		warn.Log("replication_factor", want, "available_peers", have, "err", "replication currently impossible")
 		return c.fail
 	}
+	if c.active == nil {
+		warn.Log("err", "no active segment")
+		return c.fail
+	}
 
-	for i := 0; i < len(indices) && replicated < c.replicationFactor; i++ {
-		var (
-			index  = indices[i]
-			target = peers[index]
-		)
-		resp, err := c.client.Post(buildStorePath(target), c.active.Bytes())
-		if err != nil {
-			warn.Log("target", target, "during", store.APIPathReplicate, "err", err)
+	// Replicate to the placed peers concurrently, replacing any that fail with
+	// the next of the remaining peers.
+	var (
+		name       = c.active.Name()
+		sum        = c.active.Sum32()
+		topic      = c.topic
+		targets    = c.placement.Place(spoolID(name), peers)
+		results    = make(chan replication, len(peers))
+		next       = 0
+		inflight   = 0
+		replicated = 0
+		failed     []string
+	)
+	send := func() {
+		target := targets[next]
+		next++
+		inflight++
+		go func() {
+			results <- replication{target, c.replicateTo(name, sum, topic, target)}
+		}()
+	}
+	for next < c.replicationFactor {
+		send()
+	}
+
+	for replicated < c.writeQuorum && inflight > 0 {
+		res := <-results
+		inflight--
+
+		if res.err != nil {
+			warn.Log("target", res.target, "during", store.APIPathReplicate, "err", res.err)
+			if next < len(peers) {
+				send()
+			} else {
+				failed = append(failed, res.target)
+			}
 			continue
 		}
-		resp.Close()
 		replicated++
 	}
 
-	if replicated < c.replicationFactor {
-		warn.Log("err", "failed to fully replicate", "want", c.replicationFactor, "have", replicated)
+	if replicated < c.writeQuorum {
+		warn.Log("err", "failed to reach write quorum", "want", c.writeQuorum, "have", replicated)
 		return c.fail
 	}
 
 	// All good!
 	c.replicatedSegments.Inc()
-	c.replicatedBytes.Add(float64(c.active.Len()))
+	c.replicatedBytes.Add(float64(c.activeSize()))
+
+	// Any peers that are yet to acknowledge are handed the spool, so they can
+	// carry on in the background whilst we move on to the next segment.
+	if inflight > 0 || len(failed) > 0 {
+		c.active.Close()
+		c.active = nil
+
+		c.stragglers.Add(1)
+		go c.replicateStragglers(name, sum, topic, results, inflight, failed)
+	}
 
 	return c.commit
 }
 
+// replicateStragglers waits for the inflight replications to complete,
+// retrying any that fail. Once all are done, the spool is removed.
+func (c *Consumer) replicateStragglers(name string, sum uint32, topic string, results <-chan replication, inflight int, failed []string) {
+	defer c.stragglers.Done()
+
+	var wg sync.WaitGroup
+	retry := func(target string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.retryReplicateTo(name, sum, topic, target)
+		}()
+	}
+
+	for _, target := range failed {
+		retry(target)
+	}
+	for ; inflight > 0; inflight-- {
+		if res := <-results; res.err != nil {
+			retry(res.target)
+		}
+	}
+	wg.Wait()
+
+	if err := c.filesys.Remove(name); err != nil {
+		level.Warn(c.logger).Log("state", "replicate", "during", "spool", "err", err)
+	}
+}
+
+// retryReplicateTo retries replicating the spool to the target, backing off
+// between each attempt, until it succeeds, runs out of attempts or the
+// consumer is stopped.
+func (c *Consumer) retryReplicateTo(name string, sum uint32, topic, target string) {
+	backoff := c.retryBackoff
+	for attempt := 1; attempt <= c.retryAttempts; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-c.quit:
+			return
+		}
+
+		err := c.replicateTo(name, sum, topic, target)
+		if err == nil {
+			return
+		}
+		level.Warn(c.logger).Log("state", "replicate", "target", target, "attempt", attempt, "err", err)
+		backoff *= 2
+	}
+	level.Error(c.logger).Log("state", "replicate", "target", target, "err", "giving up on straggler")
+}
+
+// replicateTo streams the spooled segment to the log of the topic on the
+// target, which verifies it against the checksum of the spool.
+func (c *Consumer) replicateTo(name string, sum uint32, topic, target string) error {
+	defer func(begin time.Time) {
+		c.replicationLatency.WithLabelValues(target).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	f, err := c.filesys.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "opening spool")
+	}
+	defer f.Close()
+
+	resp, err := c.client.PostStream(buildStorePath(target, topic, spoolID(name), sum), f)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if status := resp.Status(); status != http.StatusOK {
+		return errors.Errorf("unexpected status %d", status)
+	}
+	return nil
+}
+
+type replication struct {
+	target string
+	err    error
+}
+
 func (c *Consumer) commit() stateFn {
 	return c.resetVia("commit")
 }
@@ -290,11 +548,17 @@ func (c *Consumer) resetVia(commitOrFailed string) stateFn {
 		warn = level.Warn(base)
 	)
 
+	// Take the pending segments, so they're no longer heartbeated.
+	c.pendingMutex.Lock()
+	pending := c.pending
+	c.pending = map[string][]string{}
+	c.pendingMutex.Unlock()
+
 	// If commits fail, the segment may be re-replicated; that's OK.
 	// If fails fail, the segment will eventually time-out; that's also OK.
 	// So we have best-effort semantics, just log the error and move on.
 	var wg sync.WaitGroup
-	for instance, ids := range c.pending {
+	for instance, ids := range pending {
 		wg.Add(len(ids))
 		for _, id := range ids {
 			go func(instance, id string) {
@@ -315,14 +579,149 @@ func (c *Consumer) resetVia(commitOrFailed string) stateFn {
 
 	// Reset various pending things.
 	c.gatherErrors = 0
-	c.pending = map[string][]string{}
-	c.active.Reset()
+	c.topic = topic.Default
 	c.activeSince = time.Time{}
+	if c.active != nil {
+		c.active.Close()
+		if err := c.filesys.Remove(c.active.Name()); err != nil {
+			warn.Log("during", "spool", "err", err)
+		}
+		c.active = nil
+	}
 
 	// Back to the beginning.
 	return c.gather
 }
 
+// heartbeat extends the deadline of the pending segments every interval, until
+// the consumer is stopped.
+func (c *Consumer) heartbeat() {
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.extend()
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// extend the deadline of every pending segment. A segment that can't be
+// extended may be failed by the ingester and handed to another consumer, in
+// which case it will be replicated twice; that's OK, as records are merged.
+func (c *Consumer) extend() {
+	warn := level.Warn(log.With(c.logger, "state", "heartbeat"))
+
+	c.pendingMutex.Lock()
+	pending := make(map[string][]string, len(c.pending))
+	for instance, ids := range c.pending {
+		pending[instance] = append([]string{}, ids...)
+	}
+	c.pendingMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for instance, ids := range pending {
+		wg.Add(len(ids))
+		for _, id := range ids {
+			go func(instance, id string) {
+				defer wg.Done()
+
+				uri := buildIngestExtendPath(instance, id)
+				resp, err := c.client.Post(uri, nil)
+				if err != nil {
+					warn.Log("instance", instance, "during", "POST", "uri", uri, "err", err)
+					return
+				}
+				defer resp.Close()
+
+				if status := resp.Status(); status != http.StatusOK {
+					warn.Log("instance", instance, "during", "POST", "uri", uri, "err", fmt.Sprintf("unexpected status %d", status))
+				}
+			}(instance, id)
+		}
+	}
+	wg.Wait()
+}
+
+// spool creates a file for the active segment to be written to.
+func (c *Consumer) spool() (*spoolFile, error) {
+	if err := c.filesys.MkdirAll(c.root); err != nil {
+		return nil, errors.Wrapf(err, "creating path %s", c.root)
+	}
+	id, err := uuid.NewTime()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.filesys.Create(filepath.Join(c.root, fmt.Sprintf("%s%s", id, spoolExt)))
+	if err != nil {
+		return nil, err
+	}
+	return &spoolFile{File: f, hash: checksum.New()}, nil
+}
+
+// spoolFile checksums the active segment as it's written, so that the spool
+// doesn't have to be read again to be replicated.
+type spoolFile struct {
+	fs.File
+	hash hash.Hash32
+}
+
+func (s *spoolFile) Write(p []byte) (int, error) {
+	n, err := s.File.Write(p)
+	s.hash.Write(p[:n])
+	return n, err
+}
+
+// Sum32 returns the checksum of everything written to the spool.
+func (s *spoolFile) Sum32() uint32 {
+	return s.hash.Sum32()
+}
+
+// spoolID returns the id of the segment spooled to the file, which is also
+// the id the segment is stored with.
+func spoolID(name string) string {
+	return strings.TrimSuffix(filepath.Base(name), spoolExt)
+}
+
+// removeSpools removes any spools left over from a previous run.
+func (c *Consumer) removeSpools() error {
+	if !c.filesys.Exists(c.root) {
+		return nil
+	}
+
+	var toRemove []string
+	if err := c.filesys.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == spoolExt {
+			toRemove = append(toRemove, path)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, path := range toRemove {
+		if err := c.filesys.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeSize returns the number of bytes in the active segment.
+func (c *Consumer) activeSize() int64 {
+	if c.active == nil {
+		return 0
+	}
+	return c.active.Size()
+}
+
 type countingWriter struct{ n int64 }
 
 func (cw *countingWriter) Write(p []byte) (int, error) {
@@ -330,18 +729,22 @@ func (cw *countingWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func buildIngestNextIDPath(instance string) string {
-	return fmt.Sprintf("http://%s/ingest%s", instance, ingester.APIPathNext)
+func buildIngestBatchNextPath(instance, name string, count int, budget int64) string {
+	return fmt.Sprintf("http://%s/ingest%s?count=%d&bytes=%d%s", instance, ingester.APIPathBatchNext, count, budget, topic.Param(name))
 }
 
-func buildIngestIDPath(instance, id string) string {
-	return fmt.Sprintf("http://%s/ingest%s?id=%s", instance, ingester.APIPathRead, id)
+func buildIngestBatchReadPath(instance string, ids []string) string {
+	return fmt.Sprintf("http://%s/ingest%s?id=%s", instance, ingester.APIPathBatchRead, strings.Join(ids, "&id="))
 }
 
 func buildIngestResetPath(instance, reason, id string) string {
 	return fmt.Sprintf("http://%s/ingest/%s?id=%s", instance, reason, id)
 }
 
-func buildStorePath(instance string) string {
-	return fmt.Sprintf("http://%s/store%s", instance, store.APIPathReplicate)
+func buildIngestExtendPath(instance, id string) string {
+	return fmt.Sprintf("http://%s/ingest%s?id=%s", instance, ingester.APIPathExtend, id)
+}
+
+func buildStorePath(instance, name, id string, sum uint32) string {
+	return fmt.Sprintf("http://%s/store%s?id=%s&checksum=%s%s", instance, store.APIPathReplicate, id, checksum.Format(sum), topic.Param(name))
 }
@@ -5,17 +5,23 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"reflect"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/checksum"
 	clientsMocks "github.com/SimonRichardson/cluster/pkg/clients/mocks"
 	"github.com/SimonRichardson/cluster/pkg/cluster"
 	clusterMocks "github.com/SimonRichardson/cluster/pkg/cluster/mocks"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/ingester"
 	"github.com/SimonRichardson/cluster/pkg/members"
 	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/placement"
+	"github.com/SimonRichardson/cluster/pkg/topic"
 	"github.com/SimonRichardson/cluster/pkg/uuid"
 	"github.com/go-kit/kit/log"
 	"github.com/golang/mock/gomock"
@@ -67,6 +73,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 		)
@@ -78,11 +85,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -102,6 +115,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -114,11 +128,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -140,6 +160,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -156,16 +177,22 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
 		c.gatherErrors = 10
-		c.active.WriteString(input)
+		writeSpool(t, c, input)
 
 		got := c.guard(c.gather)
 		if expected, actual := c.replicate, got; !stateFnEqual(expected, actual) {
@@ -183,6 +210,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -194,11 +222,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -218,6 +252,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -233,11 +268,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -257,6 +298,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -270,11 +312,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -304,6 +352,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -320,16 +369,22 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
 		c.segmentTargetSize = 1
-		c.active.WriteString(input)
+		writeSpool(t, c, input)
 
 		got := c.guard(c.gather)
 		if expected, actual := c.replicate, got; !stateFnEqual(expected, actual) {
@@ -350,6 +405,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -361,17 +417,23 @@ func TestConsumerGather(t *testing.T) {
 		expectPeerType(peer, instances, cluster.PeerTypeStore)
 
 		client.EXPECT().
-			Get(URL(buildIngestNextIDPath(instance))).
+			Get(URL(buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100))).
 			Return(nil, errors.New("bad")).Times(1)
 
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -394,6 +456,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client   = clientsMocks.NewMockClient(ctrl)
 			response = clientsMocks.NewMockResponse(ctrl)
@@ -405,7 +468,7 @@ func TestConsumerGather(t *testing.T) {
 		expectPeerType(peer, instances, cluster.PeerTypeIngest)
 		expectPeerType(peer, instances, cluster.PeerTypeStore)
 
-		expectClientGet(client, response, buildIngestNextIDPath(instance))
+		expectClientGet(client, response, buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100))
 		response.EXPECT().
 			Bytes().
 			Return(nil, errors.New("bad"))
@@ -413,11 +476,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -440,6 +509,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client   = clientsMocks.NewMockClient(ctrl)
 			response = clientsMocks.NewMockResponse(ctrl)
@@ -456,21 +526,27 @@ func TestConsumerGather(t *testing.T) {
 		expectClientGetBytes(
 			client,
 			response,
-			buildIngestNextIDPath(instance),
+			buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100),
 			id,
 		)
 		client.EXPECT().
-			Get(URL(buildIngestIDPath(instance, string(id)))).
+			Get(URL(buildIngestBatchReadPath(instance, []string{string(id)}))).
 			Return(nil, errors.New("bad")).Times(1)
 
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -493,6 +569,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client   = clientsMocks.NewMockClient(ctrl)
 			response = clientsMocks.NewMockResponse(ctrl)
@@ -509,10 +586,10 @@ func TestConsumerGather(t *testing.T) {
 		expectClientGetBytes(
 			client,
 			response,
-			buildIngestNextIDPath(instance),
+			buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100),
 			id,
 		)
-		expectClientGet(client, response, buildIngestIDPath(instance, string(id)))
+		expectClientGet(client, response, buildIngestBatchReadPath(instance, []string{string(id)}))
 		response.EXPECT().
 			Reader().
 			Return(ioutil.NopCloser(strings.NewReader("\n\n")))
@@ -520,11 +597,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -547,6 +630,7 @@ func TestConsumerGather(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client   = clientsMocks.NewMockClient(ctrl)
 			response = clientsMocks.NewMockResponse(ctrl)
@@ -564,14 +648,14 @@ func TestConsumerGather(t *testing.T) {
 		expectClientGetBytes(
 			client,
 			response,
-			buildIngestNextIDPath(instance),
+			buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100),
 			id,
 		)
 		expectClientGetReader(
 			client,
 			response,
-			buildIngestIDPath(instance, string(id)),
-			ioutil.NopCloser(strings.NewReader(input)),
+			buildIngestBatchReadPath(instance, []string{string(id)}),
+			ioutil.NopCloser(strings.NewReader(frame(string(id), input))),
 		)
 
 		consumedSegments.EXPECT().Inc()
@@ -580,11 +664,17 @@ func TestConsumerGather(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -593,8 +683,10 @@ func TestConsumerGather(t *testing.T) {
 			t.Errorf("expected: %T, actual: %T", expected, actual)
 		}
 
-		want := []byte(input)
-		if expected, actual := want, c.active.Bytes(); !reflect.DeepEqual(expected, actual) {
+		// Merged records are always newline delimited, see "gather batch
+		// delimits segments".
+		want := []byte(input + "\n")
+		if expected, actual := want, readSpool(t, c); !reflect.DeepEqual(expected, actual) {
 			t.Errorf("expected: %s, actual: %s", string(expected), string(actual))
 		}
 		if expected, actual := time.Now().Add(-time.Millisecond), c.activeSince; !actual.After(expected) {
@@ -607,6 +699,303 @@ func TestConsumerGather(t *testing.T) {
 			t.Errorf("expected: %s, actual: %s", expected, actual)
 		}
 	})
+
+	t.Run("gather in order of priority", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
+
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instance  = "0.0.0.0:8080"
+			instances = []string{instance}
+
+			id    = uuid.MustNew().Bytes()
+			input = fmt.Sprintf("%s %s", string(id), uuid.MustNew().String())
+		)
+
+		expectPeerType(peer, instances, cluster.PeerTypeIngest)
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		// The audit topic has nothing to give, so the debug topic is next.
+		client.EXPECT().
+			Get(URL(buildIngestBatchNextPath(instance, "audit", defaultBatchSize, 100))).
+			Return(nil, errors.New("not found")).Times(1)
+		expectClientGetBytes(
+			client,
+			response,
+			buildIngestBatchNextPath(instance, "debug", defaultBatchSize, 100),
+			id,
+		)
+		expectClientGetReader(
+			client,
+			response,
+			buildIngestBatchReadPath(instance, []string{string(id)}),
+			ioutil.NopCloser(strings.NewReader(frame(string(id), input))),
+		)
+
+		consumedSegments.EXPECT().Inc()
+		consumedBytes.EXPECT().Add(float64(len(input)))
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			[]string{"audit", "debug"},
+			100,
+			time.Minute,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		c.guard(c.gather)
+		if expected, actual := "debug", c.topic; expected != actual {
+			t.Fatalf("expected: %q, actual: %q", expected, actual)
+		}
+
+		// Once the active segment holds records of a topic, only that topic
+		// is gathered.
+		expectPeerType(peer, instances, cluster.PeerTypeIngest)
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+		client.EXPECT().
+			Get(URL(buildIngestBatchNextPath(instance, "debug", defaultBatchSize, 100-int64(len(input)+1)))).
+			Return(nil, errors.New("not found")).Times(1)
+
+		got := c.guard(c.gather)
+		if expected, actual := c.gather, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := 1, c.gatherErrors; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("gather batch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
+
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instance  = "0.0.0.0:8080"
+			instances = []string{instance}
+
+			ids    = []string{uuid.MustNew().String(), uuid.MustNew().String()}
+			inputs = []string{
+				fmt.Sprintf("%s A\n", uuid.MustNewTime()),
+				fmt.Sprintf("%s B\n", uuid.MustNewTime()),
+			}
+		)
+
+		expectPeerType(peer, instances, cluster.PeerTypeIngest)
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		expectClientGetBytes(
+			client,
+			response,
+			buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100),
+			[]byte(strings.Join(ids, "\n")),
+		)
+		expectClientGetReader(
+			client,
+			response,
+			buildIngestBatchReadPath(instance, ids),
+			ioutil.NopCloser(strings.NewReader(frame(ids[0], inputs[0])+frame(ids[1], inputs[1]))),
+		)
+
+		consumedSegments.EXPECT().Inc().Times(2)
+		consumedBytes.EXPECT().Add(float64(len(inputs[0]) + len(inputs[1])))
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		got := c.guard(c.gather)
+		if expected, actual := c.gather, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+
+		if expected, actual := inputs[0]+inputs[1], string(readSpool(t, c)); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := ids, c.pending[instance]; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("gather batch delimits segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
+
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instance  = "0.0.0.0:8080"
+			instances = []string{instance}
+
+			ids = []string{uuid.MustNew().String(), uuid.MustNew().String()}
+			// Neither segment ends with a newline, which would join their
+			// records in the spool, if they weren't delimited when merged.
+			inputs = []string{
+				fmt.Sprintf("%s A", uuid.MustNewTime()),
+				fmt.Sprintf("%s B", uuid.MustNewTime()),
+			}
+		)
+
+		expectPeerType(peer, instances, cluster.PeerTypeIngest)
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		expectClientGetBytes(
+			client,
+			response,
+			buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100),
+			[]byte(strings.Join(ids, "\n")),
+		)
+		expectClientGetReader(
+			client,
+			response,
+			buildIngestBatchReadPath(instance, ids),
+			ioutil.NopCloser(strings.NewReader(frame(ids[0], inputs[0])+frame(ids[1], inputs[1]))),
+		)
+
+		consumedSegments.EXPECT().Inc().Times(2)
+		consumedBytes.EXPECT().Add(float64(len(inputs[0]) + len(inputs[1])))
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		got := c.guard(c.gather)
+		if expected, actual := c.gather, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+
+		if expected, actual := inputs[0]+"\n"+inputs[1]+"\n", string(readSpool(t, c)); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("gather batch with missing frame", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
+
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instance  = "0.0.0.0:8080"
+			instances = []string{instance}
+
+			ids   = []string{uuid.MustNew().String(), uuid.MustNew().String()}
+			input = fmt.Sprintf("%s A\n", uuid.MustNewTime())
+		)
+
+		expectPeerType(peer, instances, cluster.PeerTypeIngest)
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		expectClientGetBytes(
+			client,
+			response,
+			buildIngestBatchNextPath(instance, topic.Default, defaultBatchSize, 100),
+			[]byte(strings.Join(ids, "\n")),
+		)
+		expectClientGetReader(
+			client,
+			response,
+			buildIngestBatchReadPath(instance, ids),
+			ioutil.NopCloser(strings.NewReader(frame(ids[0], input))),
+		)
+
+		consumedSegments.EXPECT().Inc().Times(1)
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		got := c.guard(c.gather)
+		if expected, actual := c.fail, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := 1, c.gatherErrors; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
 }
 
 func TestConsumerReplicate(t *testing.T) {
@@ -622,6 +1011,7 @@ func TestConsumerReplicate(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 		)
@@ -633,11 +1023,17 @@ func TestConsumerReplicate(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -657,6 +1053,7 @@ func TestConsumerReplicate(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -669,11 +1066,17 @@ func TestConsumerReplicate(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			10,
+			10, 10,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -693,6 +1096,7 @@ func TestConsumerReplicate(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -701,28 +1105,34 @@ func TestConsumerReplicate(t *testing.T) {
 
 			id    = uuid.MustNew().Bytes()
 			input = fmt.Sprintf("%s %s", string(id), uuid.MustNew().String())
-
-			b = bytes.NewBufferString(input)
 		)
 
 		expectPeerType(peer, instances, cluster.PeerTypeStore)
 
-		client.EXPECT().
-			Post(URL(buildStorePath(instance)), b.Bytes()).
-			Return(nil, errors.New("bad")).Times(1)
-
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
-		c.active = b
+		writeSpool(t, c, input)
+		segmentID := spoolID(c.active.Name())
+
+		client.EXPECT().
+			PostStream(URL(buildStorePath(instance, topic.Default, segmentID, checksum.Checksum([]byte(input)))), Body([]byte(input))).
+			Return(nil, errors.New("bad")).Times(1)
+		expectReplicationLatency(ctrl, replicationLatency, instance)
 
 		got := c.guard(c.replicate)
 		if expected, actual := c.fail, got; !stateFnEqual(expected, actual) {
@@ -740,6 +1150,7 @@ func TestConsumerReplicate(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client   = clientsMocks.NewMockClient(ctrl)
 			response = clientsMocks.NewMockResponse(ctrl)
@@ -749,39 +1160,260 @@ func TestConsumerReplicate(t *testing.T) {
 
 			id    = uuid.MustNew().Bytes()
 			input = fmt.Sprintf("%s %s", string(id), uuid.MustNew().String())
+		)
+
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		replicatedSegments.EXPECT().Inc()
+		replicatedBytes.EXPECT().Add(float64(len(input)))
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		writeSpool(t, c, input)
+		segmentID := spoolID(c.active.Name())
+
+		expectClientPostStream(
+			client,
+			response,
+			buildStorePath(instance, topic.Default, segmentID, checksum.Checksum([]byte(input))),
+			[]byte(input),
+		)
+		expectReplicationLatency(ctrl, replicationLatency, instance)
+
+		got := c.guard(c.replicate)
+		if expected, actual := c.commit, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+	})
+
+	t.Run("replicate to placed peer", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
-			b = bytes.NewBufferString(input)
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instances = []string{"0.0.0.0:8080", "0.0.0.0:8081", "0.0.0.0:8082"}
+			placer    = placement.NewRendezvous()
+
+			id    = uuid.MustNew().Bytes()
+			input = fmt.Sprintf("%s %s", string(id), uuid.MustNew().String())
 		)
 
 		expectPeerType(peer, instances, cluster.PeerTypeStore)
 
-		expectClientPost(
+		replicatedSegments.EXPECT().Inc()
+		replicatedBytes.EXPECT().Add(float64(len(input)))
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			1, 1,
+			placer,
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		writeSpool(t, c, input)
+		segmentID := spoolID(c.active.Name())
+
+		target := placer.Place(segmentID, instances)[0]
+		expectClientPostStream(
 			client,
 			response,
-			buildStorePath(instance),
-			b.Bytes(),
+			buildStorePath(target, topic.Default, segmentID, checksum.Checksum([]byte(input))),
+			[]byte(input),
+		)
+		expectReplicationLatency(ctrl, replicationLatency, target)
+
+		got := c.guard(c.replicate)
+		if expected, actual := c.commit, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+	})
+
+	t.Run("replicate with write quorum", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
+			observer           = metricMocks.NewMockObserver(ctrl)
+
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instances = []string{"0.0.0.0:8080", "0.0.0.0:8081", "0.0.0.0:8082"}
+
+			id    = uuid.MustNew().Bytes()
+			input = fmt.Sprintf("%s %s", string(id), uuid.MustNew().String())
 		)
 
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		replicationLatency.EXPECT().
+			WithLabelValues(gomock.Any()).
+			Return(observer).Times(4)
+		observer.EXPECT().
+			Observe(gomock.Any()).Times(4)
+
 		replicatedSegments.EXPECT().Inc()
 		replicatedBytes.EXPECT().Add(float64(len(input)))
 
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			3, 2,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
+		c.retryAttempts, c.retryBackoff = 1, time.Millisecond
+
+		writeSpool(t, c, input)
+		segmentID := spoolID(c.active.Name())
+
+		for _, instance := range instances[:2] {
+			client.EXPECT().
+				PostStream(URL(buildStorePath(instance, topic.Default, segmentID, checksum.Checksum([]byte(input)))), Body([]byte(input))).
+				Return(response, nil).Times(1)
+		}
+		response.EXPECT().
+			Status().
+			Return(http.StatusOK).Times(2)
+		response.EXPECT().
+			Close().
+			Return(nil).Times(2)
 
-		c.active = b
+		// The straggler fails, and then fails again when it's retried.
+		client.EXPECT().
+			PostStream(URL(buildStorePath(instances[2], topic.Default, segmentID, checksum.Checksum([]byte(input)))), Body([]byte(input))).
+			Return(nil, errors.New("bad")).Times(2)
+		name := c.active.Name()
 
 		got := c.guard(c.replicate)
 		if expected, actual := c.commit, got; !stateFnEqual(expected, actual) {
 			t.Errorf("expected: %T, actual: %T", expected, actual)
 		}
+
+		c.stragglers.Wait()
+
+		if expected, actual := false, c.filesys.Exists(name); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("replicate without write quorum", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer               = clusterMocks.NewMockPeer(ctrl)
+			consumedSegments   = metricMocks.NewMockCounter(ctrl)
+			consumedBytes      = metricMocks.NewMockCounter(ctrl)
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
+			observer           = metricMocks.NewMockObserver(ctrl)
+
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instances = []string{"0.0.0.0:8080", "0.0.0.0:8081"}
+
+			id    = uuid.MustNew().Bytes()
+			input = fmt.Sprintf("%s %s", string(id), uuid.MustNew().String())
+		)
+
+		expectPeerType(peer, instances, cluster.PeerTypeStore)
+
+		replicationLatency.EXPECT().
+			WithLabelValues(gomock.Any()).
+			Return(observer).Times(2)
+		observer.EXPECT().
+			Observe(gomock.Any()).Times(2)
+
+		c := NewConsumer(
+			peer,
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			2, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			consumedSegments, consumedBytes,
+			replicatedSegments, replicatedBytes,
+			replicationLatency,
+			log.NewNopLogger(),
+		)
+
+		writeSpool(t, c, input)
+		segmentID := spoolID(c.active.Name())
+
+		client.EXPECT().
+			PostStream(URL(buildStorePath(instances[0], topic.Default, segmentID, checksum.Checksum([]byte(input)))), Body([]byte(input))).
+			Return(response, nil).Times(1)
+		response.EXPECT().
+			Status().
+			Return(http.StatusInternalServerError).Times(1)
+		response.EXPECT().
+			Close().
+			Return(nil).Times(1)
+		client.EXPECT().
+			PostStream(URL(buildStorePath(instances[1], topic.Default, segmentID, checksum.Checksum([]byte(input)))), Body([]byte(input))).
+			Return(nil, errors.New("bad")).Times(1)
+
+		got := c.guard(c.replicate)
+		if expected, actual := c.fail, got; !stateFnEqual(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
 	})
 }
 
@@ -798,6 +1430,7 @@ func TestConsumerReset(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client = clientsMocks.NewMockClient(ctrl)
 
@@ -813,11 +1446,17 @@ func TestConsumerReset(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
@@ -839,6 +1478,7 @@ func TestConsumerReset(t *testing.T) {
 			consumedBytes      = metricMocks.NewMockCounter(ctrl)
 			replicatedSegments = metricMocks.NewMockCounter(ctrl)
 			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			replicationLatency = metricMocks.NewMockHistogramVec(ctrl)
 
 			client   = clientsMocks.NewMockClient(ctrl)
 			response = clientsMocks.NewMockResponse(ctrl)
@@ -858,21 +1498,35 @@ func TestConsumerReset(t *testing.T) {
 		c := NewConsumer(
 			peer,
 			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
 			100,
 			time.Minute,
-			1,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
 			consumedSegments, consumedBytes,
 			replicatedSegments, replicatedBytes,
+			replicationLatency,
 			log.NewNopLogger(),
 		)
 
 		c.pending[instance] = []string{id}
+		writeSpool(t, c, id)
+		name := c.active.Name()
 
 		got := c.guard(c.commit)
 		if expected, actual := c.gather, got; !stateFnEqual(expected, actual) {
 			t.Errorf("expected: %T, actual: %T", expected, actual)
 		}
 
+		if expected, actual := false, c.filesys.Exists(name); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := int64(0), c.activeSize(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
 		if expected, actual := 0, c.gatherErrors; expected != actual {
 			t.Errorf("expected: %d, actual: %d", expected, actual)
 		}
@@ -912,6 +1566,60 @@ func expectClientPost(c *clientsMocks.MockClient,
 		Return(nil)
 }
 
+func expectClientPostStream(c *clientsMocks.MockClient,
+	r *clientsMocks.MockResponse,
+	u string,
+	b []byte,
+) {
+	c.EXPECT().
+		PostStream(URL(u), Body(b)).
+		Return(r, nil).Times(1)
+	r.EXPECT().
+		Status().
+		Return(http.StatusOK)
+	r.EXPECT().
+		Close().
+		Return(nil)
+}
+
+func expectReplicationLatency(ctrl *gomock.Controller,
+	h *metricMocks.MockHistogramVec,
+	target string,
+) {
+	observer := metricMocks.NewMockObserver(ctrl)
+	h.EXPECT().
+		WithLabelValues(target).
+		Return(observer).Times(1)
+	observer.EXPECT().
+		Observe(gomock.Any()).Times(1)
+}
+
+func writeSpool(t *testing.T, c *Consumer, input string) {
+	if c.active == nil {
+		var err error
+		if c.active, err = c.spool(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.active.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSpool(t *testing.T, c *Consumer) []byte {
+	f, err := c.filesys.Open(c.active.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
 type peerTypeMatcher struct {
 	peerType members.PeerType
 }
@@ -945,3 +1653,131 @@ func (m urlMatcher) String() string {
 }
 
 func URL(p string) gomock.Matcher { return urlMatcher{p} }
+
+type bodyMatcher struct {
+	body []byte
+}
+
+func (m bodyMatcher) Matches(x interface{}) bool {
+	if r, ok := x.(io.Reader); ok {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(b, m.body)
+	}
+	return false
+}
+
+func (m bodyMatcher) String() string {
+	return fmt.Sprintf("%q is body", m.body)
+}
+
+func Body(b []byte) gomock.Matcher { return bodyMatcher{b} }
+
+func TestConsumerHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	newConsumer := func(ctrl *gomock.Controller, client *clientsMocks.MockClient) *Consumer {
+		return NewConsumer(
+			clusterMocks.NewMockPeer(ctrl),
+			client,
+			fs.NewVirtualFilesystem(),
+			"/spool",
+			nil,
+			100,
+			time.Minute,
+			1, 1,
+			placement.NewRendezvous(),
+			time.Minute,
+			metricMocks.NewMockCounter(ctrl), metricMocks.NewMockCounter(ctrl),
+			metricMocks.NewMockCounter(ctrl), metricMocks.NewMockCounter(ctrl),
+			metricMocks.NewMockHistogramVec(ctrl),
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		c := newConsumer(ctrl, clientsMocks.NewMockClient(ctrl))
+		if expected, actual := 20*time.Second, c.heartbeatInterval; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			client   = clientsMocks.NewMockClient(ctrl)
+			response = clientsMocks.NewMockResponse(ctrl)
+
+			instances = []string{"0.0.0.0:8080", "0.0.0.0:8081"}
+			ids       = []string{uuid.MustNew().String(), uuid.MustNew().String()}
+		)
+
+		for i, instance := range instances {
+			client.EXPECT().
+				Post(URL(buildIngestExtendPath(instance, ids[i])), nil).
+				Return(response, nil).Times(1)
+		}
+		response.EXPECT().
+			Status().
+			Return(http.StatusOK).Times(2)
+		response.EXPECT().
+			Close().
+			Return(nil).Times(2)
+
+		c := newConsumer(ctrl, client)
+		for i, instance := range instances {
+			c.pending[instance] = []string{ids[i]}
+		}
+
+		c.extend()
+	})
+
+	t.Run("extend with client failure", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			client = clientsMocks.NewMockClient(ctrl)
+
+			instance = "0.0.0.0:8080"
+			id       = uuid.MustNew().String()
+		)
+
+		client.EXPECT().
+			Post(URL(buildIngestExtendPath(instance, id)), nil).
+			Return(nil, errors.New("bad")).Times(1)
+
+		c := newConsumer(ctrl, client)
+		c.pending[instance] = []string{id}
+
+		c.extend()
+
+		// The segment is still pending, so it's committed or failed as usual.
+		if expected, actual := 1, len(c.pending[instance]); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("nothing pending", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		c := newConsumer(ctrl, clientsMocks.NewMockClient(ctrl))
+		c.extend()
+	})
+}
+
+func frame(id, input string) string {
+	var buf bytes.Buffer
+	if err := ingester.WriteFrame(&buf, id, strings.NewReader(input), int64(len(input))); err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
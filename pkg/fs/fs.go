@@ -50,6 +50,10 @@ type Filesystem interface {
 
 	// Lock attempts to create a locking file for a given path.
 	Lock(string) (Releaser, bool, error)
+
+	// FreeSpace returns the number of bytes available on the filesystem that
+	// holds the path, or returns an error upon failure.
+	FreeSpace(string) (int64, error)
 }
 
 // File is an abstraction for reading, writing and also closing a file. These
@@ -84,6 +84,10 @@ func (localFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	return filepath.Walk(root, walkFn)
 }
 
+func (localFilesystem) FreeSpace(path string) (int64, error) {
+	return freeSpace(path)
+}
+
 func (localFilesystem) Lock(path string) (r Releaser, existed bool, err error) {
 	r, existed, err = lock.New(path)
 	r = deletingReleaser{path, r}
@@ -0,0 +1,13 @@
+// +build darwin linux
+
+package fs
+
+import "syscall"
+
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"math"
 	"path/filepath"
 	"time"
 )
@@ -21,6 +22,7 @@ func (nopFilesystem) Walk(root string, walkFn filepath.WalkFunc) error  { return
 func (nopFilesystem) MkdirAll(path string) error                        { return nil }
 func (nopFilesystem) Chtimes(path string, atime, mtime time.Time) error { return nil }
 func (nopFilesystem) Lock(path string) (Releaser, bool, error)          { return nopReleaser{}, false, nil }
+func (nopFilesystem) FreeSpace(path string) (int64, error)              { return math.MaxInt64, nil }
 
 type nopFile struct{}
 
@@ -3,6 +3,7 @@ package fs
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -45,7 +46,9 @@ func (fs *virtualFilesystem) Open(path string) (File, error) {
 	if !ok {
 		return nil, errNotFound{os.ErrNotExist}
 	}
-	return f, nil
+	// os.Open gives each caller their own offset, so reading doesn't drain the
+	// file for anyone else.
+	return f.open(path), nil
 }
 
 func (fs *virtualFilesystem) Rename(oldname, newname string) error {
@@ -61,6 +64,10 @@ func (fs *virtualFilesystem) Rename(oldname, newname string) error {
 	delete(fs.files, oldname)
 	fs.files[newname] = f
 
+	f.mutex.Lock()
+	f.name = newname
+	f.mutex.Unlock()
+
 	return nil
 }
 
@@ -106,8 +113,11 @@ func (fs *virtualFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
 
+	// Only paths within the root directory are walked, so that a root isn't
+	// mistaken for a sibling sharing the same prefix.
+	dir := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
 	for path, f := range fs.files {
-		if !strings.HasPrefix(path, root) {
+		if path != root && !strings.HasPrefix(path, dir) {
 			continue
 		}
 
@@ -122,6 +132,11 @@ func (fs *virtualFilesystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	return nil
 }
 
+// FreeSpace is unlimited, as the files are held in memory.
+func (fs *virtualFilesystem) FreeSpace(path string) (int64, error) {
+	return math.MaxInt64, nil
+}
+
 func (fs *virtualFilesystem) Lock(path string) (r Releaser, existed bool, err error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
@@ -152,6 +167,19 @@ type virtualFile struct {
 	mtime time.Time
 }
 
+func (f *virtualFile) open(path string) *virtualFile {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	res := &virtualFile{
+		name:  path,
+		atime: f.atime,
+		mtime: f.mtime,
+	}
+	res.buf.Write(f.buf.Bytes())
+	return res
+}
+
 func (f *virtualFile) Read(p []byte) (int, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
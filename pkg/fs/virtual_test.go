@@ -3,9 +3,12 @@ package fs
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -61,6 +64,36 @@ func TestVirtualFilesystem(t *testing.T) {
 		}
 	})
 
+	t.Run("open twice", func(t *testing.T) {
+		var (
+			fsys = NewVirtualFilesystem()
+			path = fmt.Sprintf("tmpfile-%d", rand.Intn(1000))
+		)
+
+		file, err := fsys.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			f, err := fsys.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := "content", string(b); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
 	t.Run("rename", func(t *testing.T) {
 		dir := fmt.Sprintf("tmpdir-%d", rand.Intn(1000))
 		fsys := NewVirtualFilesystem()
@@ -164,6 +197,28 @@ func TestVirtualFilesystem(t *testing.T) {
 			t.Errorf("expected: %t, actual: %t", expected, actual)
 		}
 	})
+
+	t.Run("walk skips siblings sharing a prefix", func(t *testing.T) {
+		fsys := NewVirtualFilesystem()
+		for _, path := range []string{"dir/a", "dir/sub/b", "dir2/c"} {
+			if _, err := fsys.Create(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var paths []string
+		if err := fsys.Walk("dir", func(path string, info os.FileInfo, err error) error {
+			paths = append(paths, path)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(paths)
+
+		if expected, actual := "dir/a dir/sub/b", strings.Join(paths, " "); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
 }
 
 func TestVirtualFile(t *testing.T) {
@@ -1,62 +1,149 @@
 package ingester
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/compression"
 	"github.com/SimonRichardson/cluster/pkg/metrics"
 	"github.com/SimonRichardson/cluster/pkg/queue"
+	"github.com/SimonRichardson/cluster/pkg/records"
 	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
 )
 
+// Paths that claim, write or manage the segments of a queue take the topic of
+// the queue, which is the default topic if none is given. Pending segments are
+// known by their id alone.
 const (
 
 	// APIPathNext represents what the next segment to work on
 	APIPathNext = "/next"
 
-	// APIPathRead represents a way to read the segment by id
+	// APIPathRead represents a way to read the segment by id, compressed with
+	// the encoding negotiated by the accept encoding of the request.
 	APIPathRead = "/read"
 
+	// APIPathBatchNext represents a way to claim a batch of segments to work
+	// on, limited by a count and a byte budget.
+	APIPathBatchNext = "/batch/next"
+
+	// APIPathBatchRead represents a way to read a batch of segments by id, with
+	// each segment framed by its id and size. The whole batch is compressed
+	// with the encoding negotiated by the accept encoding of the request.
+	APIPathBatchRead = "/batch/read"
+
 	// APIPathCommit represents a way to commit a segment by id, so that it's no
 	// longer offered for reading.
 	APIPathCommit = "/commit"
 
 	// APIPathFailed represents a way to fail a segment by id.
 	APIPathFailed = "/failed"
+
+	// APIPathExtend represents a way to extend the deadline of a pending
+	// segment by id, so that it isn't failed whilst it's still being consumed.
+	APIPathExtend = "/extend"
+
+	// APIPathDead represents a way to list the dead segments, which failed too
+	// many times to be handed out again.
+	APIPathDead = "/dead"
+
+	// APIPathDeadRead represents a way to read a dead segment by id, so that
+	// it can be inspected.
+	APIPathDeadRead = "/dead/read"
+
+	// APIPathDeadRequeue represents a way to requeue a dead segment by id, so
+	// that it's handed out again.
+	APIPathDeadRequeue = "/dead/requeue"
+
+	// APIPathDeadDelete represents a way to delete a dead segment by id.
+	APIPathDeadDelete = "/dead/delete"
+
+	// APIPathAdminSegments represents a way to list every segment held by the
+	// queue, along with its state, size and age.
+	APIPathAdminSegments = "/admin/segments"
+
+	// APIPathAdminPending represents a way to list the pending segments that
+	// are claimed by consumers, along with their deadlines.
+	APIPathAdminPending = "/admin/pending"
+
+	// APIPathAdminFail represents a way to force a pending segment to fail by
+	// id, regardless of the consumer that claimed it.
+	APIPathAdminFail = "/admin/fail"
+
+	// APIPathAdminDelete represents a way to delete a flushed segment by its
+	// queue id, so that it's never handed out.
+	APIPathAdminDelete = "/admin/delete"
+
+	// APIPathWrite represents a way to write records to the active segment,
+	// in the format given by the content type and optionally compressed with
+	// the content encoding. The durability of the write can be selected per
+	// request. Writes are refused with a retry after once the queue is full.
+	APIPathWrite = "/write"
 )
 
+// Topic is a queue of segments kept apart from the segments of other topics,
+// along with the writer of its active segment.
+type Topic struct {
+	Name   string
+	Queue  queue.Queue
+	Writer *queue.RotatingWriter
+}
+
 // API serves the ingest API.
 type API struct {
-	queue                             queue.Queue
+	topics                            map[string]Topic
+	durability                        Durability
 	timeout                           time.Duration
+	retryAfter                        time.Duration
 	pending                           map[string]pendingSegment
 	action                            chan func()
 	stop                              chan chan struct{}
 	clients                           metrics.Gauge
 	failedSegments                    metrics.Counter
 	committedSegments, committedBytes metrics.Counter
+	corruptSegments                   metrics.Counter
 	duration                          metrics.HistogramVec
 }
 
 type pendingSegment struct {
+	topic    string
 	segment  queue.ReadSegment
 	deadline time.Time
 	reading  bool
+	consumer string
 }
 
-// NewAPI returns a usable ingest API.
+// NewAPI returns a usable ingest API, serving each of the topics.
 func NewAPI(
-	queue queue.Queue,
+	topics []Topic,
+	durability Durability,
 	pendingSegmentTimeout time.Duration,
+	queueFullRetryAfter time.Duration,
 	clients metrics.Gauge,
 	failedSegments, committedSegments, committedBytes metrics.Counter,
+	corruptSegments metrics.Counter,
 	duration metrics.HistogramVec,
 ) *API {
+	byName := make(map[string]Topic, len(topics))
+	for _, t := range topics {
+		byName[t.Name] = t
+	}
 	a := &API{
+		topics:            byName,
+		durability:        durability,
 		timeout:           pendingSegmentTimeout,
+		retryAfter:        queueFullRetryAfter,
 		pending:           map[string]pendingSegment{},
 		action:            make(chan func()),
 		stop:              make(chan chan struct{}),
@@ -64,6 +151,7 @@ func NewAPI(
 		failedSegments:    failedSegments,
 		committedSegments: committedSegments,
 		committedBytes:    committedBytes,
+		corruptSegments:   corruptSegments,
 		duration:          duration,
 	}
 	go a.loop()
@@ -93,10 +181,34 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		a.handleNext(w, r)
 	case method == "GET" && path == APIPathRead:
 		a.handleRead(w, r)
+	case method == "GET" && path == APIPathBatchNext:
+		a.handleBatchNext(w, r)
+	case method == "GET" && path == APIPathBatchRead:
+		a.handleBatchRead(w, r)
 	case method == "POST" && path == APIPathCommit:
 		a.handleCommit(w, r)
 	case method == "POST" && path == APIPathFailed:
 		a.handleFailed(w, r)
+	case method == "POST" && path == APIPathExtend:
+		a.handleExtend(w, r)
+	case method == "POST" && path == APIPathWrite:
+		a.handleWrite(w, r)
+	case method == "GET" && path == APIPathDead:
+		a.handleDead(w, r)
+	case method == "GET" && path == APIPathDeadRead:
+		a.handleDeadRead(w, r)
+	case method == "POST" && path == APIPathDeadRequeue:
+		a.handleDeadRequeue(w, r)
+	case method == "POST" && path == APIPathDeadDelete:
+		a.handleDeadDelete(w, r)
+	case method == "GET" && path == APIPathAdminSegments:
+		a.handleAdminSegments(w, r)
+	case method == "GET" && path == APIPathAdminPending:
+		a.handleAdminPending(w, r)
+	case method == "POST" && path == APIPathAdminFail:
+		a.handleFailed(w, r)
+	case method == "POST" && path == APIPathAdminDelete:
+		a.handleAdminDelete(w, r)
 	default:
 		// Nothing found
 		http.NotFound(w, r)
@@ -147,13 +259,19 @@ func (a *API) clean(now time.Time) {
 }
 
 func (a *API) handleNext(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	var (
 		notFoundError       = make(chan struct{})
 		internalServerError = make(chan error)
 		nextID              = make(chan string)
 	)
 	a.action <- func() {
-		s, err := a.queue.Dequeue()
+		s, err := t.Queue.Dequeue()
 		if queue.ErrNoSegmentsAvailable(err) {
 			close(notFoundError)
 			return
@@ -168,7 +286,7 @@ func (a *API) handleNext(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		a.pending[id.String()] = pendingSegment{s, time.Now().Add(a.timeout), false}
+		a.pending[id.String()] = pendingSegment{t.Name, s, time.Now().Add(a.timeout), false, r.RemoteAddr}
 		nextID <- id.String()
 	}
 	select {
@@ -206,7 +324,140 @@ func (a *API) handleRead(w http.ResponseWriter, r *http.Request) {
 	}
 	select {
 	case s := <-segment:
-		io.Copy(w, s)
+		cw := compression.ResponseWriter(w, r)
+		if _, err := io.Copy(cw, s); checksum.ErrMismatch(err) {
+			// The segment has already been sent, so abort the response to
+			// make sure that the corrupt segment isn't taken as complete.
+			a.corruptSegments.Inc()
+			panic(http.ErrAbortHandler)
+		}
+		cw.Close()
+
+	case <-notFoundError:
+		http.NotFound(w, r)
+
+	case <-concurrentError:
+		http.Error(w, "another client is already reading this segment", http.StatusInternalServerError)
+	}
+}
+
+// BatchNext claims up to count segments, stopping early once the size of the
+// claimed segments reaches the byte budget. At least one segment is claimed.
+func (a *API) handleBatchNext(w http.ResponseWriter, r *http.Request) {
+	count, budget, err := parseBatchParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var (
+		notFoundError       = make(chan struct{})
+		internalServerError = make(chan error)
+		nextIDs             = make(chan []string)
+	)
+	a.action <- func() {
+		var (
+			ids  []string
+			size int64
+		)
+		for len(ids) < count && (budget <= 0 || size < budget) {
+			s, err := t.Queue.Dequeue()
+			if queue.ErrNoSegmentsAvailable(err) {
+				break
+			}
+			if err != nil {
+				internalServerError <- err
+				return
+			}
+			id, err := uuid.New()
+			if err != nil {
+				internalServerError <- err
+				return
+			}
+
+			a.pending[id.String()] = pendingSegment{t.Name, s, time.Now().Add(a.timeout), false, r.RemoteAddr}
+			ids = append(ids, id.String())
+			size += s.Size()
+		}
+		if len(ids) == 0 {
+			close(notFoundError)
+			return
+		}
+		nextIDs <- ids
+	}
+	select {
+	case <-notFoundError:
+		http.NotFound(w, r)
+
+	case err := <-internalServerError:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	case ids := <-nextIDs:
+		fmt.Fprint(w, strings.Join(ids, "\n"))
+	}
+}
+
+// BatchRead reads the pending segments for the ids, framing each one.
+func (a *API) handleBatchRead(w http.ResponseWriter, r *http.Request) {
+	ids := r.URL.Query()["id"]
+	if len(ids) == 0 {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		segments        = make(chan []queue.ReadSegment)
+		notFoundError   = make(chan struct{})
+		concurrentError = make(chan struct{})
+	)
+	a.action <- func() {
+		seen := make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			s, ok := a.pending[id]
+			if !ok {
+				close(notFoundError)
+				return
+			}
+			if _, ok := seen[id]; ok || s.reading {
+				close(concurrentError)
+				return
+			}
+			seen[id] = struct{}{}
+		}
+
+		res := make([]queue.ReadSegment, len(ids))
+		for i, id := range ids {
+			s := a.pending[id]
+			s.reading = true
+			a.pending[id] = s
+			res[i] = s.segment
+		}
+		segments <- res
+	}
+	select {
+	case res := <-segments:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		cw := compression.ResponseWriter(w, r)
+		for i, s := range res {
+			// Segments are sized as they're read, regardless of how they're
+			// compressed, so they're streamed straight into their frames.
+			if err := WriteFrame(cw, ids[i], s, s.Size()); err != nil {
+				// The frames are already being written, so the best we can do
+				// is to cut the response short, leaving out the frames that
+				// are yet to be written.
+				if checksum.ErrMismatch(err) {
+					a.corruptSegments.Inc()
+				}
+				cw.Close()
+				return
+			}
+		}
+		cw.Close()
 
 	case <-notFoundError:
 		http.NotFound(w, r)
@@ -300,6 +551,351 @@ func (a *API) handleFailed(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Extend renews the deadline of a pending segment.
+func (a *API) handleExtend(w http.ResponseWriter, r *http.Request) {
+	var (
+		notFoundError = make(chan struct{})
+		extendOK      = make(chan struct{})
+	)
+
+	a.action <- func() {
+		id := r.URL.Query().Get("id")
+		s, ok := a.pending[id]
+		if !ok {
+			close(notFoundError)
+			return
+		}
+
+		s.deadline = time.Now().Add(a.timeout)
+		a.pending[id] = s
+		close(extendOK)
+	}
+
+	select {
+	case <-notFoundError:
+		http.NotFound(w, r)
+
+	case <-extendOK:
+		fmt.Fprint(w, "Extend OK")
+	}
+}
+
+func (a *API) handleWrite(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	durability := a.durability
+	if d := r.URL.Query().Get("durability"); d != "" {
+		var err error
+		if durability, err = ParseDurability(d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := compression.RequestBody(r)
+	if compression.ErrUnsupportedEncoding(err) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate all the records up front, so that a bad request doesn't leave
+	// partial writes within the segment. The format of the records is given
+	// by the content type, defaulting to text.
+	var (
+		buf   bytes.Buffer
+		codec = records.CodecFor(r.Header.Get("Content-Type"))
+	)
+	n, err := copyRecords(&buf, codec.NewDecoder(body))
+	if records.ErrInvalidRecord(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if n == 0 {
+		fmt.Fprint(w, "No records")
+		return
+	}
+
+	if _, err := t.Writer.WriteSync(buf.Bytes(), n, durability.sync()); queue.ErrQueueFull(err) {
+		// Tell the client to back off until consumers catch up, or until
+		// there is disk space again.
+		code := http.StatusTooManyRequests
+		if queue.ErrDiskFull(err) {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(a.retryAfter.Seconds()))))
+		http.Error(w, err.Error(), code)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "Write OK")
+}
+
+// Dead lists the dead segments.
+func (a *API) handleDead(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var (
+		segments = make(chan []queue.DeadSegment)
+		deadErr  = make(chan error)
+	)
+	a.action <- func() {
+		res, err := t.Queue.DeadSegments()
+		if err != nil {
+			deadErr <- err
+			return
+		}
+		segments <- res
+	}
+
+	select {
+	case err := <-deadErr:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	case res := <-segments:
+		if res == nil {
+			res = []queue.DeadSegment{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// DeadRead reads a dead segment.
+func (a *API) handleDeadRead(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var (
+		segment = make(chan io.ReadCloser)
+		deadErr = make(chan error)
+	)
+	a.action <- func() {
+		s, err := t.Queue.OpenDead(r.URL.Query().Get("id"))
+		if err != nil {
+			deadErr <- err
+			return
+		}
+		segment <- s
+	}
+
+	select {
+	case err := <-deadErr:
+		queueError(w, err)
+
+	case s := <-segment:
+		defer s.Close()
+		if _, err := io.Copy(w, s); checksum.ErrMismatch(err) {
+			a.corruptSegments.Inc()
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// DeadRequeue makes a dead segment available for reading again.
+func (a *API) handleDeadRequeue(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	deadErr := make(chan error)
+	a.action <- func() {
+		deadErr <- t.Queue.Requeue(r.URL.Query().Get("id"))
+	}
+
+	if err := <-deadErr; err != nil {
+		queueError(w, err)
+		return
+	}
+	fmt.Fprint(w, "Requeue OK")
+}
+
+// DeadDelete removes a dead segment.
+func (a *API) handleDeadDelete(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	deadErr := make(chan error)
+	a.action <- func() {
+		deadErr <- t.Queue.DeleteDead(r.URL.Query().Get("id"))
+	}
+
+	if err := <-deadErr; err != nil {
+		queueError(w, err)
+		return
+	}
+	fmt.Fprint(w, "Delete OK")
+}
+
+// AdminSegments lists every segment held by the queue.
+func (a *API) handleAdminSegments(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var (
+		segments = make(chan []queue.Segment)
+		queueErr = make(chan error)
+	)
+	a.action <- func() {
+		res, err := t.Queue.Segments()
+		if err != nil {
+			queueErr <- err
+			return
+		}
+		segments <- res
+	}
+
+	select {
+	case err := <-queueErr:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	case res := <-segments:
+		now := time.Now()
+		statuses := make([]segmentStatus, len(res))
+		for i, s := range res {
+			statuses[i] = segmentStatus{Segment: s}
+			// The age is left out if it isn't known when the segment was
+			// created, rather than counting from the zero time.
+			if !s.Created.IsZero() {
+				statuses[i].Age = now.Sub(s.Created).String()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(statuses)
+	}
+}
+
+// AdminPending lists the pending segments, soonest deadline first.
+func (a *API) handleAdminPending(w http.ResponseWriter, r *http.Request) {
+	pending := make(chan []pendingStatus)
+	a.action <- func() {
+		res := make([]pendingStatus, 0, len(a.pending))
+		for id, s := range a.pending {
+			res = append(res, pendingStatus{
+				ID:       id,
+				Topic:    s.topic,
+				Size:     s.segment.Size(),
+				Deadline: s.deadline,
+				Reading:  s.reading,
+				Consumer: s.consumer,
+			})
+		}
+		pending <- res
+	}
+
+	res := <-pending
+	sort.Slice(res, func(i, j int) bool {
+		if a, b := res[i].Deadline, res[j].Deadline; !a.Equal(b) {
+			return a.Before(b)
+		}
+		return res[i].ID < res[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// AdminDelete removes a flushed segment from the queue.
+func (a *API) handleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	t, err := a.topicFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	queueErr := make(chan error)
+	a.action <- func() {
+		queueErr <- t.Queue.Delete(r.URL.Query().Get("id"))
+	}
+
+	if err := <-queueErr; err != nil {
+		queueError(w, err)
+		return
+	}
+	fmt.Fprint(w, "Delete OK")
+}
+
+// segmentStatus describes a segment held by the queue, along with how long ago
+// it was enqueued.
+type segmentStatus struct {
+	queue.Segment
+	Age string `json:"age,omitempty"`
+}
+
+// pendingStatus describes a pending segment, along with the address of the
+// consumer that claimed it.
+type pendingStatus struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	Size     int64     `json:"size"`
+	Deadline time.Time `json:"deadline"`
+	Reading  bool      `json:"reading"`
+	Consumer string    `json:"consumer"`
+}
+
+// topicFrom returns the topic named by the request, which is the default topic
+// if none is named.
+func (a *API) topicFrom(r *http.Request) (Topic, error) {
+	name := r.URL.Query().Get("topic")
+	t, ok := a.topics[name]
+	if !ok {
+		return Topic{}, errNotFound{errors.Errorf("unknown topic %q", name)}
+	}
+	return t, nil
+}
+
+func queueError(w http.ResponseWriter, err error) {
+	if queue.ErrNotFound(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// parseBatchParams reads the count and byte budget of a batch, defaulting to a
+// single segment without a budget.
+func parseBatchParams(values url.Values) (count int, budget int64, err error) {
+	count = 1
+	if v := values.Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count < 1 {
+			return 0, 0, errors.Errorf("invalid count %q", v)
+		}
+	}
+	if v := values.Get("bytes"); v != "" {
+		if budget, err = strconv.ParseInt(v, 10, 64); err != nil || budget < 0 {
+			return 0, 0, errors.Errorf("invalid bytes %q", v)
+		}
+	}
+	return count, budget, nil
+}
+
 type interceptingWriter struct {
 	code int
 	http.ResponseWriter
@@ -0,0 +1,709 @@
+package ingester
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/queue"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAPIExtend(t *testing.T) {
+	t.Parallel()
+
+	deadline := func(a *API, id string) time.Time {
+		c := make(chan time.Time)
+		a.action <- func() { c <- a.pending[id].deadline }
+		return <-c
+	}
+
+	t.Run("extend", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		segment, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := segment.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathNext, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		id := w.Body.String()
+
+		before := deadline(a, id)
+		time.Sleep(10 * time.Millisecond)
+
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathExtend+"?id="+id, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		if after := deadline(a, id); !after.After(before) {
+			t.Errorf("expected: %s to be after %s", after, before)
+		}
+	})
+
+	t.Run("extend unknown segment", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, _ := newAPI(t, ctrl)
+		defer a.Stop()
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathExtend+"?id=unknown", nil))
+		if expected, actual := http.StatusNotFound, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestAPIBatch(t *testing.T) {
+	t.Parallel()
+
+	enqueue := func(t *testing.T, q queue.Queue, data ...string) {
+		for _, d := range data {
+			segment, err := q.Enqueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := segment.Write([]byte(d)); err != nil {
+				t.Fatal(err)
+			}
+			if err := segment.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	next := func(t *testing.T, a *API, query string, code int) []string {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathBatchNext+query, nil))
+		if expected, actual := code, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		return strings.Fields(w.Body.String())
+	}
+
+	t.Run("next with count", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q, "a\n", "b\n", "c\n")
+
+		if expected, actual := 2, len(next(t, a, "?count=2", http.StatusOK)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, len(next(t, a, "?count=2", http.StatusOK)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		next(t, a, "?count=2", http.StatusNotFound)
+	})
+
+	t.Run("next with byte budget", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q, "aaaa\n", "bbbb\n", "cccc\n")
+
+		if expected, actual := 2, len(next(t, a, "?count=10&bytes=6", http.StatusOK)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("next with invalid count", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, _ := newAPI(t, ctrl)
+		defer a.Stop()
+
+		next(t, a, "?count=0", http.StatusBadRequest)
+	})
+
+	t.Run("read", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		input := []string{"a\n", "bb\n", "ccc\n"}
+		enqueue(t, q, input...)
+		ids := next(t, a, "?count=3", http.StatusOK)
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathBatchRead+"?id="+strings.Join(ids, "&id="), nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		frames := NewFrameReader(w.Body)
+		for i := range input {
+			id, r, err := frames.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := ids[i], id; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := input[i], string(b); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+		}
+		if _, _, err := frames.Next(); err != io.EOF {
+			t.Errorf("expected: %v, actual: %v", io.EOF, err)
+		}
+	})
+
+	t.Run("read compressed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q, "a\n")
+		ids := next(t, a, "", http.StatusOK)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", APIPathBatchRead+"?id="+ids[0], nil)
+		r.Header.Set("Accept-Encoding", "snappy")
+		a.ServeHTTP(w, r)
+		if expected, actual := "snappy", w.Header().Get("Content-Encoding"); expected != actual {
+			t.Fatalf("expected: %q, actual: %q", expected, actual)
+		}
+
+		body, err := compression.Snappy.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, frame, err := NewFrameReader(body).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "a\n", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("read unknown segment", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q, "a\n")
+		ids := next(t, a, "", http.StatusOK)
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathBatchRead+"?id="+ids[0]+"&id=unknown", nil))
+		if expected, actual := http.StatusNotFound, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("read twice", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q, "a\n")
+		ids := next(t, a, "", http.StatusOK)
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathBatchRead+"?id="+ids[0]+"&id="+ids[0], nil))
+		if expected, actual := http.StatusInternalServerError, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestAPIDead(t *testing.T) {
+	t.Parallel()
+
+	// kill hands out a segment and fails it twice, so that it's dead.
+	kill := func(t *testing.T, a *API, q queue.Queue) queue.DeadSegment {
+		segment, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment.Write([]byte("a\n"))
+		segment.Close()
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, httptest.NewRequest("GET", APIPathNext, nil))
+			if expected, actual := http.StatusOK, w.Code; expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+			id := w.Body.String()
+
+			w = httptest.NewRecorder()
+			a.ServeHTTP(w, httptest.NewRequest("POST", APIPathFailed+"?id="+id, nil))
+			if expected, actual := http.StatusOK, w.Code; expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathDead, nil))
+		var dead []queue.DeadSegment
+		if err := json.NewDecoder(w.Body).Decode(&dead); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(dead); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		return dead[0]
+	}
+
+	t.Run("read", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl, queue.WithMaxAttempts(2))
+		defer a.Stop()
+
+		dead := kill(t, a, q)
+		if expected, actual := 2, dead.Attempts; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathDeadRead+"?id="+dead.ID, nil))
+		if expected, actual := "a\n", w.Body.String(); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("requeue", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl, queue.WithMaxAttempts(2))
+		defer a.Stop()
+
+		dead := kill(t, a, q)
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathDeadRequeue+"?id="+dead.ID, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathNext, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl, queue.WithMaxAttempts(2))
+		defer a.Stop()
+
+		dead := kill(t, a, q)
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathDeadDelete+"?id="+dead.ID, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathDeadDelete+"?id="+dead.ID, nil))
+		if expected, actual := http.StatusNotFound, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestAPIAdmin(t *testing.T) {
+	t.Parallel()
+
+	enqueue := func(t *testing.T, q queue.Queue) {
+		segment, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment.Write([]byte("a\n"))
+		segment.Close()
+	}
+
+	next := func(t *testing.T, a *API) string {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathNext, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		return w.Body.String()
+	}
+
+	segments := func(t *testing.T, a *API) []segmentStatus {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathAdminSegments, nil))
+		var res []segmentStatus
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	pending := func(t *testing.T, a *API) []pendingStatus {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathAdminPending, nil))
+		var res []pendingStatus
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q)
+		enqueue(t, q)
+		next(t, a)
+
+		res := segments(t, a)
+		if expected, actual := 2, len(res); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for i, state := range []string{"pending", "flushed"} {
+			if expected, actual := state, res[i].State; expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+			if expected, actual := int64(2), res[i].Size; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if _, err := time.ParseDuration(res[i].Age); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q)
+		id := next(t, a)
+
+		res := pending(t, a)
+		if expected, actual := 1, len(res); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := id, res[0].ID; expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := false, res[0].Reading; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		// httptest requests come from a fixed remote address.
+		if expected, actual := "192.0.2.1:1234", res[0].Consumer; expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if res[0].Deadline.Before(time.Now()) {
+			t.Errorf("expected deadline in the future, actual: %v", res[0].Deadline)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q)
+		id := next(t, a)
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathAdminFail+"?id="+id, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		if expected, actual := 0, len(pending(t, a)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, q.Depth().Flushed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		enqueue(t, q)
+		id := segments(t, a)[0].ID
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathAdminDelete+"?id="+id, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathAdminDelete+"?id="+id, nil))
+		if expected, actual := http.StatusNotFound, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(segments(t, a)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestAPIWrite(t *testing.T) {
+	t.Parallel()
+
+	write := func(a *API) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", APIPathWrite, strings.NewReader(uuid.MustNewTime().String()+" a\n")))
+		return w
+	}
+
+	t.Run("write", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, q := newAPI(t, ctrl)
+		defer a.Stop()
+
+		if expected, actual := http.StatusOK, write(a).Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, q.Depth().Flushed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, _ := newAPI(t, ctrl, queue.WithQuota(queue.Quota{MaxSegments: 1}))
+		defer a.Stop()
+
+		if expected, actual := http.StatusOK, write(a).Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w := write(a)
+		if expected, actual := http.StatusTooManyRequests, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "1", w.Header().Get("Retry-After"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+}
+
+func TestAPITopics(t *testing.T) {
+	t.Parallel()
+
+	write := func(a *API, path string) int {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(uuid.MustNewTime().String()+" a\n")))
+		return w.Code
+	}
+
+	t.Run("write", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, queues := newTopicsAPI(t, ctrl, []string{topic.Default, "audit"})
+		defer a.Stop()
+
+		if expected, actual := http.StatusOK, write(a, APIPathWrite+"?topic=audit"); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for name, expected := range map[string]int{topic.Default: 0, "audit": 1} {
+			if actual := queues[name].Depth().Flushed; expected != actual {
+				t.Errorf("%q: expected: %d, actual: %d", name, expected, actual)
+			}
+		}
+	})
+
+	t.Run("write unknown topic", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, _ := newTopicsAPI(t, ctrl, []string{topic.Default, "audit"})
+		defer a.Stop()
+
+		if expected, actual := http.StatusNotFound, write(a, APIPathWrite+"?topic=debug"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("next", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		a, _ := newTopicsAPI(t, ctrl, []string{topic.Default, "audit"})
+		defer a.Stop()
+
+		if expected, actual := http.StatusOK, write(a, APIPathWrite+"?topic=audit"); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathBatchNext, nil))
+		if expected, actual := http.StatusNotFound, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathBatchNext+"?topic=audit", nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		id := w.Body.String()
+
+		// Pending segments are known by their id, regardless of the topic.
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathAdminPending, nil))
+		var pending []pendingStatus
+		if err := json.NewDecoder(w.Body).Decode(&pending); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(pending); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (pendingStatus{ID: id, Topic: "audit"}), (pendingStatus{ID: pending[0].ID, Topic: pending[0].Topic}); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", APIPathRead+"?id="+id, nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func newAPI(t *testing.T, ctrl *gomock.Controller, opts ...queue.Option) (*API, queue.Queue) {
+	a, queues := newTopicsAPI(t, ctrl, []string{topic.Default}, opts...)
+	return a, queues[topic.Default]
+}
+
+func newTopicsAPI(t *testing.T, ctrl *gomock.Controller, names []string, opts ...queue.Option) (*API, map[string]queue.Queue) {
+	var (
+		clients           = metricMocks.NewMockGauge(ctrl)
+		failedSegments    = metricMocks.NewMockCounter(ctrl)
+		committedSegments = metricMocks.NewMockCounter(ctrl)
+		committedBytes    = metricMocks.NewMockCounter(ctrl)
+		corruptSegments   = metricMocks.NewMockCounter(ctrl)
+		duration          = metricMocks.NewMockHistogramVec(ctrl)
+		observer          = metricMocks.NewMockObserver(ctrl)
+		writtenBytes      = metricMocks.NewMockCounter(ctrl)
+		writtenRecords    = metricMocks.NewMockCounter(ctrl)
+		rotations         = metricMocks.NewMockCounterVec(ctrl)
+	)
+
+	clients.EXPECT().Inc().AnyTimes()
+	clients.EXPECT().Dec().AnyTimes()
+	failedSegments.EXPECT().Inc().AnyTimes()
+	duration.EXPECT().WithLabelValues(gomock.Any(), gomock.Any(), gomock.Any()).Return(observer).AnyTimes()
+	observer.EXPECT().Observe(gomock.Any()).AnyTimes()
+	writtenBytes.EXPECT().Add(gomock.Any()).AnyTimes()
+	writtenRecords.EXPECT().Add(gomock.Any()).AnyTimes()
+	rotations.EXPECT().WithLabelValues(gomock.Any()).Return(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rotations",
+	})).AnyTimes()
+
+	var (
+		topics []Topic
+		queues = map[string]queue.Queue{}
+	)
+	for _, name := range names {
+		config, err := queue.Build(append([]queue.Option{queue.With("virtual")}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := queue.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every write is flushed into its own segment.
+		writer := queue.NewRotatingWriter(
+			q,
+			queue.RotationPolicy{MaxRecords: 1},
+			writtenBytes, writtenRecords,
+			rotations,
+			log.NewNopLogger(),
+		)
+
+		topics = append(topics, Topic{name, q, writer})
+		queues[name] = q
+	}
+
+	return NewAPI(
+		topics,
+		DurabilityNone,
+		time.Minute,
+		time.Second,
+		clients,
+		failedSegments, committedSegments, committedBytes,
+		corruptSegments,
+		duration,
+	), queues
+}
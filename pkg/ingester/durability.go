@@ -0,0 +1,57 @@
+package ingester
+
+import (
+	"strings"
+
+	"github.com/SimonRichardson/cluster/pkg/queue"
+	"github.com/pkg/errors"
+)
+
+// Durability describes what guarantees a write has before it's acknowledged.
+type Durability string
+
+const (
+
+	// DurabilityNone acknowledges a write once it's been written to the active
+	// segment, the segment is never explicitly synced.
+	DurabilityNone Durability = "none"
+
+	// DurabilityFlush acknowledges a write once it's been written to the active
+	// segment, the segment is then synced before it's rotated.
+	DurabilityFlush Durability = "flush"
+
+	// DurabilityFsync acknowledges a write only once the active segment has
+	// been synced.
+	DurabilityFsync Durability = "fsync"
+)
+
+func (d Durability) String() string {
+	return string(d)
+}
+
+// sync returns when a write should be synced to meet the durability guarantee.
+func (d Durability) sync() queue.Sync {
+	switch d {
+	case DurabilityFlush:
+		return queue.SyncOnRotate
+	case DurabilityFsync:
+		return queue.SyncImmediately
+	default:
+		return queue.SyncNever
+	}
+}
+
+// ParseDurability parses a potential durability and errors out if it's not a
+// known valid durability.
+func ParseDurability(d string) (Durability, error) {
+	switch strings.ToLower(d) {
+	case "none":
+		return DurabilityNone, nil
+	case "flush":
+		return DurabilityFlush, nil
+	case "fsync":
+		return DurabilityFsync, nil
+	default:
+		return "", errors.Errorf("invalid durability (%s)", d)
+	}
+}
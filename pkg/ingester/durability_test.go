@@ -0,0 +1,28 @@
+package ingester
+
+import "testing"
+
+func TestParseDurability(t *testing.T) {
+	for _, testcase := range []struct {
+		value string
+		want  Durability
+		valid bool
+	}{
+		{"none", DurabilityNone, true},
+		{"flush", DurabilityFlush, true},
+		{"fsync", DurabilityFsync, true},
+		{"FSYNC", DurabilityFsync, true},
+		{"", "", false},
+		{"bad", "", false},
+	} {
+		t.Run(testcase.value, func(t *testing.T) {
+			durability, err := ParseDurability(testcase.value)
+			if expected, actual := testcase.valid, err == nil; expected != actual {
+				t.Fatalf("expected: %t, actual: %t", expected, actual)
+			}
+			if expected, actual := testcase.want, durability; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package ingester
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/pkg/errors"
+)
+
+// WriteFrame writes size bytes of the segment read from r as a frame of a
+// batch read. Each frame is headed by a line holding the id and the size of
+// the segment, and trailed by a line holding the checksum of the segment.
+func WriteFrame(w io.Writer, id string, r io.Reader, size int64) error {
+	if _, err := fmt.Fprintf(w, "%s %d\n", id, size); err != nil {
+		return err
+	}
+
+	h := checksum.New()
+	if _, err := io.CopyN(io.MultiWriter(w, h), r, size); err != nil {
+		return err
+	}
+
+	// Segments are verified when they're fully read, so read past the end of
+	// the segment to make sure that it's not corrupt before trailing it.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s\n", checksum.Format(h.Sum32()))
+	return err
+}
+
+// FrameReader reads the frames of a batch read, one segment at a time.
+type FrameReader struct {
+	r       *bufio.Reader
+	current *frame
+}
+
+// NewFrameReader creates a FrameReader reading frames from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Next advances to the next frame, returning the id of the segment along with
+// a reader for the segment. The reader fails with a checksum mismatch error if
+// the segment doesn't match the checksum trailing it. Any part of the previous
+// segment that wasn't read is discarded. Next returns io.EOF once there are no
+// more frames.
+func (f *FrameReader) Next() (string, io.Reader, error) {
+	if f.current != nil {
+		if _, err := io.Copy(ioutil.Discard, f.current); err != nil {
+			return "", nil, err
+		}
+		f.current = nil
+	}
+
+	line, err := f.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", nil, io.EOF
+	} else if err != nil {
+		return "", nil, errors.Wrap(err, "reading frame header")
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", nil, errors.Errorf("invalid frame header %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return "", nil, errors.Errorf("invalid frame size %q", fields[1])
+	}
+
+	f.current = &frame{r: f.r, n: size, hash: checksum.New()}
+	return fields[0], f.current, nil
+}
+
+// frame reads the remaining bytes of a single segment, failing if the stream
+// ends before the segment does, or if the segment is corrupt.
+type frame struct {
+	r        *bufio.Reader
+	n        int64
+	hash     hash.Hash32
+	verified bool
+	err      error
+}
+
+func (f *frame) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, f.verify()
+	}
+	if int64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.hash.Write(p[:n])
+	f.n -= int64(n)
+	if err == io.EOF && f.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// verify reads the trailer of the frame once, returning io.EOF if the segment
+// matches the checksum held by the trailer.
+func (f *frame) verify() error {
+	if f.verified {
+		return f.err
+	}
+	f.verified = true
+
+	line, err := f.r.ReadString('\n')
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.err = errors.Wrap(err, "reading frame trailer")
+		return f.err
+	}
+
+	expected, err := checksum.Parse(strings.TrimSpace(line))
+	if err != nil {
+		f.err = err
+		return f.err
+	}
+	if f.err = checksum.Verify(expected, f.hash.Sum32()); f.err == nil {
+		f.err = io.EOF
+	}
+	return f.err
+}
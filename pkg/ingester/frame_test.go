@@ -0,0 +1,117 @@
+package ingester
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+)
+
+func TestFrames(t *testing.T) {
+	t.Parallel()
+
+	t.Run("round trip", func(t *testing.T) {
+		fn := func(segments [][]byte) bool {
+			var buf bytes.Buffer
+			for _, segment := range segments {
+				if err := WriteFrame(&buf, "id", bytes.NewReader(segment), int64(len(segment))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			frames := NewFrameReader(&buf)
+			for _, segment := range segments {
+				id, r, err := frames.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id != "id" || !bytes.Equal(segment, b) {
+					return false
+				}
+			}
+			_, _, err := frames.Next()
+			return err == io.EOF
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("skip unread frame", func(t *testing.T) {
+		frames := NewFrameReader(strings.NewReader(encodeFrame("a", "foo") + encodeFrame("b", "bar")))
+		if _, _, err := frames.Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		id, r, err := frames.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "b", id; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "bar", string(b); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("truncated frame", func(t *testing.T) {
+		frames := NewFrameReader(strings.NewReader("a 10\nfoo"))
+		_, r, err := frames.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("expected: %v, actual: %v", io.ErrUnexpectedEOF, err)
+		}
+	})
+
+	t.Run("corrupt frame", func(t *testing.T) {
+		input := []byte(encodeFrame("a", "foo"))
+		input[len("a 3\n")] = 'g'
+
+		_, r, err := NewFrameReader(bytes.NewReader(input)).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); !checksum.ErrMismatch(err) {
+			t.Errorf("expected checksum mismatch, actual: %v", err)
+		}
+	})
+
+	t.Run("missing trailer", func(t *testing.T) {
+		_, r, err := NewFrameReader(strings.NewReader("a 3\nfoo")).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("invalid header", func(t *testing.T) {
+		for _, input := range []string{"\n\n", "a\n", "a b\n", "a -1\n", "a 1"} {
+			if _, _, err := NewFrameReader(strings.NewReader(input)).Next(); err == nil {
+				t.Errorf("expected error for %q", input)
+			}
+		}
+	})
+}
+
+func encodeFrame(id, segment string) string {
+	var buf bytes.Buffer
+	WriteFrame(&buf, id, strings.NewReader(segment), int64(len(segment)))
+	return buf.String()
+}
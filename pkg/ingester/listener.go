@@ -0,0 +1,76 @@
+package ingester
+
+import (
+	"io"
+	"net"
+
+	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/SimonRichardson/cluster/pkg/queue"
+	"github.com/SimonRichardson/cluster/pkg/records"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+var ackOK = []byte("OK\n")
+
+// HandleConnections accepts long-lived connections from the listener, writing
+// each record into the writer. Records can be newline delimited text or length
+// prefixed binary, the format of each record being detected as it's read.
+// Records must have a valid uuid, otherwise the connection is closed. Unless
+// the durability is none, each record is acknowledged with an "OK" line once
+// the durability guarantee has been met. HandleConnections returns when the
+// listener is closed.
+func HandleConnections(
+	ln net.Listener,
+	writer *queue.RotatingWriter,
+	durability Durability,
+	clients metrics.Gauge,
+	logger log.Logger,
+) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handleConnection(conn, writer, durability, clients, logger)
+	}
+}
+
+func handleConnection(conn net.Conn,
+	writer *queue.RotatingWriter,
+	durability Durability,
+	clients metrics.Gauge,
+	logger log.Logger,
+) {
+	defer conn.Close()
+
+	clients.Inc()
+	defer clients.Dec()
+
+	dst := durableWriter{writer, durability, conn}
+	if _, err := copyRecords(dst, records.NewDecoder(conn)); err != nil {
+		level.Warn(logger).Log("remote", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// durableWriter writes each record with a durability guarantee, acknowledging
+// the record once it has been met. Each write holds a single record.
+type durableWriter struct {
+	writer     *queue.RotatingWriter
+	durability Durability
+	ack        io.Writer
+}
+
+func (w durableWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.WriteSync(p, 1, w.durability.sync())
+	if err != nil {
+		return n, err
+	}
+	if w.durability != DurabilityNone {
+		if _, err := w.ack.Write(ackOK); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package ingester
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/queue"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandleConnection(t *testing.T) {
+	t.Parallel()
+
+	t.Run("connection", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		config, err := queue.Build(queue.With("virtual"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := queue.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			clients        = metricMocks.NewMockGauge(ctrl)
+			writtenBytes   = metricMocks.NewMockCounter(ctrl)
+			writtenRecords = metricMocks.NewMockCounter(ctrl)
+			rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+			input = fmt.Sprintf("%s Foo", uuid.MustNew().String())
+		)
+
+		clients.EXPECT().Inc()
+		clients.EXPECT().Dec()
+		writtenBytes.EXPECT().Add(float64(len(input) + 1))
+		writtenRecords.EXPECT().Add(float64(1))
+		rotations.EXPECT().
+			WithLabelValues(queue.ReasonRecords.String()).
+			Return(prometheus.NewCounter(prometheus.CounterOpts{Name: "rotations"}))
+
+		var (
+			policy           = queue.RotationPolicy{MaxRecords: 1}
+			writer           = queue.NewRotatingWriter(q, policy, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+			server, producer = net.Pipe()
+			done             = make(chan struct{})
+		)
+		go func() {
+			handleConnection(server, writer, DurabilityNone, clients, log.NewNopLogger())
+			close(done)
+		}()
+
+		if _, err := producer.Write([]byte(input)); err != nil {
+			t.Fatal(err)
+		}
+		producer.Close()
+		<-done
+
+		segment, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := input+"\n", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package ingester
+
+import (
+	"io"
+
+	"github.com/SimonRichardson/cluster/pkg/records"
+)
+
+// copyRecords validates each record from the decoder, before writing them to
+// the writer as they were encoded. Text records missing a trailing newline
+// will have one appended. It returns the number of records written.
+func copyRecords(dst io.Writer, dec records.Decoder) (n int, err error) {
+	for {
+		if _, err := dec.Decode(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		// Ensure the record is written in one go, so that writers shared
+		// between connections don't interleave partial records.
+		if _, err := dst.Write(dec.Bytes()); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
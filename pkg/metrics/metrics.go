@@ -17,6 +17,9 @@ type Gauge interface {
 	// Dec decrements the Gauge by 1. Use Sub to decrement it by arbitrary
 	// values.
 	Dec()
+
+	// Set sets the Gauge to an arbitrary value.
+	Set(float64)
 }
 
 // HistogramVec is a Collector that bundles a set of Histograms that all share the
@@ -45,3 +48,16 @@ type Counter interface {
 	// 0.
 	Add(float64)
 }
+
+// CounterVec is a Collector that bundles a set of Counters that all share the
+// same Desc, but have different values for their variable labels. This is used
+// if you want to count the same thing partitioned by various dimensions
+// (e.g. number of HTTP requests, partitioned by response code and method).
+type CounterVec interface {
+
+	// WithLabelValues works as GetMetricWithLabelValues, but panics where
+	// GetMetricWithLabelValues would have returned an error. By not returning an
+	// error, WithLabelValues allows shortcuts like
+	//     myVec.WithLabelValues("404", "GET").Add(42)
+	WithLabelValues(...string) prometheus.Counter
+}
@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/SimonRichardson/cluster/pkg/metrics (interfaces: Gauge,HistogramVec,Counter)
+// Source: github.com/SimonRichardson/cluster/pkg/metrics (interfaces: Gauge,HistogramVec,Counter,CounterVec)
 
 package mocks
 
@@ -52,6 +52,16 @@ func (_mr *MockGaugeMockRecorder) Inc() *gomock.Call {
 	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Inc", reflect.TypeOf((*MockGauge)(nil).Inc))
 }
 
+// Set mocks base method
+func (_m *MockGauge) Set(_param0 float64) {
+	_m.ctrl.Call(_m, "Set", _param0)
+}
+
+// Set indicates an expected call of Set
+func (_mr *MockGaugeMockRecorder) Set(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Set", reflect.TypeOf((*MockGauge)(nil).Set), arg0)
+}
+
 // MockHistogramVec is a mock of HistogramVec interface
 type MockHistogramVec struct {
 	ctrl     *gomock.Controller
@@ -133,3 +143,42 @@ func (_m *MockCounter) Inc() {
 func (_mr *MockCounterMockRecorder) Inc() *gomock.Call {
 	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Inc", reflect.TypeOf((*MockCounter)(nil).Inc))
 }
+
+// MockCounterVec is a mock of CounterVec interface
+type MockCounterVec struct {
+	ctrl     *gomock.Controller
+	recorder *MockCounterVecMockRecorder
+}
+
+// MockCounterVecMockRecorder is the mock recorder for MockCounterVec
+type MockCounterVecMockRecorder struct {
+	mock *MockCounterVec
+}
+
+// NewMockCounterVec creates a new mock instance
+func NewMockCounterVec(ctrl *gomock.Controller) *MockCounterVec {
+	mock := &MockCounterVec{ctrl: ctrl}
+	mock.recorder = &MockCounterVecMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (_m *MockCounterVec) EXPECT() *MockCounterVecMockRecorder {
+	return _m.recorder
+}
+
+// WithLabelValues mocks base method
+func (_m *MockCounterVec) WithLabelValues(_param0 ...string) prometheus.Counter {
+	_s := []interface{}{}
+	for _, _x := range _param0 {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "WithLabelValues", _s...)
+	ret0, _ := ret[0].(prometheus.Counter)
+	return ret0
+}
+
+// WithLabelValues indicates an expected call of WithLabelValues
+func (_mr *MockCounterVecMockRecorder) WithLabelValues(arg0 ...interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "WithLabelValues", reflect.TypeOf((*MockCounterVec)(nil).WithLabelValues), arg0...)
+}
@@ -0,0 +1,68 @@
+package placement
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// Placement decides which store peers a segment is replicated to.
+type Placement interface {
+
+	// Place returns the peers ordered by preference for the segment id. The
+	// first peers, up to the replication factor, are where the segment is
+	// placed, with the remaining peers used in turn to replace any that fail.
+	Place(id string, peers []string) []string
+}
+
+// NewRendezvous creates a Placement using rendezvous (highest random
+// weight) hashing over the peer names. Every peer is scored against the
+// segment id, so a segment is always placed on the same peers, segments are
+// spread evenly across the peers, and only the segments of a peer that joins
+// or leaves are moved.
+func NewRendezvous() Placement {
+	return rendezvousPlacement{}
+}
+
+type rendezvousPlacement struct{}
+
+func (rendezvousPlacement) Place(id string, peers []string) []string {
+	type weighted struct {
+		peer  string
+		score uint64
+	}
+
+	scores := make([]weighted, len(peers))
+	for i, peer := range peers {
+		scores[i] = weighted{peer, score(id, peer)}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if a, b := scores[i].score, scores[j].score; a != b {
+			return a > b
+		}
+		return scores[i].peer < scores[j].peer
+	})
+
+	res := make([]string, len(scores))
+	for i, s := range scores {
+		res[i] = s.peer
+	}
+	return res
+}
+
+// score hashes the peer and the id together. FNV on its own distributes keys
+// that only differ by a few trailing bytes poorly, so the hash is finalized
+// with the splitmix64 mixer.
+func score(id, peer string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(peer))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
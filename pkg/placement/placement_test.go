@@ -0,0 +1,95 @@
+package placement
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestRendezvous(t *testing.T) {
+	t.Parallel()
+
+	peers := []string{
+		"0.0.0.0:8080",
+		"0.0.0.0:8081",
+		"0.0.0.0:8082",
+		"0.0.0.0:8083",
+		"0.0.0.0:8084",
+	}
+
+	t.Run("place every peer", func(t *testing.T) {
+		fn := func(id string) bool {
+			res := NewRendezvous().Place(id, peers)
+
+			sorted := append([]string{}, res...)
+			sort.Strings(sorted)
+			return reflect.DeepEqual(peers, sorted)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		fn := func(id string) bool {
+			var (
+				placement = NewRendezvous()
+				reversed  = make([]string, len(peers))
+			)
+			for i, peer := range peers {
+				reversed[len(peers)-1-i] = peer
+			}
+			return reflect.DeepEqual(
+				placement.Place(id, peers),
+				placement.Place(id, reversed),
+			)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("balanced", func(t *testing.T) {
+		var (
+			placement = NewRendezvous()
+			counts    = map[string]int{}
+			segments  = 10000
+		)
+		for i := 0; i < segments; i++ {
+			counts[placement.Place(uuid.MustNewTime().String(), peers)[0]]++
+		}
+
+		mean := segments / len(peers)
+		for _, peer := range peers {
+			if count := counts[peer]; count < mean*8/10 || count > mean*12/10 {
+				t.Errorf("peer %s: expected: %d±20%%, actual: %d", peer, mean, count)
+			}
+		}
+	})
+
+	t.Run("minimal disruption", func(t *testing.T) {
+		var (
+			placement = NewRendezvous()
+			joined    = "0.0.0.0:8085"
+			grown     = append(append([]string{}, peers...), joined)
+		)
+		for i := 0; i < 1000; i++ {
+			id := fmt.Sprintf("segment-%d", i)
+
+			before, after := placement.Place(id, peers)[0], placement.Place(id, grown)[0]
+			if before != after && after != joined {
+				t.Errorf("segment %s: expected: %s or %s, actual: %s", id, before, joined, after)
+			}
+		}
+	})
+
+	t.Run("no peers", func(t *testing.T) {
+		if expected, actual := 0, len(NewRendezvous().Place("id", nil)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
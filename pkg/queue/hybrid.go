@@ -0,0 +1,383 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+)
+
+// hybridQueue holds segments in memory, so that small bursts are written and
+// read without going to disk, up to a budget of bytes. Past the budget, the
+// oldest flushed segments are spilled to a real queue under their own ids, so
+// the queue is still dequeued in the order the segments were enqueued in. If
+// that's not enough, the active segment is moved to disk as it's written, and
+// new segments are enqueued straight to disk, until segments held in memory
+// are committed.
+//
+// Segments held in memory don't survive a restart, so syncing a segment moves
+// it to disk, same as a segment of the real queue. Closing the queue spills
+// every segment still held in memory, where segments that were handed out are
+// flushed again, same as the real queue recovers them. Dead segments are
+// always spilled, so that they can be inspected after a restart.
+type hybridQueue struct {
+	mutex       sync.Mutex
+	memory      map[string]*hybridSegment
+	disk        *realQueue
+	filesys     fs.Filesystem
+	root        string
+	budget      int64
+	maxAttempts int
+	quota       Quota
+}
+
+func newHybridQueue(disk *realQueue, budget int64, maxAttempts int, quota Quota) Queue {
+	return &hybridQueue{
+		memory:      make(map[string]*hybridSegment),
+		disk:        disk,
+		filesys:     disk.filesys,
+		root:        disk.root,
+		budget:      budget,
+		maxAttempts: maxAttempts,
+		quota:       quota,
+	}
+}
+
+// Enqueue fails with a queue full error if the segments held in memory and on
+// disk are at the quota. Segments are enqueued to disk if the segments held in
+// memory are at the budget.
+func (q *hybridQueue) Enqueue() (WriteSegment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var free int64
+	if q.quota.MinFreeBytes > 0 {
+		var err error
+		if free, err = q.filesys.FreeSpace(q.root); err != nil {
+			return nil, errors.Wrap(err, "free space")
+		}
+	}
+	if err := q.quota.check(q.depth(), free); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewTime()
+	if err != nil {
+		return nil, errors.Wrap(err, "enqueue")
+	}
+
+	s := &hybridSegment{
+		queue:  q,
+		id:     id.String(),
+		buffer: new(bytes.Buffer),
+		state:  Active,
+	}
+	if q.memoryBytes() >= q.budget {
+		if err := q.persist(s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	q.memory[s.id] = s
+	return s, nil
+}
+
+// Dequeue hands out the oldest flushed segment, whether it's held in memory or
+// on disk. Segments on disk without time ordered ids were enqueued before any
+// held in memory.
+func (q *hybridQueue) Dequeue() (ReadSegment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	s := q.oldest()
+	if id, ok := q.disk.oldest(); ok && (s == nil || !timeOrdered(id) || id < s.id) {
+		return q.disk.Dequeue()
+	}
+	if s == nil {
+		return nil, errNoSegmentsAvailable{errors.New("nothing found for reading")}
+	}
+
+	s.state = Pending
+	s.offset = 0
+	return s, nil
+}
+
+func (q *hybridQueue) Depth() Depth {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.depth()
+}
+
+func (q *hybridQueue) depth() Depth {
+	d := q.disk.Depth()
+	for _, s := range q.memory {
+		d.add(s.state, 1)
+		d.Bytes += int64(s.buffer.Len())
+	}
+	return d
+}
+
+func (q *hybridQueue) Segments() ([]Segment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	res, err := q.disk.Segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range q.memory {
+		res = append(res, newSegment(s.id, s.state, int64(s.buffer.Len()), time.Time{}))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// Delete only removes flushed segments, same as the real queue does.
+func (q *hybridQueue) Delete(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if s, ok := q.memory[id]; ok {
+		if s.state != Flushed {
+			return errNotFound{errors.Errorf("flushed segment %q not found", id)}
+		}
+		delete(q.memory, id)
+		return nil
+	}
+	return q.disk.Delete(id)
+}
+
+func (q *hybridQueue) DeadSegments() ([]DeadSegment, error) {
+	return q.disk.DeadSegments()
+}
+
+func (q *hybridQueue) OpenDead(id string) (io.ReadCloser, error) {
+	return q.disk.OpenDead(id)
+}
+
+func (q *hybridQueue) Requeue(id string) error {
+	return q.disk.Requeue(id)
+}
+
+func (q *hybridQueue) DeleteDead(id string) error {
+	return q.disk.DeleteDead(id)
+}
+
+func (q *hybridQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for id, s := range q.memory {
+		if s.buffer.Len() == 0 {
+			continue
+		}
+		if err := q.disk.spill(id, s.buffer.Bytes(), s.attempts, Flushed); err != nil {
+			return errors.Wrapf(err, "spilling segment %s", id)
+		}
+		delete(q.memory, id)
+	}
+	return q.disk.Close()
+}
+
+// oldest returns the oldest flushed segment held in memory, or nil if there
+// isn't one. The caller must hold the mutex.
+func (q *hybridQueue) oldest() *hybridSegment {
+	var res *hybridSegment
+	for _, s := range q.memory {
+		if s.state == Flushed && (res == nil || s.id < res.id) {
+			res = s
+		}
+	}
+	return res
+}
+
+// spill moves the oldest flushed segments to disk until the segments held in
+// memory fit within the budget. Segments that are active or pending are left
+// in memory until they're flushed again. The caller must hold the mutex.
+func (q *hybridQueue) spill() error {
+	for q.memoryBytes() > q.budget {
+		s := q.oldest()
+		if s == nil {
+			return nil
+		}
+		if err := q.disk.spill(s.id, s.buffer.Bytes(), s.attempts, Flushed); err != nil {
+			return errors.Wrapf(err, "spilling segment %s", s.id)
+		}
+		delete(q.memory, s.id)
+	}
+	return nil
+}
+
+// persist moves the active segment to disk, where it's written to from then
+// on. The caller must hold the mutex.
+func (q *hybridQueue) persist(s *hybridSegment) error {
+	w, err := q.disk.persist(s.id, s.buffer.Bytes())
+	if err != nil {
+		return errors.Wrapf(err, "persisting segment %s", s.id)
+	}
+	s.disk, s.buffer = w, new(bytes.Buffer)
+	delete(q.memory, s.id)
+	return nil
+}
+
+func (q *hybridQueue) memoryBytes() int64 {
+	var res int64
+	for _, s := range q.memory {
+		res += int64(s.buffer.Len())
+	}
+	return res
+}
+
+// flushed makes the segment available to be dequeued, spilling segments to
+// disk if the budget is exceeded. The segment is flushed even if spilling
+// fails.
+func (q *hybridQueue) flushed(s *hybridSegment) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	s.state = Flushed
+	return q.spill()
+}
+
+func (q *hybridQueue) remove(s *hybridSegment) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.memory, s.id)
+}
+
+// failed makes the segment available to be dequeued again, unless it failed
+// the max attempts, in which case it's spilled to disk as dead.
+func (q *hybridQueue) failed(s *hybridSegment) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	s.attempts++
+	s.offset = 0
+	s.state = Flushed
+	if q.maxAttempts > 0 && s.attempts >= q.maxAttempts {
+		if err := q.disk.spill(s.id, s.buffer.Bytes(), s.attempts, Dead); err != nil {
+			return errors.Wrapf(err, "spilling dead segment %s", s.id)
+		}
+		delete(q.memory, s.id)
+		return nil
+	}
+	return q.spill()
+}
+
+// hybridSegment is held in memory, unless it's been moved to disk whilst it was
+// active, in which case it's written to disk.
+type hybridSegment struct {
+	queue    *hybridQueue
+	id       string
+	buffer   *bytes.Buffer
+	disk     *realWriteSegment
+	offset   int
+	attempts int
+	state    Extension
+}
+
+// Read reads the segment without draining it, so that a failed segment can be
+// read again.
+func (h *hybridSegment) Read(b []byte) (int, error) {
+	p := h.buffer.Bytes()[h.offset:]
+	if len(p) == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, p)
+	h.offset += n
+	return n, nil
+}
+
+// Write moves the segment to disk if it takes the segments held in memory over
+// the budget, once the flushed segments are spilled.
+func (h *hybridSegment) Write(b []byte) (int, error) {
+	h.queue.mutex.Lock()
+	defer h.queue.mutex.Unlock()
+
+	if h.disk != nil {
+		return h.disk.Write(b)
+	}
+	n, err := h.buffer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if err := h.queue.spill(); err != nil {
+		return n, err
+	}
+	if h.queue.memoryBytes() > h.queue.budget {
+		if err := h.queue.persist(h); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Sync moves the segment to disk before syncing it, as segments held in
+// memory can't be made durable.
+func (h *hybridSegment) Sync() error {
+	h.queue.mutex.Lock()
+	if h.disk == nil {
+		if err := h.queue.persist(h); err != nil {
+			h.queue.mutex.Unlock()
+			return err
+		}
+	}
+	disk := h.disk
+	h.queue.mutex.Unlock()
+
+	return disk.Sync()
+}
+
+func (h *hybridSegment) Close() error {
+	if disk := h.onDisk(); disk != nil {
+		return disk.Close()
+	}
+	return h.queue.flushed(h)
+}
+
+func (h *hybridSegment) Delete() error {
+	if disk := h.onDisk(); disk != nil {
+		return disk.Delete()
+	}
+	h.queue.remove(h)
+	return nil
+}
+
+// onDisk returns the segment written to disk, or nil if it's held in memory.
+func (h *hybridSegment) onDisk() *realWriteSegment {
+	h.queue.mutex.Lock()
+	defer h.queue.mutex.Unlock()
+
+	return h.disk
+}
+
+func (h *hybridSegment) Commit() error {
+	h.queue.remove(h)
+	return nil
+}
+
+func (h *hybridSegment) Failed() error {
+	return h.queue.failed(h)
+}
+
+func (h *hybridSegment) Size() int64 {
+	h.queue.mutex.Lock()
+	defer h.queue.mutex.Unlock()
+
+	if h.disk != nil {
+		return h.disk.Size()
+	}
+	return int64(h.buffer.Len())
+}
@@ -0,0 +1,319 @@
+package queue
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+)
+
+func TestHybridQueue(t *testing.T) {
+	t.Parallel()
+
+	newQueue := func(t *testing.T, fsys fs.Filesystem, budget int64, maxAttempts int, quota Quota) *hybridQueue {
+		disk, err := newRealQueue(fsys, "/root", compression.Identity, nil, maxAttempts, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newHybridQueue(disk.(*realQueue), budget, maxAttempts, quota).(*hybridQueue)
+	}
+
+	enqueue := func(t *testing.T, q Queue, data string) {
+		w, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dequeue := func(t *testing.T, q Queue) string {
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("held in memory within budget", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 100, 0, Quota{})
+		enqueue(t, q, "a")
+		enqueue(t, q, "b")
+
+		if expected, actual := 0, q.disk.Depth().Segments(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (Depth{Flushed: 2, Bytes: 2}), q.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+	})
+
+	t.Run("spills the oldest over budget", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 4, 0, Quota{})
+		input := []string{"aaa", "bbb", "ccc"}
+		for _, data := range input {
+			enqueue(t, q, data)
+		}
+
+		if expected, actual := 2, q.disk.Depth().Flushed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, len(q.memory); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (Depth{Flushed: 3, Bytes: 9}), q.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+
+		for _, data := range input {
+			if expected, actual := data, dequeue(t, q); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+		}
+		if _, err := q.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+	})
+
+	t.Run("failed segments keep their place", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 100, 0, Quota{})
+		enqueue(t, q, "a")
+		enqueue(t, q, "b")
+
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Failed(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, data := range []string{"a", "b"} {
+			if expected, actual := data, dequeue(t, q); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+		}
+	})
+
+	t.Run("dead segments are spilled", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 100, 2, Quota{})
+		enqueue(t, q, "data")
+
+		for i := 0; i < 2; i++ {
+			r, err := q.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Failed(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dead, err := q.DeadSegments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(dead); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, dead[0].Attempts; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(q.memory); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		rc, err := q.OpenDead(dead[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "data", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("spilled segments survive restarts", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 0, 0, Quota{})
+		enqueue(t, q, "data")
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		q = newQueue(t, fsys, 0, 0, Quota{})
+		if expected, actual := "data", dequeue(t, q); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("synced segments are moved to disk", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 100, 0, Quota{})
+		w, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 0, len(q.memory); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (Depth{Flushed: 1, Bytes: 2}), q.disk.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+		if expected, actual := "ab", dequeue(t, q); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("close spills segments held in memory", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 100, 0, Quota{})
+		enqueue(t, q, "a")
+		enqueue(t, q, "b")
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		q = newQueue(t, fsys, 100, 0, Quota{})
+		for _, data := range []string{"a", "b"} {
+			if expected, actual := data, dequeue(t, q); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+		}
+	})
+
+	t.Run("active segments over budget are moved to disk", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 4, 0, Quota{})
+		w, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []string{"aaa", "bbb"} {
+			if _, err := w.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if expected, actual := 0, len(q.memory); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (Depth{Active: 1, Bytes: 6}), q.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "aaabbb", dequeue(t, q); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("enqueues to disk whilst pending segments are over budget", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 4, 0, Quota{})
+		enqueue(t, q, "aaaa")
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		enqueue(t, q, "bbbb")
+
+		if expected, actual := 1, len(q.memory); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (Depth{Flushed: 1, Bytes: 4}), q.disk.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+		if err := r.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "bbbb", dequeue(t, q); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("segments", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1, 0, Quota{})
+		enqueue(t, q, "a")
+		enqueue(t, q, "b")
+		if _, err := q.Enqueue(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := q.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var states []string
+		for _, s := range segments {
+			states = append(states, s.State)
+		}
+		if expected, actual := "flushed flushed active", strings.Join(states, " "); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("delete flushed", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1, 0, Quota{})
+		enqueue(t, q, "a")
+		enqueue(t, q, "b")
+
+		segments, err := q.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range segments {
+			if err := q.Delete(s.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if expected, actual := (Depth{}), q.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1, 0, Quota{MaxSegments: 2})
+		enqueue(t, q, "a")
+		enqueue(t, q, "b")
+
+		_, err := q.Enqueue()
+		if expected, actual := true, ErrQueueFull(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+// index holds the state of every segment of the real queue in memory, so that
+// the oldest flushed segment is found without walking the queue. Segments are
+// ordered by their ids, which are time ordered, so the order is the order the
+// segments were enqueued in and survives restarts. Segments enqueued before
+// ids were time ordered are older than any that are, so they're ordered first,
+// by the time they were last modified when they were recovered.
+type index struct {
+	entries map[string]entry
+	flushed idHeap
+	depth   Depth
+}
+
+type entry struct {
+	state   Extension
+	size    int64
+	modTime time.Time
+}
+
+func newIndex() *index {
+	return &index{
+		entries: make(map[string]entry),
+	}
+}
+
+// set moves the segment for the id to the state, making it available to pop
+// if it's flushed.
+func (i *index) set(id string, state Extension) {
+	e, ok := i.entries[id]
+	if ok {
+		i.depth.add(e.state, -1)
+	}
+	if state == Flushed && (!ok || e.state != Flushed) {
+		heap.Push(&i.flushed, heapEntry{
+			id:      id,
+			legacy:  !timeOrdered(id),
+			modTime: e.modTime,
+		})
+	}
+	e.state = state
+	i.entries[id] = e
+	i.depth.add(state, 1)
+}
+
+// recover sets the state of a segment found on disk, which was last modified
+// at the time given. The entry holds no state until it's set, so that the depth
+// is only counted once.
+func (i *index) recover(id string, state Extension, modTime time.Time) {
+	i.entries[id] = entry{modTime: modTime}
+	i.set(id, state)
+}
+
+// resize updates the size of the segment for the id.
+func (i *index) resize(id string, size int64) {
+	e, ok := i.entries[id]
+	if !ok {
+		return
+	}
+	i.depth.Bytes += size - e.size
+	e.size = size
+	i.entries[id] = e
+}
+
+// peek returns the id of the oldest flushed segment, leaving it flushed.
+func (i *index) peek() (string, bool) {
+	for i.flushed.Len() > 0 {
+		id := i.flushed[0].id
+
+		// Segments that moved on since they were flushed are left in the heap,
+		// as they're cheaper to skip than to find.
+		if e, ok := i.entries[id]; !ok || e.state != Flushed {
+			heap.Pop(&i.flushed)
+			continue
+		}
+		return id, true
+	}
+	return "", false
+}
+
+// pop returns the id of the oldest flushed segment, marking it as pending.
+func (i *index) pop() (string, bool) {
+	id, ok := i.peek()
+	if !ok {
+		return "", false
+	}
+	heap.Pop(&i.flushed)
+	i.set(id, Pending)
+	return id, true
+}
+
+// remove forgets about the segment for the id.
+func (i *index) remove(id string) {
+	if e, ok := i.entries[id]; ok {
+		i.depth.add(e.state, -1)
+		i.depth.Bytes -= e.size
+		delete(i.entries, id)
+	}
+}
+
+type heapEntry struct {
+	id      string
+	legacy  bool
+	modTime time.Time
+}
+
+// older returns true if the segment a was enqueued before b.
+func older(a, b heapEntry) bool {
+	if a.legacy != b.legacy {
+		return a.legacy
+	}
+	if a.legacy && !a.modTime.Equal(b.modTime) {
+		return a.modTime.Before(b.modTime)
+	}
+	return a.id < b.id
+}
+
+// timeOrdered returns true if the id is ordered by the time it was generated.
+func timeOrdered(id string) bool {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return false
+	}
+	_, ok := u.Time()
+	return ok
+}
+
+type idHeap []heapEntry
+
+func (h idHeap) Len() int            { return len(h) }
+func (h idHeap) Less(i, j int) bool  { return older(h[i], h[j]) }
+func (h idHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *idHeap) Push(x interface{}) { *h = append(*h, x.(heapEntry)) }
+
+func (h *idHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"sort"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestIndex(t *testing.T) {
+	t.Parallel()
+
+	t.Run("pop in order", func(t *testing.T) {
+		fn := func(ids []string) bool {
+			idx := newIndex()
+			seen := make(map[string]struct{})
+			var expected []string
+			for _, id := range ids {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				seen[id] = struct{}{}
+				expected = append(expected, id)
+				idx.set(id, Flushed)
+			}
+			sort.Strings(expected)
+
+			for _, id := range expected {
+				if actual, ok := idx.pop(); !ok || actual != id {
+					return false
+				}
+			}
+			_, ok := idx.pop()
+			return !ok
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("peek leaves the segment flushed", func(t *testing.T) {
+		idx := newIndex()
+		idx.set("b", Flushed)
+		idx.set("a", Flushed)
+		idx.set("a", Pending)
+
+		if id, ok := idx.peek(); !ok || id != "b" {
+			t.Fatalf("expected: %q, actual: %q", "b", id)
+		}
+		if expected, actual := (Depth{Flushed: 1, Pending: 1}), idx.depth; expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+		if id, ok := idx.pop(); !ok || id != "b" {
+			t.Errorf("expected: %q, actual: %q", "b", id)
+		}
+	})
+
+	t.Run("failed segments are popped first", func(t *testing.T) {
+		idx := newIndex()
+		idx.set("a", Flushed)
+		idx.set("b", Flushed)
+
+		id, _ := idx.pop()
+		idx.set(id, Flushed)
+
+		if expected, actual := "a", mustPop(t, idx); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("skips segments that moved on", func(t *testing.T) {
+		idx := newIndex()
+		idx.set("a", Flushed)
+		idx.set("b", Flushed)
+		idx.remove("a")
+		idx.set("a", Active)
+
+		if expected, actual := "b", mustPop(t, idx); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if _, ok := idx.pop(); ok {
+			t.Error("expected no segments")
+		}
+	})
+
+	t.Run("legacy ids are popped first", func(t *testing.T) {
+		var (
+			idx = newIndex()
+			now = time.Now()
+
+			current = uuid.MustNewTime().String()
+			older   = uuid.MustNew().String()
+			newer   = uuid.MustNew().String()
+		)
+
+		// Ids that aren't time ordered are recovered in the order they were
+		// last modified, ahead of any ids that are.
+		idx.recover(current, Flushed, now.Add(-time.Hour))
+		idx.recover(newer, Flushed, now)
+		idx.recover(older, Flushed, now.Add(-time.Minute))
+
+		for _, expected := range []string{older, newer, current} {
+			if actual := mustPop(t, idx); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+		if expected, actual := (Depth{Pending: 3}), idx.depth; expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+	})
+
+	t.Run("flushed twice is popped once", func(t *testing.T) {
+		idx := newIndex()
+		idx.set("a", Flushed)
+		idx.set("a", Flushed)
+
+		mustPop(t, idx)
+		if _, ok := idx.pop(); ok {
+			t.Error("expected no segments")
+		}
+	})
+}
+
+func mustPop(t *testing.T, idx *index) string {
+	id, ok := idx.pop()
+	if !ok {
+		t.Fatal("expected a segment")
+	}
+	return id
+}
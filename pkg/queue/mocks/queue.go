@@ -6,6 +6,7 @@ package mocks
 import (
 	queue "github.com/SimonRichardson/cluster/pkg/queue"
 	gomock "github.com/golang/mock/gomock"
+	io "io"
 	reflect "reflect"
 )
 
@@ -32,6 +33,55 @@ func (_m *MockQueue) EXPECT() *MockQueueMockRecorder {
 	return _m.recorder
 }
 
+// DeadSegments mocks base method
+func (_m *MockQueue) DeadSegments() ([]queue.DeadSegment, error) {
+	ret := _m.ctrl.Call(_m, "DeadSegments")
+	ret0, _ := ret[0].([]queue.DeadSegment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeadSegments indicates an expected call of DeadSegments
+func (_mr *MockQueueMockRecorder) DeadSegments() *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "DeadSegments", reflect.TypeOf((*MockQueue)(nil).DeadSegments))
+}
+
+// Delete mocks base method
+func (_m *MockQueue) Delete(_param0 string) error {
+	ret := _m.ctrl.Call(_m, "Delete", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete
+func (_mr *MockQueueMockRecorder) Delete(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Delete", reflect.TypeOf((*MockQueue)(nil).Delete), arg0)
+}
+
+// DeleteDead mocks base method
+func (_m *MockQueue) DeleteDead(_param0 string) error {
+	ret := _m.ctrl.Call(_m, "DeleteDead", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDead indicates an expected call of DeleteDead
+func (_mr *MockQueueMockRecorder) DeleteDead(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "DeleteDead", reflect.TypeOf((*MockQueue)(nil).DeleteDead), arg0)
+}
+
+// Depth mocks base method
+func (_m *MockQueue) Depth() queue.Depth {
+	ret := _m.ctrl.Call(_m, "Depth")
+	ret0, _ := ret[0].(queue.Depth)
+	return ret0
+}
+
+// Depth indicates an expected call of Depth
+func (_mr *MockQueueMockRecorder) Depth() *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Depth", reflect.TypeOf((*MockQueue)(nil).Depth))
+}
+
 // Dequeue mocks base method
 func (_m *MockQueue) Dequeue() (queue.ReadSegment, error) {
 	ret := _m.ctrl.Call(_m, "Dequeue")
@@ -57,3 +107,41 @@ func (_m *MockQueue) Enqueue() (queue.WriteSegment, error) {
 func (_mr *MockQueueMockRecorder) Enqueue() *gomock.Call {
 	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Enqueue", reflect.TypeOf((*MockQueue)(nil).Enqueue))
 }
+
+// OpenDead mocks base method
+func (_m *MockQueue) OpenDead(_param0 string) (io.ReadCloser, error) {
+	ret := _m.ctrl.Call(_m, "OpenDead", _param0)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// OpenDead indicates an expected call of OpenDead
+func (_mr *MockQueueMockRecorder) OpenDead(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "OpenDead", reflect.TypeOf((*MockQueue)(nil).OpenDead), arg0)
+}
+
+// Requeue mocks base method
+func (_m *MockQueue) Requeue(_param0 string) error {
+	ret := _m.ctrl.Call(_m, "Requeue", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Requeue indicates an expected call of Requeue
+func (_mr *MockQueueMockRecorder) Requeue(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Requeue", reflect.TypeOf((*MockQueue)(nil).Requeue), arg0)
+}
+
+// Segments mocks base method
+func (_m *MockQueue) Segments() ([]queue.Segment, error) {
+	ret := _m.ctrl.Call(_m, "Segments")
+	ret0, _ := ret[0].([]queue.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Segments indicates an expected call of Segments
+func (_mr *MockQueueMockRecorder) Segments() *gomock.Call {
+	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Segments", reflect.TypeOf((*MockQueue)(nil).Segments))
+}
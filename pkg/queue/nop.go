@@ -1,5 +1,11 @@
 package queue
 
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
 type nopQueue struct{}
 
 func newNopQueue() Queue {
@@ -9,6 +15,17 @@ func newNopQueue() Queue {
 func (q nopQueue) Enqueue() (WriteSegment, error) { return nopSegment{}, nil }
 func (q nopQueue) Dequeue() (ReadSegment, error)  { return nopSegment{}, nil }
 
+func (q nopQueue) Segments() ([]Segment, error)         { return nil, nil }
+func (q nopQueue) Delete(id string) error               { return nil }
+func (q nopQueue) DeadSegments() ([]DeadSegment, error) { return nil, nil }
+func (q nopQueue) Requeue(id string) error              { return nil }
+func (q nopQueue) DeleteDead(id string) error           { return nil }
+func (q nopQueue) Depth() Depth                         { return Depth{} }
+
+func (q nopQueue) OpenDead(id string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(nil)), nil
+}
+
 type nopSegment struct{}
 
 func (v nopSegment) Read(b []byte) (int, error)  { return 0, nil }
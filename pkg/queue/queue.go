@@ -1,5 +1,17 @@
 package queue
 
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 // Queue is an abstraction for segments on an ingest node.
 type Queue interface {
 
@@ -8,6 +20,130 @@ type Queue interface {
 
 	// Dequeue returns the first segment, which can then be read from.
 	Dequeue() (ReadSegment, error)
+
+	// DeadSegments returns the segments that failed too many times to be
+	// handed out again, oldest first.
+	DeadSegments() ([]DeadSegment, error)
+
+	// OpenDead returns the dead segment for the id, so that it can be
+	// inspected.
+	OpenDead(id string) (io.ReadCloser, error)
+
+	// Requeue makes the dead segment for the id available for reading again,
+	// forgetting about the attempts that failed.
+	Requeue(id string) error
+
+	// DeleteDead removes the dead segment for the id.
+	DeleteDead(id string) error
+
+	// Segments returns every segment held by the queue along with its state,
+	// oldest first.
+	Segments() ([]Segment, error)
+
+	// Delete removes the flushed segment for the id, so that it's never
+	// handed out.
+	Delete(id string) error
+
+	// Depth returns the number of segments held in each state.
+	Depth() Depth
+}
+
+// Segment describes a segment held by a queue.
+type Segment struct {
+	ID      string    `json:"id"`
+	State   string    `json:"state"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+func newSegment(id string, state Extension, size int64, modTime time.Time) Segment {
+	// Segment ids are time ordered, so they tell when the segment was
+	// enqueued. Segments enqueued before ids were time ordered fall back to
+	// when they were last modified, which is zero if it isn't known.
+	created := modTime
+	if u, err := uuid.Parse(id); err == nil {
+		if t, ok := u.Time(); ok {
+			created = t
+		}
+	}
+	return Segment{
+		ID:      id,
+		State:   strings.TrimPrefix(state.Ext(), "."),
+		Size:    size,
+		Created: created,
+	}
+}
+
+// Depth is the number of segments held by a queue in each state, along with
+// the number of bytes they hold once read, regardless of their compression.
+type Depth struct {
+	Active  int   `json:"active"`
+	Flushed int   `json:"flushed"`
+	Pending int   `json:"pending"`
+	Dead    int   `json:"dead"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Segments returns the number of segments in every state.
+func (d Depth) Segments() int {
+	return d.Active + d.Flushed + d.Pending + d.Dead
+}
+
+// Backlog returns the number of segments yet to be consumed, which leaves out
+// dead segments, as they're never handed out again.
+func (d Depth) Backlog() int {
+	return d.Active + d.Flushed + d.Pending
+}
+
+func (d *Depth) add(state Extension, n int) {
+	switch state {
+	case Active:
+		d.Active += n
+	case Flushed:
+		d.Flushed += n
+	case Pending:
+		d.Pending += n
+	case Dead:
+		d.Dead += n
+	}
+}
+
+// Quota limits what a queue holds, so that an ingester can't fill its disk
+// when consumers fall behind. Zero leaves a limit unbounded. The max bytes are
+// those of the segments once read, so compressed segments take up less of the
+// disk than the quota allows.
+//
+// The quota is only checked when a segment is enqueued, counting what the
+// active segments hold so far. It's a soft limit, as the active segments can
+// carry on growing past it until they're rotated. The max segments are those
+// of the backlog, so that dead segments don't fill the quota for good.
+type Quota struct {
+	MaxSegments  int
+	MaxBytes     int64
+	MinFreeBytes int64
+}
+
+// check returns a queue full error if one more segment doesn't fit within the
+// quota.
+func (q Quota) check(depth Depth, free int64) error {
+	switch {
+	case q.MaxSegments > 0 && depth.Backlog() >= q.MaxSegments:
+		return errQueueFull{errors.Errorf("queue holds %d segments, quota is %d", depth.Backlog(), q.MaxSegments), false}
+	case q.MaxBytes > 0 && depth.Bytes >= q.MaxBytes:
+		return errQueueFull{errors.Errorf("queue holds %d bytes, quota is %d", depth.Bytes, q.MaxBytes), false}
+	case q.MinFreeBytes > 0 && free < q.MinFreeBytes:
+		return errQueueFull{errors.Errorf("%d bytes free on disk, quota is %d", free, q.MinFreeBytes), true}
+	}
+	return nil
+}
+
+// DeadSegment describes a segment that failed too many times to be handed out
+// again.
+type DeadSegment struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	Attempts int       `json:"attempts"`
+	ModTime  time.Time `json:"mod_time"`
 }
 
 type noSegmentsAvailable interface {
@@ -36,3 +172,213 @@ func ErrNoSegmentsAvailable(err error) bool {
 	}
 	return false
 }
+
+type queueFull interface {
+	QueueFull() bool
+	DiskFull() bool
+}
+
+type errQueueFull struct {
+	err  error
+	disk bool
+}
+
+func (e errQueueFull) Error() string {
+	return e.err.Error()
+}
+
+func (e errQueueFull) QueueFull() bool {
+	return true
+}
+
+func (e errQueueFull) DiskFull() bool {
+	return e.disk
+}
+
+// ErrQueueFull tests to see if the error passed, or the cause of it, is a
+// queue full error or not. Enqueue fails with a queue full error once the
+// queue reaches its quota.
+func ErrQueueFull(err error) bool {
+	if err != nil {
+		if _, ok := errors.Cause(err).(queueFull); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrDiskFull tests to see if the error passed, or the cause of it, is a
+// queue full error due to running out of disk space.
+func ErrDiskFull(err error) bool {
+	if err != nil {
+		if e, ok := errors.Cause(err).(queueFull); ok {
+			return e.DiskFull()
+		}
+	}
+	return false
+}
+
+type notFound interface {
+	NotFound() bool
+}
+
+type errNotFound struct {
+	err error
+}
+
+func (e errNotFound) Error() string {
+	return e.err.Error()
+}
+
+func (e errNotFound) NotFound() bool {
+	return true
+}
+
+// ErrNotFound tests to see if the error passed is a not found error or not.
+func ErrNotFound(err error) bool {
+	if err != nil {
+		if _, ok := err.(notFound); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Config encapsulates the requirements for generating a Queue
+type Config struct {
+	name        string
+	filesystem  fs.Filesystem
+	root        string
+	compression compression.Encoding
+	ratio       prometheus.Observer
+	maxAttempts int
+	quota       Quota
+	budget      int64
+}
+
+// Option defines a option for generating a queue Config
+type Option func(*Config) error
+
+// Build ingests configuration options to then yield a Config and return an
+// error if it fails during setup.
+func Build(opts ...Option) (*Config, error) {
+	var config Config
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// With adds a type of queue to use for the configuration.
+func With(name string) Option {
+	return func(config *Config) error {
+		config.name = name
+		return nil
+	}
+}
+
+// WithFilesystem adds a filesystem to the configuration, which is used by the
+// real and hybrid queues to persist segments.
+func WithFilesystem(filesystem fs.Filesystem) Option {
+	return func(config *Config) error {
+		config.filesystem = filesystem
+		return nil
+	}
+}
+
+// WithRoot adds a root path to the configuration, where all the segments for
+// the real and hybrid queues are located.
+func WithRoot(root string) Option {
+	return func(config *Config) error {
+		config.root = root
+		return nil
+	}
+}
+
+// WithCompression adds the encoding used by the real and hybrid queues to
+// compress the segments they persist, observing the compression ratio of each
+// segment. Segments are read back regardless of how they were compressed.
+func WithCompression(encoding compression.Encoding, ratio prometheus.Observer) Option {
+	return func(config *Config) error {
+		config.compression = encoding
+		config.ratio = ratio
+		return nil
+	}
+}
+
+// WithMaxAttempts adds the number of times a segment can fail before it's
+// dead, so that a segment that can never be consumed isn't handed out forever.
+// Zero lets segments fail any number of times.
+func WithMaxAttempts(maxAttempts int) Option {
+	return func(config *Config) error {
+		if maxAttempts < 0 {
+			return errors.Errorf("invalid max attempts %d", maxAttempts)
+		}
+		config.maxAttempts = maxAttempts
+		return nil
+	}
+}
+
+// WithQuota adds the quota limiting what the queue holds, after which
+// Enqueue fails with a queue full error.
+func WithQuota(quota Quota) Option {
+	return func(config *Config) error {
+		if quota.MaxSegments < 0 || quota.MaxBytes < 0 || quota.MinFreeBytes < 0 {
+			return errors.Errorf("invalid quota %+v", quota)
+		}
+		config.quota = quota
+		return nil
+	}
+}
+
+// WithMemoryBudget adds the number of bytes the hybrid queue holds in memory,
+// after which the oldest segments are spilled to disk.
+func WithMemoryBudget(budget int64) Option {
+	return func(config *Config) error {
+		if budget < 0 {
+			return errors.Errorf("invalid memory budget %d", budget)
+		}
+		config.budget = budget
+		return nil
+	}
+}
+
+// New creates a queue from a configuration or returns error if on failure.
+func New(config *Config) (q Queue, err error) {
+	switch strings.ToLower(config.name) {
+	case "real":
+		if config.filesystem == nil {
+			return nil, errors.New("missing filesystem")
+		}
+		encoding, ratio := config.compression, config.ratio
+		if encoding == nil || encoding == compression.Identity {
+			encoding, ratio = compression.Identity, nil
+		}
+		q, err = newRealQueue(config.filesystem, config.root, encoding, ratio, config.maxAttempts, config.quota)
+	case "hybrid":
+		if config.filesystem == nil {
+			return nil, errors.New("missing filesystem")
+		}
+		encoding, ratio := config.compression, config.ratio
+		if encoding == nil || encoding == compression.Identity {
+			encoding, ratio = compression.Identity, nil
+		}
+		// The quota is checked by the hybrid queue, as it covers the segments
+		// held in memory as well.
+		var disk Queue
+		if disk, err = newRealQueue(config.filesystem, config.root, encoding, ratio, config.maxAttempts, Quota{}); err != nil {
+			return nil, err
+		}
+		q = newHybridQueue(disk.(*realQueue), config.budget, config.maxAttempts, config.quota)
+	case "virtual":
+		q = newVirtualQueue(config.maxAttempts, config.quota)
+	case "nop":
+		q = newNopQueue()
+	default:
+		err = errors.Errorf("unexpected queue type %q", config.name)
+	}
+	return
+}
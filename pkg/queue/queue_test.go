@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/pkg/errors"
+)
+
+func TestBuildingQueue(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(name, root string) bool {
+			config, err := Build(
+				With(name),
+				WithRoot(root),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected, actual := name, config.name; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := root, config.root; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+
+			return true
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		_, err := Build(
+			func(config *Config) error {
+				return errors.Errorf("bad")
+			},
+		)
+
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	t.Run("real", func(t *testing.T) {
+		config, err := Build(
+			With("real"),
+			WithFilesystem(fs.NewVirtualFilesystem()),
+			WithRoot("/root"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("real without filesystem", func(t *testing.T) {
+		config, err := Build(
+			With("real"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("hybrid", func(t *testing.T) {
+		config, err := Build(
+			With("hybrid"),
+			WithFilesystem(fs.NewVirtualFilesystem()),
+			WithRoot("/root"),
+			WithMemoryBudget(1024),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("hybrid without filesystem", func(t *testing.T) {
+		config, err := Build(
+			With("hybrid"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("virtual", func(t *testing.T) {
+		config, err := Build(
+			With("virtual"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("nop", func(t *testing.T) {
+		config, err := Build(
+			With("nop"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		config, err := Build(
+			With("invalid"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
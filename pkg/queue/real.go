@@ -2,13 +2,22 @@ package queue
 
 import (
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"time"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/compression"
 	"github.com/SimonRichardson/cluster/pkg/fs"
 	"github.com/SimonRichardson/cluster/pkg/uuid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 //Extension describe differing types of persisted queued types
@@ -24,6 +33,18 @@ const (
 
 	// Pending status which items are pending
 	Pending Extension = ".pending"
+
+	// Checksum states the sidecar holding the checksum of a flushed item
+	Checksum Extension = ".crc"
+
+	// Attempts states the sidecar holding the number of times an item failed
+	Attempts Extension = ".attempts"
+
+	// Size states the sidecar holding the size of a flushed item once read
+	Size Extension = ".size"
+
+	// Dead states which items failed too many times to be worked on again
+	Dead Extension = ".dead"
 )
 
 // Ext returns the extension of the constant extension
@@ -36,12 +57,18 @@ const (
 )
 
 type realQueue struct {
-	root     string
-	filesys  fs.Filesystem
-	releaser fs.Releaser
+	mutex       sync.Mutex
+	root        string
+	filesys     fs.Filesystem
+	encoding    compression.Encoding
+	ratio       prometheus.Observer
+	maxAttempts int
+	quota       Quota
+	index       *index
+	releaser    fs.Releaser
 }
 
-func newRealQueue(filesys fs.Filesystem, root string) (Queue, error) {
+func newRealQueue(filesys fs.Filesystem, root string, encoding compression.Encoding, ratio prometheus.Observer, maxAttempts int, quota Quota) (Queue, error) {
 	if err := filesys.MkdirAll(root); err != nil {
 		return nil, errors.Wrapf(err, "creating path %s", root)
 	}
@@ -51,168 +78,672 @@ func newRealQueue(filesys fs.Filesystem, root string) (Queue, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "locking %s", lock)
 	}
-	if err := recoverSegments(filesys, root); err != nil {
+	idx, err := recoverSegments(filesys, root)
+	if err != nil {
 		return nil, errors.Wrap(err, "during recovery")
 	}
 
 	return &realQueue{
-		root:     root,
-		filesys:  filesys,
-		releaser: r,
+		index:       idx,
+		root:        root,
+		filesys:     filesys,
+		encoding:    encoding,
+		ratio:       ratio,
+		maxAttempts: maxAttempts,
+		quota:       quota,
+		releaser:    r,
 	}, nil
 }
 
+// Enqueue fails with a queue full error if the queue is at its quota.
 func (q *realQueue) Enqueue() (WriteSegment, error) {
-	id, err := uuid.New()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var free int64
+	if q.quota.MinFreeBytes > 0 {
+		var err error
+		if free, err = q.filesys.FreeSpace(q.root); err != nil {
+			return nil, errors.Wrap(err, "free space")
+		}
+	}
+	if err := q.quota.check(q.index.depth, free); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewTime()
 	if err != nil {
 		return nil, errors.Wrap(err, "enqueue")
 	}
+	return q.create(id.String())
+}
+
+// create creates the active segment for the id. The caller must hold the
+// mutex.
+func (q *realQueue) create(id string) (*realWriteSegment, error) {
 	filename := filepath.Join(q.root, fmt.Sprintf("%s%s", id, Active))
 
 	f, err := q.filesys.Create(filename)
 	if err != nil {
 		return nil, err
 	}
-
-	return realWriteSegment{q.filesys, f}, nil
+	q.index.set(id, Active)
+
+	return &realWriteSegment{
+		queue: q,
+		id:    id,
+		fs:    q.filesys,
+		f:     f,
+		w:     q.encoding.NewWriter(f),
+		hash:  checksum.New(),
+		ratio: q.ratio,
+	}, nil
 }
 
 func (q *realQueue) Dequeue() (ReadSegment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	id, ok := q.index.pop()
+	if !ok {
+		return nil, errNoSegmentsAvailable{errors.New("nothing found for reading")}
+	}
+
 	var (
-		oldest = time.Now()
-		chosen string
+		chosen  = filepath.Join(q.root, fmt.Sprintf("%s%s", id, Flushed))
+		newname = modifyExtension(chosen, Pending.Ext())
 	)
-	q.filesys.Walk(q.root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	if err := q.filesys.Rename(chosen, newname); err != nil {
+		// The segment is gone from under the queue, so forget about it.
+		q.index.remove(id)
+		return nil, errors.Wrap(err, "error when fetching; please try again")
+	}
+
+	f, err := q.filesys.Open(newname)
+	if err != nil {
+		if renameErr := q.filesys.Rename(newname, chosen); renameErr != nil {
+			return nil, errors.Wrap(renameErr, "error attempting to rename")
 		}
-		if info.IsDir() || filepath.Ext(path) != Flushed.Ext() {
+		q.index.set(id, Flushed)
+		return nil, err
+	}
+
+	return &realReadSegment{queue: q, fs: q.filesys, f: f, size: q.index.entries[id].size, maxAttempts: q.maxAttempts}, nil
+}
+
+func (q *realQueue) DeadSegments() ([]DeadSegment, error) {
+	var segments []DeadSegment
+	if err := walkSegments(q.filesys, q.root, func(path string, info os.FileInfo) error {
+		if filepath.Ext(path) != Dead.Ext() {
 			return nil
 		}
-		if t := info.ModTime(); t.Before(oldest) {
-			chosen, oldest = path, t
+		attempts, err := readAttempts(q.filesys, modifyExtension(path, Attempts.Ext()))
+		if err != nil {
+			return err
 		}
+		segments = append(segments, DeadSegment{
+			ID:       segmentID(path),
+			Size:     q.size(segmentID(path), info.Size()),
+			Attempts: attempts,
+			ModTime:  info.ModTime(),
+		})
 		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if a, b := segments[i].ModTime, segments[j].ModTime; !a.Equal(b) {
+			return a.Before(b)
+		}
+		return segments[i].ID < segments[j].ID
 	})
-	if chosen == "" {
-		return nil, errNoSegmentsAvailable{errors.New("nothing found for reading")}
+	return segments, nil
+}
+
+func (q *realQueue) OpenDead(id string) (io.ReadCloser, error) {
+	filename, err := q.deadFilename(id)
+	if err != nil {
+		return nil, err
 	}
+	f, err := q.filesys.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{&realReadSegment{fs: q.filesys, f: f}, f}, nil
+}
 
-	newname := modifyExtension(chosen, Pending.Ext())
-	if err := q.filesys.Rename(chosen, newname); err != nil {
-		return nil, errors.Wrap(err, "error when fetching; please try again")
+func (q *realQueue) Requeue(id string) error {
+	filename, err := q.deadFilename(id)
+	if err != nil {
+		return err
+	}
+	if sidecar := modifyExtension(filename, Attempts.Ext()); q.filesys.Exists(sidecar) {
+		if err := q.filesys.Remove(sidecar); err != nil {
+			return err
+		}
+	}
+	if err := q.filesys.Rename(filename, modifyExtension(filename, Flushed.Ext())); err != nil {
+		return err
+	}
+	q.setState(id, Flushed)
+	return nil
+}
+
+func (q *realQueue) DeleteDead(id string) error {
+	filename, err := q.deadFilename(id)
+	if err != nil {
+		return err
+	}
+	for _, ext := range []Extension{Checksum, Attempts, Size} {
+		if sidecar := modifyExtension(filename, ext.Ext()); q.filesys.Exists(sidecar) {
+			if err := q.filesys.Remove(sidecar); err != nil {
+				return err
+			}
+		}
+	}
+	if err := q.filesys.Remove(filename); err != nil {
+		return err
 	}
+	q.removeState(id)
+	return nil
+}
 
-	f, err := q.filesys.Open(newname)
+// Segments returns the segments as indexed, sized by what's been written to
+// them so far.
+func (q *realQueue) Segments() ([]Segment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	res := make([]Segment, 0, len(q.index.entries))
+	for id, e := range q.index.entries {
+		res = append(res, newSegment(id, e.state, e.size, e.modTime))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// Delete only removes flushed segments, as the others are either being written
+// to or handed out.
+func (q *realQueue) Delete(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Only ids known to the index are used, so that they can't be used to reach
+	// outside of the queue.
+	if e, ok := q.index.entries[id]; !ok || e.state != Flushed {
+		return errNotFound{errors.Errorf("flushed segment %q not found", id)}
+	}
+
+	filename := filepath.Join(q.root, fmt.Sprintf("%s%s", id, Flushed))
+	for _, ext := range []Extension{Checksum, Attempts, Size} {
+		if sidecar := modifyExtension(filename, ext.Ext()); q.filesys.Exists(sidecar) {
+			if err := q.filesys.Remove(sidecar); err != nil {
+				return err
+			}
+		}
+	}
+	if err := q.filesys.Remove(filename); err != nil {
+		return err
+	}
+	q.index.remove(id)
+	return nil
+}
+
+// spill writes a segment held elsewhere to disk under its own id, so that it
+// keeps its place in the queue, along with the attempts that failed. Segments
+// are spilled as either flushed or dead.
+func (q *realQueue) spill(id string, p []byte, attempts int, state Extension) error {
+	w, err := q.persist(id, p)
 	if err != nil {
-		if renameErr := q.filesys.Rename(newname, chosen); renameErr != nil {
-			return nil, errors.Wrap(renameErr, "error attempting to rename")
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	filename := filepath.Join(q.root, fmt.Sprintf("%s%s", id, Flushed))
+	if attempts > 0 {
+		if err := writeAttempts(q.filesys, modifyExtension(filename, Attempts.Ext()), attempts); err != nil {
+			return err
 		}
+	}
+	if state == Dead {
+		if err := q.filesys.Rename(filename, modifyExtension(filename, Dead.Ext())); err != nil {
+			return err
+		}
+		q.setState(id, Dead)
+	}
+	return nil
+}
+
+// persist writes a segment held elsewhere to disk under its own id, leaving it
+// active so that it can carry on being written to.
+func (q *realQueue) persist(id string, p []byte) (*realWriteSegment, error) {
+	q.mutex.Lock()
+	w, err := q.create(id)
+	q.mutex.Unlock()
+	if err != nil {
 		return nil, err
 	}
 
-	return realReadSegment{q.filesys, f}, nil
+	if _, err := w.Write(p); err != nil {
+		w.Delete()
+		return nil, err
+	}
+	return w, nil
+}
+
+// oldest returns the id of the oldest flushed segment, without handing it out.
+func (q *realQueue) oldest() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.index.peek()
 }
 
 func (q *realQueue) Close() error {
 	return q.releaser.Release()
 }
 
+func (q *realQueue) Depth() Depth {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.index.depth
+}
+
+// size returns the size of the segment once read as indexed, or the fallback
+// if the segment isn't indexed.
+func (q *realQueue) size(id string, fallback int64) int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if e, ok := q.index.entries[id]; ok {
+		return e.size
+	}
+	return fallback
+}
+
+func (q *realQueue) setState(id string, state Extension) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.index.set(id, state)
+}
+
+func (q *realQueue) flushState(id string, size int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.index.set(id, Flushed)
+	q.index.resize(id, size)
+}
+
+func (q *realQueue) resizeState(id string, size int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.index.resize(id, size)
+}
+
+func (q *realQueue) removeState(id string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.index.remove(id)
+}
+
+func (q *realQueue) deadFilename(id string) (string, error) {
+	// Ids are only ever the base of a filename, so that they can't be used to
+	// reach outside of the queue.
+	filename := filepath.Join(q.root, fmt.Sprintf("%s%s", id, Dead))
+	if id == "" || filepath.Base(id) != id || !q.filesys.Exists(filename) {
+		return "", errNotFound{errors.Errorf("dead segment %q not found", id)}
+	}
+	return filename, nil
+}
+
+// realWriteSegment compresses the segment as it's written. The checksum and
+// the size of the segment are those of the uncompressed segment.
 type realWriteSegment struct {
-	fs fs.Filesystem
-	f  fs.File
+	queue *realQueue
+	id    string
+	fs    fs.Filesystem
+	f     fs.File
+	w     compression.Writer
+	hash  hash.Hash32
+	size  int64
+	ratio prometheus.Observer
 }
 
-func (w realWriteSegment) Write(p []byte) (int, error) {
-	return w.f.Write(p)
+// Write counts the bytes written towards the depth of the queue straight away,
+// so that the quota accounts for the active segment.
+func (w *realWriteSegment) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	w.queue.resizeState(w.id, w.size)
+	return n, err
 }
 
-func (w realWriteSegment) Sync() error {
+func (w *realWriteSegment) Sync() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
 	return w.f.Sync()
 }
 
-func (w realWriteSegment) Close() error {
+func (w *realWriteSegment) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	size := w.f.Size()
+	if w.ratio != nil && w.size > 0 {
+		w.ratio.Observe(float64(size) / float64(w.size))
+	}
 	if err := w.f.Close(); err != nil {
 		return err
 	}
 
+	// The sidecars are written before the segment is flushed, so that every
+	// flushed segment can be verified and sized without reading it.
 	var (
 		oldname = w.f.Name()
 		newname = modifyExtension(oldname, Flushed.Ext())
 	)
-	return w.fs.Rename(oldname, newname)
+	if err := checksum.WriteSidecar(w.fs, modifyExtension(oldname, Checksum.Ext()), w.hash.Sum32()); err != nil {
+		return err
+	}
+	if err := writeSize(w.fs, modifyExtension(oldname, Size.Ext()), w.size); err != nil {
+		return err
+	}
+	if err := w.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	w.queue.flushState(segmentID(oldname), w.size)
+	return nil
 }
 
-func (w realWriteSegment) Delete() error {
+func (w *realWriteSegment) Delete() error {
 	if err := w.f.Close(); err != nil {
 		return err
 	}
-	return w.fs.Remove(w.f.Name())
+	if err := w.fs.Remove(w.f.Name()); err != nil {
+		return err
+	}
+	w.queue.removeState(segmentID(w.f.Name()))
+	return nil
 }
 
-func (w realWriteSegment) Size() int64 {
-	return w.f.Size()
+func (w *realWriteSegment) Size() int64 {
+	return w.size
 }
 
 type realReadSegment struct {
-	fs fs.Filesystem
-	f  fs.File
+	queue       *realQueue
+	fs          fs.Filesystem
+	f           fs.File
+	r           io.Reader
+	size        int64
+	maxAttempts int
 }
 
-func (r realReadSegment) Read(p []byte) (int, error) {
-	return r.f.Read(p)
+// Read decompresses the segment, regardless of how the queue compresses
+// segments now, and verifies it against the checksum held in its sidecar. If
+// the segment is corrupt, it fails with a checksum mismatch error once read.
+// Segments recovered without a sidecar can't be verified. They were never
+// closed, so a compressed stream ends wherever it was last synced.
+func (r *realReadSegment) Read(p []byte) (int, error) {
+	if r.r == nil {
+		sum, ok, err := checksum.ReadSidecar(r.fs, modifyExtension(r.f.Name(), Checksum.Ext()))
+		if err != nil {
+			return 0, err
+		}
+		dr, err := compression.Detect(r.f)
+		if !ok && compression.ErrTruncated(err) {
+			dr, err = strings.NewReader(""), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.r = truncatedReader{dr}
+		if ok {
+			r.r = checksum.NewReader(dr, sum)
+		}
+	}
+	return r.r.Read(p)
 }
 
-func (r realReadSegment) Commit() error {
+func (r *realReadSegment) Commit() error {
 	if err := r.f.Close(); err != nil {
 		return err
 	}
-	return r.fs.Remove(r.f.Name())
+	for _, ext := range []Extension{Checksum, Attempts, Size} {
+		if sidecar := modifyExtension(r.f.Name(), ext.Ext()); r.fs.Exists(sidecar) {
+			if err := r.fs.Remove(sidecar); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.fs.Remove(r.f.Name()); err != nil {
+		return err
+	}
+	r.queue.removeState(segmentID(r.f.Name()))
+	return nil
 }
 
-func (r realReadSegment) Failed() error {
+// Failed counts the failed attempt in a sidecar, so that it survives restarts.
+// Once the segment failed the max attempts, it's dead instead of flushed.
+func (r *realReadSegment) Failed() error {
 	if err := r.f.Close(); err != nil {
 		return err
 	}
 
 	var (
 		oldname = r.f.Name()
-		newname = modifyExtension(oldname, Flushed.Ext())
+		sidecar = modifyExtension(oldname, Attempts.Ext())
 	)
-	return r.fs.Rename(oldname, newname)
-}
+	attempts, err := readAttempts(r.fs, sidecar)
+	if err != nil {
+		return err
+	}
+	attempts++
+	if err := writeAttempts(r.fs, sidecar, attempts); err != nil {
+		return err
+	}
 
-func (r realReadSegment) Size() int64 {
-	return r.f.Size()
+	state := Flushed
+	if r.maxAttempts > 0 && attempts >= r.maxAttempts {
+		state = Dead
+	}
+	if err := r.fs.Rename(oldname, modifyExtension(oldname, state.Ext())); err != nil {
+		return err
+	}
+	r.queue.setState(segmentID(oldname), state)
+	return nil
 }
 
-func recoverSegments(filesys fs.Filesystem, root string) error {
-	var toRename []string
-	filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
+// Size returns the size of the segment once read, which for compressed
+// segments is more than the size it takes up on disk.
+func (r *realReadSegment) Size() int64 {
+	return r.size
+}
 
-		switch filepath.Ext(path) {
-		case Active.Ext(), Pending.Ext():
-			toRename = append(toRename, path)
+// recoverSegments flushes any segments that were still active or pending, as
+// they can be read again, and indexes the state and size of every segment.
+func recoverSegments(filesys fs.Filesystem, root string) (*index, error) {
+	var (
+		idx      = newIndex()
+		toRename = make(map[string]os.FileInfo)
+		toSize   = make(map[string]int64)
+	)
+	if err := walkSegments(filesys, root, func(path string, info os.FileInfo) error {
+		switch ext := Extension(filepath.Ext(path)); ext {
+		case Active, Pending:
+			toRename[path] = info
+		case Flushed, Dead:
+			idx.recover(segmentID(path), ext, info.ModTime())
+			toSize[path] = info.Size()
 		}
 		return nil
-	})
+	}); err != nil {
+		return nil, err
+	}
 
-	for _, path := range toRename {
+	for path, info := range toRename {
 		var (
 			oldname = path
 			newname = modifyExtension(oldname, Flushed.Ext())
 		)
 		if err := filesys.Rename(oldname, newname); err != nil {
+			return nil, err
+		}
+		idx.recover(segmentID(path), Flushed, info.ModTime())
+		toSize[newname] = info.Size()
+	}
+
+	for path, fallback := range toSize {
+		size, err := sizeSegment(filesys, path, fallback)
+		if err != nil {
+			return nil, err
+		}
+		idx.resize(segmentID(path), size)
+	}
+	return idx, nil
+}
+
+// sizeSegment returns the size of the segment once read, as held by its
+// sidecar. Segments that were never closed have no sidecar, so they're read in
+// full to size them, before writing the sidecar so that they're only read
+// once. Segments that can't be read are sized by the fallback, as they fail
+// once they're read anyway.
+func sizeSegment(filesys fs.Filesystem, filename string, fallback int64) (int64, error) {
+	sidecar := modifyExtension(filename, Size.Ext())
+	if size, ok, err := readSize(filesys, sidecar); err == nil && ok {
+		return size, nil
+	}
+
+	f, err := filesys.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(ioutil.Discard, &realReadSegment{fs: filesys, f: f})
+	f.Close()
+	if err != nil {
+		return fallback, nil
+	}
+	if err := writeSize(filesys, sidecar, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// walkSegments walks the files held directly in the root, skipping the
+// directories of any topics nested within it.
+func walkSegments(filesys fs.Filesystem, root string, fn func(string, os.FileInfo) error) error {
+	root = filepath.Clean(root)
+	return filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
 			return err
 		}
+		if info.IsDir() {
+			if filepath.Clean(path) != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(path) != root {
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+// readAttempts reads the number of failed attempts from the sidecar file,
+// which is zero if there is no sidecar file.
+func readAttempts(filesys fs.Filesystem, filename string) (int, error) {
+	attempts, _, err := readNumber(filesys, filename)
+	return int(attempts), err
+}
+
+// writeAttempts writes the number of failed attempts to the sidecar file.
+func writeAttempts(filesys fs.Filesystem, filename string, attempts int) error {
+	return writeNumber(filesys, filename, int64(attempts))
+}
+
+// readSize reads the size of a segment once read from the sidecar file. If
+// there is no sidecar file, then false is returned, as the size isn't known.
+func readSize(filesys fs.Filesystem, filename string) (int64, bool, error) {
+	return readNumber(filesys, filename)
+}
+
+// writeSize writes the size of a segment once read to the sidecar file.
+func writeSize(filesys fs.Filesystem, filename string, size int64) error {
+	return writeNumber(filesys, filename, size)
+}
+
+func readNumber(filesys fs.Filesystem, filename string) (int64, bool, error) {
+	if !filesys.Exists(filename) {
+		return 0, false, nil
 	}
-	return nil
+
+	f, err := filesys.Open(filename)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "opening sidecar %s", filename)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "reading sidecar %s", filename)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "corrupt sidecar %s", filename)
+	}
+	return n, true, nil
+}
+
+func writeNumber(filesys fs.Filesystem, filename string, n int64) error {
+	f, err := filesys.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "creating sidecar %s", filename)
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", n); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing sidecar %s", filename)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "syncing sidecar %s", filename)
+	}
+	return f.Close()
+}
+
+// truncatedReader ends a stream that was cut short, instead of failing it.
+type truncatedReader struct {
+	r io.Reader
+}
+
+func (t truncatedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if compression.ErrTruncated(err) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func segmentID(filename string) string {
+	base := filepath.Base(filename)
+	return base[:len(base)-len(filepath.Ext(base))]
 }
 
 func modifyExtension(filename, newExt string) string {
@@ -0,0 +1,576 @@
+package queue
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestRealQueue(t *testing.T) {
+	t.Parallel()
+
+	newQueue := func(t *testing.T, fsys fs.Filesystem, maxAttempts int) *realQueue {
+		q, err := newRealQueue(fsys, "/root", compression.Identity, nil, maxAttempts, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.(*realQueue)
+	}
+
+	enqueue := func(t *testing.T, q Queue, data string) {
+		w, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fail := func(t *testing.T, q Queue) {
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Failed(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("dequeue in enqueue order", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 0)
+
+		input := []string{"a", "b", "c", "d"}
+		for _, data := range input {
+			enqueue(t, q, data)
+		}
+
+		// The order survives restarts, even though every segment has the
+		// same modification time.
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		q = newQueue(t, fsys, 0)
+
+		for _, data := range input {
+			r, err := q.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := data, string(b); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+			if err := r.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := q.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+	})
+
+	t.Run("active segments are not handed out", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 0)
+
+		w, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("pending segments are recovered", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 0)
+		enqueue(t, q, "data")
+
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		q = newQueue(t, fsys, 0)
+		if _, err := q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("compressed active segments are recovered", func(t *testing.T) {
+		for _, encoding := range []compression.Encoding{compression.Gzip, compression.Snappy} {
+			fsys := fs.NewVirtualFilesystem()
+			queue, err := newRealQueue(fsys, "/root", encoding, nil, 0, Quota{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := queue.(*realQueue)
+
+			// The segment is synced but never closed, as if the ingester
+			// crashed, so the compressed stream has no trailer.
+			w, err := q.Enqueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			q = newQueue(t, fsys, 0)
+			r, err := q.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: %v", encoding.Name(), err)
+			}
+			if expected, actual := "data", string(b); expected != actual {
+				t.Errorf("%s: expected: %q, actual: %q", encoding.Name(), expected, actual)
+			}
+			if expected, actual := int64(len(b)), r.Size(); expected != actual {
+				t.Errorf("%s: expected: %d, actual: %d", encoding.Name(), expected, actual)
+			}
+		}
+	})
+
+	t.Run("compressed segments are sized once read", func(t *testing.T) {
+		var (
+			fsys  = fs.NewVirtualFilesystem()
+			input = strings.Repeat("data", 100)
+		)
+		queue, err := newRealQueue(fsys, "/root", compression.Gzip, nil, 0, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := queue.(*realQueue)
+		enqueue(t, q, input)
+
+		// The size survives restarts, even though the segment takes up less
+		// of the disk.
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		q = newQueue(t, fsys, 0)
+		if expected, actual := int64(len(input)), q.Depth().Bytes; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := int64(len(input)), r.Size(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed segments are handed out again", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 0)
+		enqueue(t, q, "data")
+
+		for i := 0; i < 5; i++ {
+			fail(t, q)
+		}
+		if _, err := q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("dead after max attempts", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 3)
+		enqueue(t, q, "data")
+
+		fail(t, q)
+		fail(t, q)
+
+		// Attempts survive restarts.
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		q = newQueue(t, fsys, 3)
+		fail(t, q)
+
+		if _, err := q.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+
+		dead, err := q.DeadSegments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(dead); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 3, dead[0].Attempts; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		r, err := q.OpenDead(dead[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if expected, actual := "data", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("requeue", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1)
+		enqueue(t, q, "data")
+		fail(t, q)
+
+		dead, err := q.DeadSegments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Requeue(dead[0].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// Attempts are forgotten once requeued.
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if dead, err = q.DeadSegments(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(dead); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 1)
+		enqueue(t, q, "data")
+		fail(t, q)
+
+		dead, err := q.DeadSegments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.DeleteDead(dead[0].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := "/root/" + dead[0].ID
+		for _, ext := range []Extension{Dead, Checksum, Attempts} {
+			if expected, actual := false, fsys.Exists(filename+ext.Ext()); expected != actual {
+				t.Errorf("%s: expected: %t, actual: %t", ext, expected, actual)
+			}
+		}
+	})
+
+	t.Run("unknown dead segment", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1)
+		for _, id := range []string{"", "unknown", "../root/LOCK"} {
+			if err := q.Requeue(id); !ErrNotFound(err) {
+				t.Errorf("%q: expected not found, actual: %v", id, err)
+			}
+			if err := q.DeleteDead(id); !ErrNotFound(err) {
+				t.Errorf("%q: expected not found, actual: %v", id, err)
+			}
+		}
+	})
+
+	t.Run("depth", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1)
+		enqueue(t, q, "aa")
+		enqueue(t, q, "bbb")
+		enqueue(t, q, "c")
+		fail(t, q)
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Enqueue(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := Depth{Active: 1, Flushed: 1, Pending: 1, Dead: 1, Bytes: 6}
+		if actual := q.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+	})
+
+	t.Run("segments", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 1)
+		enqueue(t, q, "aa")
+		enqueue(t, q, "bbb")
+		enqueue(t, q, "c")
+		fail(t, q)
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Enqueue(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := q.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var states []string
+		for _, s := range segments {
+			states = append(states, s.State)
+			if s.Created.IsZero() {
+				t.Errorf("%s: expected a created time", s.ID)
+			}
+		}
+		if expected, actual := "dead pending flushed active", strings.Join(states, " "); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := int64(3), segments[1].Size; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("delete flushed", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 0)
+		enqueue(t, q, "data")
+		fail(t, q)
+
+		segments, err := q.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := segments[0].ID
+		if err := q.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := "/root/" + id
+		for _, ext := range []Extension{Flushed, Checksum, Attempts} {
+			if expected, actual := false, fsys.Exists(filename+ext.Ext()); expected != actual {
+				t.Errorf("%s: expected: %t, actual: %t", ext, expected, actual)
+			}
+		}
+		if _, err := q.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+		if err := q.Delete(id); !ErrNotFound(err) {
+			t.Errorf("expected not found, actual: %v", err)
+		}
+	})
+
+	t.Run("delete only flushed", func(t *testing.T) {
+		q := newQueue(t, fs.NewVirtualFilesystem(), 0)
+		enqueue(t, q, "data")
+		if _, err := q.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Enqueue(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := q.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range segments {
+			if err := q.Delete(s.ID); !ErrNotFound(err) {
+				t.Errorf("%s: expected not found, actual: %v", s.State, err)
+			}
+		}
+	})
+
+	t.Run("topics are kept apart", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		q := newQueue(t, fsys, 0)
+		audit, err := newRealQueue(fsys, topic.Root("/root", "audit"), compression.Identity, nil, 0, Quota{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enqueue(t, audit, "data")
+		if _, err := audit.Dequeue(); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Recovering the default topic leaves the pending segments of other
+		// topics alone.
+		q = newQueue(t, fsys, 0)
+		if expected, actual := (Depth{}), q.Depth(); expected != actual {
+			t.Errorf("expected: %+v, actual: %+v", expected, actual)
+		}
+		if expected, actual := 1, audit.Depth().Pending; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if _, err := q.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		for _, testcase := range []struct {
+			name  string
+			quota Quota
+			free  int64
+			disk  bool
+		}{
+			{"max segments", Quota{MaxSegments: 2}, 100, false},
+			{"max bytes", Quota{MaxBytes: 8}, 100, false},
+			{"min free bytes", Quota{MinFreeBytes: 50}, 10, true},
+		} {
+			fsys := freeSpaceFilesystem{fs.NewVirtualFilesystem(), testcase.free}
+			q, err := newRealQueue(fsys, "/root", compression.Identity, nil, 0, testcase.quota)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !testcase.disk {
+				enqueue(t, q, "data")
+				enqueue(t, q, "data")
+			}
+			_, err = q.Enqueue()
+			if expected, actual := true, ErrQueueFull(err); expected != actual {
+				t.Errorf("%s: expected: %t, actual: %t", testcase.name, expected, actual)
+			}
+			if expected, actual := testcase.disk, ErrDiskFull(err); expected != actual {
+				t.Errorf("%s: expected: %t, actual: %t", testcase.name, expected, actual)
+			}
+		}
+	})
+
+	t.Run("legacy segments are created when last modified", func(t *testing.T) {
+		var (
+			fsys = fs.NewVirtualFilesystem()
+			id   = uuid.MustNew().String()
+		)
+		if err := fsys.MkdirAll("/root"); err != nil {
+			t.Fatal(err)
+		}
+		f, err := fsys.Create(filepath.Join("/root", id+Flushed.Ext()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		q := newQueue(t, fsys, 0)
+		segments, err := q.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := false, segments[0].Created.IsZero(); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("quota counts active segments", func(t *testing.T) {
+		q, err := newRealQueue(fs.NewVirtualFilesystem(), "/root", compression.Identity, nil, 0, Quota{MaxBytes: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := q.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := int64(4), q.Depth().Bytes; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if _, err := q.Enqueue(); !ErrQueueFull(err) {
+			t.Errorf("expected queue full, actual: %v", err)
+		}
+	})
+
+	t.Run("quota excludes dead segments", func(t *testing.T) {
+		q, err := newRealQueue(fs.NewVirtualFilesystem(), "/root", compression.Identity, nil, 1, Quota{MaxSegments: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enqueue(t, q, "data")
+
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Failed(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, q.Depth().Dead; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if _, err := q.Enqueue(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("quota frees up", func(t *testing.T) {
+		q, err := newRealQueue(fs.NewVirtualFilesystem(), "/root", compression.Identity, nil, 0, Quota{MaxSegments: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enqueue(t, q, "data")
+
+		r, err := q.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Enqueue(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+type freeSpaceFilesystem struct {
+	fs.Filesystem
+	free int64
+}
+
+func (f freeSpaceFilesystem) FreeSpace(string) (int64, error) {
+	return f.free, nil
+}
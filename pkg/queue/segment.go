@@ -17,7 +17,7 @@ type WriteSegment interface {
 	// Delete the written segment or fails with an error
 	Delete() error
 
-	// Size gets the size of the read segment.
+	// Size gets the size of the segment written so far.
 	Size() int64
 }
 
@@ -33,6 +33,7 @@ type ReadSegment interface {
 	// Failed notifies the read segment or fails with an error
 	Failed() error
 
-	// Size gets the size of the read segment.
+	// Size gets the size of the segment once read, which is the size it was
+	// written with, regardless of how it's compressed.
 	Size() int64
 }
@@ -3,77 +3,295 @@ package queue
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"math"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/uuid"
 	"github.com/pkg/errors"
 )
 
 type virtualQueue struct {
-	mutex sync.Mutex
-	stack []*virtualSegment
+	mutex       sync.Mutex
+	stack       []*virtualSegment
+	pending     map[*virtualSegment]struct{}
+	dead        []*virtualSegment
+	maxAttempts int
+	quota       Quota
 }
 
-func newVirtualQueue() Queue {
+func newVirtualQueue(maxAttempts int, quota Quota) Queue {
 	return &virtualQueue{
 		sync.Mutex{},
 		make([]*virtualSegment, 0),
+		make(map[*virtualSegment]struct{}),
+		make([]*virtualSegment, 0),
+		maxAttempts,
+		quota,
 	}
 }
 
+// Enqueue fails with a queue full error if the queue is at its quota. The
+// segments are held in memory, so there's no free disk space to run out of.
 func (q *virtualQueue) Enqueue() (WriteSegment, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	s := newVirtualSegment()
+	if err := q.quota.check(q.depth(), math.MaxInt64); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewTime()
+	if err != nil {
+		return nil, errors.Wrap(err, "enqueue")
+	}
+
+	s := newVirtualSegment(q, id.String())
 	q.stack = append(q.stack, s)
 	return s, nil
 }
 
+// Dequeue hands out the oldest flushed segment, leaving active segments in
+// place until they're closed, same as the real queue does.
 func (q *virtualQueue) Dequeue() (ReadSegment, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if len(q.stack) == 0 {
-		return nil, errNoSegmentsAvailable{errors.New("nothing found for reading")}
+	for i, s := range q.stack {
+		if !s.closed {
+			continue
+		}
+		q.stack = append(q.stack[:i], q.stack[i+1:]...)
+		q.pending[s] = struct{}{}
+		return s, nil
 	}
+	return nil, errNoSegmentsAvailable{errors.New("nothing found for reading")}
+}
 
-	var s ReadSegment
-	s, q.stack = q.stack[0], q.stack[1:]
+func (q *virtualQueue) Depth() Depth {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	return s, nil
+	return q.depth()
+}
+
+func (q *virtualQueue) depth() Depth {
+	var d Depth
+	for _, s := range q.stack {
+		if s.closed {
+			d.Flushed++
+		} else {
+			d.Active++
+		}
+		d.Bytes += s.Size()
+	}
+	for s := range q.pending {
+		d.Pending++
+		d.Bytes += s.Size()
+	}
+	for _, s := range q.dead {
+		d.Dead++
+		d.Bytes += s.Size()
+	}
+	return d
+}
+
+func (q *virtualQueue) Segments() ([]Segment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var res []Segment
+	for _, s := range q.stack {
+		state := Active
+		if s.closed {
+			state = Flushed
+		}
+		res = append(res, newSegment(s.id, state, s.Size(), time.Time{}))
+	}
+	for s := range q.pending {
+		res = append(res, newSegment(s.id, Pending, s.Size(), time.Time{}))
+	}
+	for _, s := range q.dead {
+		res = append(res, newSegment(s.id, Dead, s.Size(), time.Time{}))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// Delete only removes flushed segments, same as the real queue does.
+func (q *virtualQueue) Delete(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, s := range q.stack {
+		if s.id == id && s.closed {
+			q.stack = append(q.stack[:i], q.stack[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound{errors.Errorf("flushed segment %q not found", id)}
+}
+
+func (q *virtualQueue) DeadSegments() ([]DeadSegment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	res := make([]DeadSegment, len(q.dead))
+	for i, s := range q.dead {
+		res[i] = DeadSegment{
+			ID:       s.id,
+			Size:     s.Size(),
+			Attempts: s.attempts,
+			ModTime:  s.modTime,
+		}
+	}
+	return res, nil
+}
+
+func (q *virtualQueue) OpenDead(id string) (io.ReadCloser, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, err := q.findDead(id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(q.dead[i].buffer.Bytes())), nil
+}
+
+func (q *virtualQueue) Requeue(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, err := q.findDead(id)
+	if err != nil {
+		return err
+	}
+
+	s := q.dead[i]
+	q.dead = append(q.dead[:i], q.dead[i+1:]...)
+	s.attempts, s.offset = 0, 0
+	q.stack = append([]*virtualSegment{s}, q.stack...)
+	return nil
+}
+
+func (q *virtualQueue) DeleteDead(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, err := q.findDead(id)
+	if err != nil {
+		return err
+	}
+	q.dead = append(q.dead[:i], q.dead[i+1:]...)
+	return nil
+}
+
+func (q *virtualQueue) findDead(id string) (int, error) {
+	for i, s := range q.dead {
+		if s.id == id {
+			return i, nil
+		}
+	}
+	return -1, errNotFound{errors.Errorf("dead segment %q not found", id)}
+}
+
+func (q *virtualQueue) commit(s *virtualSegment) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.pending, s)
+}
+
+// failed puts the segment back at the front of the queue, same as the real
+// queue does, unless it failed the max attempts.
+func (q *virtualQueue) failed(s *virtualSegment) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.pending, s)
+	s.attempts++
+	s.offset = 0
+	if q.maxAttempts > 0 && s.attempts >= q.maxAttempts {
+		q.dead = append(q.dead, s)
+		return
+	}
+	q.stack = append([]*virtualSegment{s}, q.stack...)
 }
 
 type virtualSegment struct {
-	buffer *bytes.Buffer
-	size   *countingWriter
+	queue    *virtualQueue
+	id       string
+	buffer   *bytes.Buffer
+	offset   int
+	size     *countingWriter
+	attempts int
+	closed   bool
+	modTime  time.Time
 }
 
-func newVirtualSegment() *virtualSegment {
+func newVirtualSegment(queue *virtualQueue, id string) *virtualSegment {
 	return &virtualSegment{
-		new(bytes.Buffer),
-		&countingWriter{},
+		queue:   queue,
+		id:      id,
+		buffer:  new(bytes.Buffer),
+		size:    &countingWriter{},
+		modTime: time.Now(),
 	}
 }
+
+// Read reads the segment without draining it, so that a failed segment can be
+// read again.
 func (v *virtualSegment) Read(b []byte) (int, error) {
-	return v.buffer.Read(b)
+	p := v.buffer.Bytes()[v.offset:]
+	if len(p) == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, p)
+	v.offset += n
+	return n, nil
 }
 
 func (v *virtualSegment) Write(b []byte) (int, error) {
+	v.queue.mutex.Lock()
+	defer v.queue.mutex.Unlock()
+
 	w := io.MultiWriter(v.buffer, v.size)
 	return w.Write(b)
 }
 
-func (v *virtualSegment) Sync() error  { return nil }
-func (v *virtualSegment) Close() error { return nil }
+func (v *virtualSegment) Sync() error { return nil }
+func (v *virtualSegment) Close() error {
+	v.queue.mutex.Lock()
+	defer v.queue.mutex.Unlock()
+
+	v.closed = true
+	return nil
+}
 
 func (v *virtualSegment) Delete() error {
 	v.buffer.Reset()
 	v.size.Reset()
+	v.offset = 0
 	return nil
 }
 
-func (v *virtualSegment) Commit() error { return nil }
-func (v *virtualSegment) Failed() error { return nil }
+func (v *virtualSegment) Commit() error {
+	v.queue.commit(v)
+	return nil
+}
+
+func (v *virtualSegment) Failed() error {
+	v.queue.failed(v)
+	return nil
+}
 
 func (v *virtualSegment) Size() int64 {
 	return v.size.Len()
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"io/ioutil"
 	"reflect"
 	"testing"
 	"testing/quick"
@@ -11,7 +12,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("enqueue", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -32,7 +33,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("sync returns nil", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -52,7 +53,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("close returns nil", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -72,7 +73,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("delete resets the write segment", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -96,7 +97,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("dequeue", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -106,6 +107,9 @@ func TestVirtualQueue(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
 
 			r, err := queue.Dequeue()
 			if err != nil {
@@ -127,7 +131,7 @@ func TestVirtualQueue(t *testing.T) {
 	})
 
 	t.Run("dequeue empty queue should return err", func(t *testing.T) {
-		queue := newVirtualQueue()
+		queue := newVirtualQueue(0, Quota{})
 		_, err := queue.Dequeue()
 		if expected, actual := true, err != nil; expected != actual {
 			t.Errorf("expected: %t, actual: %t", expected, actual)
@@ -135,7 +139,7 @@ func TestVirtualQueue(t *testing.T) {
 	})
 
 	t.Run("dequeue empty queue should return ErrNoSegmentsAvailable", func(t *testing.T) {
-		queue := newVirtualQueue()
+		queue := newVirtualQueue(0, Quota{})
 		_, err := queue.Dequeue()
 		if expected, actual := true, ErrNoSegmentsAvailable(err); expected != actual {
 			t.Errorf("expected: %t, actual: %t", expected, actual)
@@ -144,7 +148,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("dequeue then commit returns nil", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -153,6 +157,9 @@ func TestVirtualQueue(t *testing.T) {
 			if _, err := w.Write(b); err != nil {
 				t.Fatal(err)
 			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
 
 			r, err := queue.Dequeue()
 			if err != nil {
@@ -169,7 +176,7 @@ func TestVirtualQueue(t *testing.T) {
 
 	t.Run("dequeue then failed returns nil", func(t *testing.T) {
 		fn := func(b []byte) bool {
-			queue := newVirtualQueue()
+			queue := newVirtualQueue(0, Quota{})
 			w, err := queue.Enqueue()
 			if err != nil {
 				t.Fatal(err)
@@ -178,6 +185,9 @@ func TestVirtualQueue(t *testing.T) {
 			if _, err := w.Write(b); err != nil {
 				t.Fatal(err)
 			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
 
 			r, err := queue.Dequeue()
 			if err != nil {
@@ -191,4 +201,90 @@ func TestVirtualQueue(t *testing.T) {
 			t.Error(err)
 		}
 	})
+
+	t.Run("dead after max attempts", func(t *testing.T) {
+		queue := newVirtualQueue(2, Quota{})
+		w, err := queue.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			r, err := queue.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Failed(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := queue.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+
+		dead, err := queue.DeadSegments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(dead); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if err := queue.Requeue(dead[0].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// Requeued segments are read from the start again.
+		r, err := queue.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "data", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("active segments are not dequeued", func(t *testing.T) {
+		queue := newVirtualQueue(0, Quota{})
+		w, err := queue.Enqueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := queue.Dequeue(); !ErrNoSegmentsAvailable(err) {
+			t.Errorf("expected no segments available, actual: %v", err)
+		}
+
+		if _, err := w.Write([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := queue.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "ab", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
 }
@@ -0,0 +1,261 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// Reason describes why an active segment was rotated.
+type Reason string
+
+const (
+
+	// ReasonSize states the segment was rotated as it reached the max bytes.
+	ReasonSize Reason = "size"
+
+	// ReasonRecords states the segment was rotated as it reached the max
+	// records.
+	ReasonRecords Reason = "records"
+
+	// ReasonAge states the segment was rotated as it reached the max age.
+	ReasonAge Reason = "age"
+
+	// ReasonIdle states the segment was rotated as it hasn't been written to
+	// within the idle timeout.
+	ReasonIdle Reason = "idle"
+
+	// ReasonStop states the segment was rotated as the writer was stopped.
+	ReasonStop Reason = "stop"
+)
+
+func (r Reason) String() string {
+	return string(r)
+}
+
+// Sync describes when a write is synced to the underlying storage.
+type Sync int
+
+const (
+
+	// SyncNever never explicitly syncs the write.
+	SyncNever Sync = iota
+
+	// SyncOnRotate syncs the segment holding the write before it's rotated.
+	SyncOnRotate
+
+	// SyncImmediately syncs the segment holding the write before returning.
+	SyncImmediately
+)
+
+// RotationPolicy defines when an active segment is rotated, so that it's closed
+// and flushed, making it available to be dequeued. Zero values disable the
+// respective rule.
+type RotationPolicy struct {
+
+	// MaxBytes rotates the segment once it's at least this size.
+	MaxBytes int64
+
+	// MaxRecords rotates the segment once it holds at least this many records.
+	MaxRecords int
+
+	// MaxAge rotates the segment once it has been active for this long.
+	MaxAge time.Duration
+
+	// IdleTimeout rotates the segment once it has gone this long without a
+	// write.
+	IdleTimeout time.Duration
+}
+
+// RotatingWriter appends encoded records to the active segment of a
+// queue, rotating the segment according to the rotation policy.
+type RotatingWriter struct {
+	mutex          sync.Mutex
+	queue          Queue
+	policy         RotationPolicy
+	active         WriteSegment
+	activeSince    time.Time
+	activeRecords  int
+	activeSync     bool
+	lastWrite      time.Time
+	stop           chan chan struct{}
+	writtenBytes   metrics.Counter
+	writtenRecords metrics.Counter
+	rotations      metrics.CounterVec
+	logger         log.Logger
+}
+
+// NewRotatingWriter creates a RotatingWriter for the queue.
+func NewRotatingWriter(
+	queue Queue,
+	policy RotationPolicy,
+	writtenBytes, writtenRecords metrics.Counter,
+	rotations metrics.CounterVec,
+	logger log.Logger,
+) *RotatingWriter {
+	return &RotatingWriter{
+		queue:          queue,
+		policy:         policy,
+		stop:           make(chan chan struct{}),
+		writtenBytes:   writtenBytes,
+		writtenRecords: writtenRecords,
+		rotations:      rotations,
+		logger:         logger,
+	}
+}
+
+// Write appends a single encoded record to the active segment, creating
+// a new segment if required. Write never explicitly syncs the write, see
+// WriteSync.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	return w.WriteSync(p, 1, SyncNever)
+}
+
+// WriteSync appends the encoded records to the active segment,
+// syncing the write according to sync. The number of records is given by the
+// caller, as only the decoder of the records knows where each one ends.
+func (w *RotatingWriter) WriteSync(p []byte, records int, sync Sync) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	if w.active == nil {
+		segment, err := w.queue.Enqueue()
+		if err != nil {
+			return 0, errors.Wrap(err, "enqueue")
+		}
+		w.active, w.activeSince = segment, now
+	}
+
+	n, err := w.active.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	w.activeRecords += records
+	w.lastWrite = now
+
+	w.writtenBytes.Add(float64(n))
+	w.writtenRecords.Add(float64(records))
+
+	switch sync {
+	case SyncOnRotate:
+		w.activeSync = true
+	case SyncImmediately:
+		if err := w.active.Sync(); err != nil {
+			return n, errors.Wrap(err, "sync")
+		}
+	}
+
+	if reason, ok := w.full(); ok {
+		return n, w.rotate(reason)
+	}
+	return n, nil
+}
+
+// Run rotates the active segment once it's too old or idle. Run returns when
+// Stop is invoked.
+func (w *RotatingWriter) Run() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := w.rotateExpired(now); err != nil {
+				level.Warn(w.logger).Log("state", "rotate", "err", err)
+			}
+
+		case q := <-w.stop:
+			w.mutex.Lock()
+			if err := w.rotate(ReasonStop); err != nil {
+				level.Warn(w.logger).Log("state", "stop", "err", err)
+			}
+			w.mutex.Unlock()
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the writer and rotate any active segment.
+func (w *RotatingWriter) Stop() {
+	q := make(chan struct{})
+	w.stop <- q
+	<-q
+}
+
+func (w *RotatingWriter) rotateExpired(now time.Time) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if reason, ok := w.expired(now); ok {
+		return w.rotate(reason)
+	}
+	return nil
+}
+
+// full checks the active segment against the size based rules of the policy.
+// The caller must hold the mutex.
+func (w *RotatingWriter) full() (Reason, bool) {
+	if w.active == nil {
+		return "", false
+	}
+	if max := w.policy.MaxBytes; max > 0 && w.active.Size() >= max {
+		return ReasonSize, true
+	}
+	if max := w.policy.MaxRecords; max > 0 && w.activeRecords >= max {
+		return ReasonRecords, true
+	}
+	return "", false
+}
+
+// expired checks the active segment against the time based rules of the
+// policy. The caller must hold the mutex.
+func (w *RotatingWriter) expired(now time.Time) (Reason, bool) {
+	if w.active == nil {
+		return "", false
+	}
+	if max := w.policy.MaxAge; max > 0 && now.Sub(w.activeSince) >= max {
+		return ReasonAge, true
+	}
+	if idle := w.policy.IdleTimeout; idle > 0 && now.Sub(w.lastWrite) >= idle {
+		return ReasonIdle, true
+	}
+	return "", false
+}
+
+// rotate closes the active segment, making it available to be dequeued. Empty
+// segments are deleted instead. The caller must hold the mutex.
+func (w *RotatingWriter) rotate(reason Reason) error {
+	if w.active == nil {
+		return nil
+	}
+
+	segment, sync := w.active, w.activeSync
+	w.active, w.activeSince, w.activeRecords, w.activeSync = nil, time.Time{}, 0, false
+
+	if segment.Size() == 0 {
+		return segment.Delete()
+	}
+	if sync {
+		if err := segment.Sync(); err != nil {
+			// The segment is still closed, so that it isn't left behind as
+			// active until the queue recovers it on restart.
+			if closeErr := segment.Close(); closeErr != nil {
+				level.Warn(w.logger).Log("state", "rotate", "err", closeErr)
+			}
+			return errors.Wrap(err, "sync")
+		}
+	}
+	if err := segment.Close(); err != nil {
+		return err
+	}
+
+	w.rotations.WithLabelValues(reason.String()).Inc()
+	return nil
+}
@@ -0,0 +1,305 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	t.Parallel()
+
+	record := func() []byte {
+		return []byte(fmt.Sprintf("%s Foo\n", uuid.MustNew().String()))
+	}
+	counter := func() prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: "rotations"})
+	}
+
+	t.Run("write", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			writtenBytes   = metricMocks.NewMockCounter(ctrl)
+			writtenRecords = metricMocks.NewMockCounter(ctrl)
+			rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+			queue = newVirtualQueue(0, Quota{})
+			input = record()
+		)
+
+		writtenBytes.EXPECT().Add(float64(len(input)))
+		writtenRecords.EXPECT().Add(float64(1))
+		rotations.EXPECT().
+			WithLabelValues(ReasonStop.String()).
+			Return(counter())
+
+		w := NewRotatingWriter(queue, RotationPolicy{}, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+		go w.Run()
+		if _, err := w.Write(input); err != nil {
+			t.Fatal(err)
+		}
+		w.Stop()
+
+		segment, err := queue.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := input, b; !bytes.Equal(expected, actual) {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	for _, testcase := range []struct {
+		name   string
+		policy RotationPolicy
+		reason Reason
+	}{
+		{"rotate on max bytes", RotationPolicy{MaxBytes: 1}, ReasonSize},
+		{"rotate on max records", RotationPolicy{MaxRecords: 2}, ReasonRecords},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var (
+				writtenBytes   = metricMocks.NewMockCounter(ctrl)
+				writtenRecords = metricMocks.NewMockCounter(ctrl)
+				rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+				input = record()
+			)
+
+			writtenBytes.EXPECT().Add(float64(len(input))).Times(2)
+			writtenRecords.EXPECT().Add(float64(1)).Times(2)
+			rotations.EXPECT().
+				WithLabelValues(testcase.reason.String()).
+				Return(counter()).
+				MinTimes(1)
+
+			w := NewRotatingWriter(newVirtualQueue(0, Quota{}), testcase.policy, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+			for i := 0; i < 2; i++ {
+				if _, err := w.Write(input); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if expected, actual := true, w.active == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		})
+	}
+
+	for _, testcase := range []struct {
+		name   string
+		policy RotationPolicy
+		reason Reason
+	}{
+		{"rotate on max age", RotationPolicy{MaxAge: time.Millisecond}, ReasonAge},
+		{"rotate on idle timeout", RotationPolicy{IdleTimeout: time.Millisecond}, ReasonIdle},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var (
+				writtenBytes   = metricMocks.NewMockCounter(ctrl)
+				writtenRecords = metricMocks.NewMockCounter(ctrl)
+				rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+				input = record()
+			)
+
+			writtenBytes.EXPECT().Add(float64(len(input)))
+			writtenRecords.EXPECT().Add(float64(1))
+			rotations.EXPECT().
+				WithLabelValues(testcase.reason.String()).
+				Return(counter())
+
+			w := NewRotatingWriter(newVirtualQueue(0, Quota{}), testcase.policy, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+			if _, err := w.Write(input); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.rotateExpired(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := true, w.active == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		})
+	}
+
+	t.Run("records are counted by the caller", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			writtenBytes   = metricMocks.NewMockCounter(ctrl)
+			writtenRecords = metricMocks.NewMockCounter(ctrl)
+			rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+			// A binary payload holding newlines is still a single record.
+			input = []byte("\x1e\n\n\n")
+		)
+
+		writtenBytes.EXPECT().Add(float64(len(input)))
+		writtenRecords.EXPECT().Add(float64(1))
+		rotations.EXPECT().
+			WithLabelValues(ReasonRecords.String()).
+			Return(counter())
+
+		w := NewRotatingWriter(newVirtualQueue(0, Quota{}), RotationPolicy{MaxRecords: 1}, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+		if _, err := w.WriteSync(input, 1, SyncNever); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := true, w.active == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("rotate deletes empty segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			writtenBytes   = metricMocks.NewMockCounter(ctrl)
+			writtenRecords = metricMocks.NewMockCounter(ctrl)
+			rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+			queue = &syncQueue{}
+		)
+
+		writtenBytes.EXPECT().Add(float64(0))
+		writtenRecords.EXPECT().Add(float64(0))
+
+		w := NewRotatingWriter(queue, RotationPolicy{}, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+		if _, err := w.WriteSync(nil, 0, SyncNever); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.rotate(ReasonStop); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := true, queue.segment.deleted; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	for _, testcase := range []struct {
+		name            string
+		sync            Sync
+		syncsAfterWrite int
+	}{
+		{"write sync never", SyncNever, 0},
+		{"write sync on rotate", SyncOnRotate, 0},
+		{"write sync immediately", SyncImmediately, 1},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var (
+				writtenBytes   = metricMocks.NewMockCounter(ctrl)
+				writtenRecords = metricMocks.NewMockCounter(ctrl)
+				rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+				queue = &syncQueue{}
+				input = record()
+			)
+
+			writtenBytes.EXPECT().Add(float64(len(input)))
+			writtenRecords.EXPECT().Add(float64(1))
+			rotations.EXPECT().
+				WithLabelValues(ReasonStop.String()).
+				Return(counter())
+
+			w := NewRotatingWriter(queue, RotationPolicy{}, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+			if _, err := w.WriteSync(input, 1, testcase.sync); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := testcase.syncsAfterWrite, queue.segment.syncs; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+
+			if err := w.rotate(ReasonStop); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := testcase.sync != SyncNever, queue.segment.syncs > 0; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		})
+	}
+
+	t.Run("rotate closes segments that fail to sync", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			writtenBytes   = metricMocks.NewMockCounter(ctrl)
+			writtenRecords = metricMocks.NewMockCounter(ctrl)
+			rotations      = metricMocks.NewMockCounterVec(ctrl)
+
+			queue = &syncQueue{}
+			input = record()
+		)
+
+		writtenBytes.EXPECT().Add(float64(len(input)))
+		writtenRecords.EXPECT().Add(float64(1))
+
+		w := NewRotatingWriter(queue, RotationPolicy{}, writtenBytes, writtenRecords, rotations, log.NewNopLogger())
+		if _, err := w.WriteSync(input, 1, SyncOnRotate); err != nil {
+			t.Fatal(err)
+		}
+
+		queue.segment.syncErr = errors.New("bad")
+		if err := w.rotate(ReasonStop); err == nil {
+			t.Fatal("expected error")
+		}
+		if expected, actual := true, queue.segment.closed; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+// syncQueue only implements what the writer uses, the rest of the queue is
+// left nil.
+type syncQueue struct {
+	Queue
+	segment *syncSegment
+}
+
+func (q *syncQueue) Enqueue() (WriteSegment, error) {
+	q.segment = &syncSegment{}
+	return q.segment, nil
+}
+
+func (q *syncQueue) Dequeue() (ReadSegment, error) {
+	return nil, errors.New("not implemented")
+}
+
+type syncSegment struct {
+	bytes.Buffer
+	syncs   int
+	syncErr error
+	closed  bool
+	deleted bool
+}
+
+func (s *syncSegment) Sync() error   { s.syncs++; return s.syncErr }
+func (s *syncSegment) Close() error  { s.closed = true; return nil }
+func (s *syncSegment) Delete() error { s.deleted = true; return nil }
+func (s *syncSegment) Size() int64   { return int64(s.Len()) }
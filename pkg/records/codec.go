@@ -0,0 +1,348 @@
+package records
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TextContentType is the content type of records encoded as newline
+	// delimited text.
+	TextContentType = "text/plain; charset=utf-8"
+
+	// BinaryContentType is the content type of records encoded in the length
+	// prefixed binary format.
+	BinaryContentType = "application/x-cluster-records"
+)
+
+const (
+	// binaryMagic starts every binary record, as a record separator can never
+	// start a text record, it allows both formats to be told apart.
+	binaryMagic byte = 0x1e
+
+	// binaryHeaderSize is the size of the magic, id, timestamp and payload
+	// length that head every binary record.
+	binaryHeaderSize = 1 + len(uuid.UUID{}) + 8 + 4
+)
+
+// MaxRecordSize is the largest a record can be once encoded, in either format.
+// Larger records are invalid, so that a single record can't exhaust the memory
+// of the decoder.
+const MaxRecordSize = 16 * 1024 * 1024
+
+// Record is a single record, identified by its id.
+type Record struct {
+	ID        uuid.UUID
+	Timestamp time.Time
+	Payload   []byte
+}
+
+// NewRecord creates a Record with the id and payload, timestamped with when a
+// time ordered id was generated.
+func NewRecord(id uuid.UUID, payload []byte) Record {
+	t, _ := id.Time()
+	return Record{
+		ID:        id,
+		Timestamp: t,
+		Payload:   payload,
+	}
+}
+
+// Codec encodes and decodes records in a single format.
+type Codec interface {
+
+	// ContentType returns the content type of the format.
+	ContentType() string
+
+	// NewEncoder returns an Encoder writing records to w.
+	NewEncoder(w io.Writer) Encoder
+
+	// NewDecoder returns a Decoder reading records from r.
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Encoder writes records in the format of its codec.
+type Encoder interface {
+
+	// Encode writes the record in one go, so that writers shared between
+	// encoders don't interleave partial records.
+	Encode(Record) error
+}
+
+// Decoder reads records in the format of its codec.
+type Decoder interface {
+
+	// Decode returns the next record, or io.EOF once there are no more
+	// records.
+	Decode() (Record, error)
+
+	// Bytes returns the last decoded record as it was encoded, allowing it to
+	// be copied without encoding it again. Text records missing a trailing
+	// newline will have one appended.
+	Bytes() []byte
+}
+
+var (
+	// Text is the codec for newline delimited records, each prefixed with
+	// the id. Text records carry no timestamp, so it's taken from the id,
+	// and their payloads can not hold newlines.
+	Text Codec = textCodec{}
+
+	// Binary is the codec for length prefixed records, holding the id,
+	// timestamp and payload. Payloads can hold arbitrary bytes.
+	Binary Codec = binaryCodec{}
+)
+
+// NewDecoder returns a Decoder reading records in either format from r,
+// detecting the format of each record as it's read.
+func NewDecoder(r io.Reader) Decoder {
+	return &decoder{r: bufio.NewReader(r), text: true, binary: true}
+}
+
+// CodecFor returns the codec for the content type, falling back to the text
+// codec for any content type other than the binary one.
+func CodecFor(contentType string) Codec {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == BinaryContentType {
+		return Binary
+	}
+	return Text
+}
+
+// Negotiate returns the codec most preferred by the accept header, falling
+// back to the text codec if neither format is accepted.
+func Negotiate(accept string) Codec {
+	var (
+		codec = Text
+		best  float64
+	)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		var c Codec
+		switch mediaType {
+		case "text/plain":
+			c = Text
+		case BinaryContentType:
+			c = Binary
+		default:
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best {
+			codec, best = c, q
+		}
+	}
+	return codec
+}
+
+type textCodec struct{}
+
+func (textCodec) ContentType() string { return TextContentType }
+
+func (textCodec) NewEncoder(w io.Writer) Encoder {
+	return textEncoder{w}
+}
+
+func (textCodec) NewDecoder(r io.Reader) Decoder {
+	return &decoder{r: bufio.NewReader(r), text: true}
+}
+
+type textEncoder struct {
+	w io.Writer
+}
+
+func (e textEncoder) Encode(record Record) error {
+	if bytes.ContainsAny(record.Payload, "\r\n") {
+		return errInvalidRecord{errors.Errorf("payload of %s can not be encoded as text", record.ID)}
+	}
+	if len(record.ID)+len(record.Payload)+2 > MaxRecordSize {
+		return errInvalidRecord{errors.Errorf("payload of %s is too large", record.ID)}
+	}
+
+	buf := make([]byte, 0, len(record.ID)+len(record.Payload)+2)
+	buf = append(buf, record.ID[:]...)
+	buf = append(buf, ' ')
+	buf = append(buf, record.Payload...)
+	buf = append(buf, '\n')
+
+	_, err := e.w.Write(buf)
+	return err
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) ContentType() string { return BinaryContentType }
+
+func (binaryCodec) NewEncoder(w io.Writer) Encoder {
+	return binaryEncoder{w}
+}
+
+func (binaryCodec) NewDecoder(r io.Reader) Decoder {
+	return &decoder{r: bufio.NewReader(r), binary: true}
+}
+
+type binaryEncoder struct {
+	w io.Writer
+}
+
+func (e binaryEncoder) Encode(record Record) error {
+	if binaryHeaderSize+len(record.Payload) > MaxRecordSize {
+		return errInvalidRecord{errors.Errorf("payload of %s is too large", record.ID)}
+	}
+
+	var nanos int64
+	if !record.Timestamp.IsZero() {
+		nanos = record.Timestamp.UnixNano()
+	}
+
+	buf := make([]byte, binaryHeaderSize, binaryHeaderSize+len(record.Payload))
+	buf[0] = binaryMagic
+	copy(buf[1:], record.ID[:])
+	binary.BigEndian.PutUint64(buf[binaryHeaderSize-12:], uint64(nanos))
+	binary.BigEndian.PutUint32(buf[binaryHeaderSize-4:], uint32(len(record.Payload)))
+	buf = append(buf, record.Payload...)
+
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// decoder reads records of the formats it's allowed, telling them apart by
+// the first byte of each record.
+type decoder struct {
+	r            *bufio.Reader
+	text, binary bool
+	raw          []byte
+}
+
+func (d *decoder) Decode() (Record, error) {
+	for {
+		b, err := d.r.Peek(1)
+		if err != nil {
+			return Record{}, err
+		}
+
+		if b[0] == binaryMagic {
+			if !d.binary {
+				return Record{}, errInvalidRecord{errors.Errorf("unexpected binary record")}
+			}
+			return d.decodeBinary()
+		}
+		if !d.text {
+			return Record{}, errInvalidRecord{errors.Errorf("expected binary record")}
+		}
+
+		line, err := d.readLine()
+		if err != nil && err != io.EOF {
+			return Record{}, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		return d.decodeText(line)
+	}
+}
+
+func (d *decoder) Bytes() []byte {
+	return d.raw
+}
+
+// readLine reads up to and including the next newline, failing once the line
+// is larger than the max record size.
+func (d *decoder) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := d.r.ReadSlice('\n')
+		if len(line)+len(b) > MaxRecordSize {
+			return nil, errInvalidRecord{errors.Errorf("record is larger than %d bytes", MaxRecordSize)}
+		}
+		line = append(line, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+func (d *decoder) decodeText(line []byte) (Record, error) {
+	trimmed := bytes.TrimLeft(line, " \t")
+	end := bytes.IndexAny(trimmed, " \t\r\n")
+	if end < 0 {
+		end = len(trimmed)
+	}
+
+	id, err := uuid.ParseBytes(trimmed[:end])
+	if err != nil {
+		return Record{}, errInvalidUUID{errors.Errorf("invalid uuid")}
+	}
+
+	payload := trimmed[end:]
+	if len(payload) > 0 && (payload[0] == ' ' || payload[0] == '\t') {
+		payload = payload[1:]
+	}
+	payload = bytes.TrimSuffix(bytes.TrimSuffix(payload, []byte("\n")), []byte("\r"))
+
+	if line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+	d.raw = line
+
+	return NewRecord(id, payload), nil
+}
+
+func (d *decoder) decodeBinary() (Record, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(binaryHeaderSize)); err != nil {
+		return Record{}, errInvalidRecord{errors.Wrap(unexpected(err), "reading header")}
+	}
+
+	header := buf.Bytes()
+	id, err := uuid.ParseBytes(header[1 : 1+len(uuid.UUID{})])
+	if err != nil {
+		return Record{}, errInvalidUUID{errors.Errorf("invalid uuid")}
+	}
+	var (
+		nanos = int64(binary.BigEndian.Uint64(header[binaryHeaderSize-12:]))
+		size  = binary.BigEndian.Uint32(header[binaryHeaderSize-4:])
+	)
+	if int64(binaryHeaderSize)+int64(size) > MaxRecordSize {
+		return Record{}, errInvalidRecord{errors.Errorf("record is larger than %d bytes", MaxRecordSize)}
+	}
+
+	// The payload is copied rather than read into a buffer of the given size,
+	// so that a corrupt size can't allocate more than the stream holds.
+	if _, err := io.CopyN(&buf, d.r, int64(size)); err != nil {
+		return Record{}, errInvalidRecord{errors.Wrap(unexpected(err), "reading payload")}
+	}
+	d.raw = buf.Bytes()
+
+	record := NewRecord(id, d.raw[binaryHeaderSize:])
+	if nanos != 0 {
+		record.Timestamp = time.Unix(0, nanos).UTC()
+	}
+	return record, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
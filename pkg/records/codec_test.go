@@ -0,0 +1,236 @@
+package records
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestCodec(t *testing.T) {
+	t.Parallel()
+
+	decodeAll := func(t *testing.T, dec Decoder) []Record {
+		var res []Record
+		for {
+			record, err := dec.Decode()
+			if err == io.EOF {
+				return res
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, record)
+		}
+	}
+
+	t.Run("text round trip", func(t *testing.T) {
+		fn := func(id uuid.UUID, payload string) bool {
+			payload = strings.Map(func(r rune) rune {
+				if r == '\r' || r == '\n' {
+					return -1
+				}
+				return r
+			}, payload)
+
+			var buf bytes.Buffer
+			if err := Text.NewEncoder(&buf).Encode(NewRecord(id, []byte(payload))); err != nil {
+				t.Fatal(err)
+			}
+
+			record, err := Text.NewDecoder(&buf).Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return record.ID.Equals(id) && string(record.Payload) == payload
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("binary round trip", func(t *testing.T) {
+		fn := func(id uuid.UUID, payload []byte, nanos int64) bool {
+			var (
+				buf      bytes.Buffer
+				expected = Record{id, time.Unix(0, nanos).UTC(), payload}
+			)
+			if err := Binary.NewEncoder(&buf).Encode(expected); err != nil {
+				t.Fatal(err)
+			}
+
+			dec := Binary.NewDecoder(&buf)
+			actual, err := dec.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dec.Decode(); err != io.EOF {
+				t.Fatalf("expected: %v, actual: %v", io.EOF, err)
+			}
+			return actual.ID.Equals(expected.ID) &&
+				(nanos == 0 || actual.Timestamp.Equal(expected.Timestamp)) &&
+				bytes.Equal(actual.Payload, expected.Payload)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("text rejects newlines", func(t *testing.T) {
+		err := Text.NewEncoder(&bytes.Buffer{}).Encode(NewRecord(uuid.MustNew(), []byte("a\nb")))
+		if expected, actual := true, ErrInvalidRecord(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("large payloads", func(t *testing.T) {
+		payload := bytes.Repeat([]byte("a"), 1<<20)
+		for _, codec := range []Codec{Text, Binary} {
+			var buf bytes.Buffer
+			if err := codec.NewEncoder(&buf).Encode(NewRecord(uuid.MustNewTime(), payload)); err != nil {
+				t.Fatal(err)
+			}
+
+			res := decodeAll(t, codec.NewDecoder(&buf))
+			if expected, actual := 1, len(res); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := len(payload), len(res[0].Payload); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+	})
+
+	t.Run("mixed formats", func(t *testing.T) {
+		var (
+			buf     bytes.Buffer
+			records = []Record{
+				NewRecord(uuid.MustNewTime(), []byte("text")),
+				NewRecord(uuid.MustNewTime(), []byte("binary\nrecord")),
+				NewRecord(uuid.MustNewTime(), []byte("more text")),
+			}
+		)
+		Text.NewEncoder(&buf).Encode(records[0])
+		Binary.NewEncoder(&buf).Encode(records[1])
+		buf.WriteString("\n")
+		Text.NewEncoder(&buf).Encode(records[2])
+		input := buf.String()
+
+		res := decodeAll(t, NewDecoder(strings.NewReader(input)))
+		if expected, actual := len(records), len(res); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for i, record := range records {
+			if expected, actual := string(record.Payload), string(res[i].Payload); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+		}
+
+		// Strict decoders refuse records of the other format.
+		if _, err := Text.NewDecoder(strings.NewReader(input[len(records[0].ID)+6:])).Decode(); !ErrInvalidRecord(err) {
+			t.Errorf("expected invalid record, actual: %v", err)
+		}
+		if _, err := Binary.NewDecoder(strings.NewReader(input)).Decode(); !ErrInvalidRecord(err) {
+			t.Errorf("expected invalid record, actual: %v", err)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		dec := NewDecoder(strings.NewReader("01234567-89ab-cdef-0123-456789abcdef\ta"))
+		record, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "a", string(record.Payload); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "01234567-89ab-cdef-0123-456789abcdef\ta\n", string(dec.Bytes()); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("truncated binary", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := Binary.NewEncoder(&buf).Encode(NewRecord(uuid.MustNewTime(), []byte("abc"))); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := NewDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-1])).Decode()
+		if expected, actual := true, ErrInvalidRecord(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("records over the max size", func(t *testing.T) {
+		payload := bytes.Repeat([]byte("a"), MaxRecordSize)
+		for _, codec := range []Codec{Text, Binary} {
+			err := codec.NewEncoder(&bytes.Buffer{}).Encode(NewRecord(uuid.MustNewTime(), payload))
+			if expected, actual := true, ErrInvalidRecord(err); expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+
+		// Neither a long line nor the size of a binary record is trusted.
+		line := uuid.MustNewTime().String() + " " + string(payload) + "\n"
+		if _, err := NewDecoder(strings.NewReader(line)).Decode(); !ErrInvalidRecord(err) {
+			t.Errorf("expected invalid record, actual: %v", err)
+		}
+		header := make([]byte, binaryHeaderSize)
+		header[0] = binaryMagic
+		copy(header[1:], uuid.MustNewTime().Bytes())
+		binary.BigEndian.PutUint32(header[binaryHeaderSize-4:], math.MaxUint32)
+		if _, err := NewDecoder(bytes.NewReader(header)).Decode(); !ErrInvalidRecord(err) {
+			t.Errorf("expected invalid record, actual: %v", err)
+		}
+	})
+
+	t.Run("invalid uuid", func(t *testing.T) {
+		_, err := NewDecoder(strings.NewReader("bad record\n")).Decode()
+		if expected, actual := true, ErrInvalidUUID(err) && ErrInvalidRecord(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	t.Parallel()
+
+	t.Run("content type", func(t *testing.T) {
+		for _, testcase := range []struct {
+			contentType string
+			expected    Codec
+		}{
+			{"", Text},
+			{"text/plain; charset=utf-8", Text},
+			{"application/x-www-form-urlencoded", Text},
+			{BinaryContentType, Binary},
+		} {
+			if expected, actual := testcase.expected, CodecFor(testcase.contentType); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected.ContentType(), actual.ContentType())
+			}
+		}
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		for _, testcase := range []struct {
+			accept   string
+			expected Codec
+		}{
+			{"", Text},
+			{"*/*", Text},
+			{BinaryContentType, Binary},
+			{"text/plain, " + BinaryContentType, Text},
+			{"text/plain;q=0.5, " + BinaryContentType, Binary},
+			{BinaryContentType + ";q=0", Text},
+		} {
+			if expected, actual := testcase.expected, Negotiate(testcase.accept); expected != actual {
+				t.Errorf("expected: %s, actual: %s, accept: %q", expected.ContentType(), actual.ContentType(), testcase.accept)
+			}
+		}
+	})
+}
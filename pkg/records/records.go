@@ -0,0 +1,142 @@
+package records
+
+import (
+	"io"
+	"sort"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+// Merge will merge multiple readers into one, de-duplicating the records by
+// their uuid and ordering them by uuid.
+func Merge(w io.Writer, readers ...io.Reader) (n int64, err error) {
+	if len(readers) == 0 {
+		return 0, nil
+	}
+
+	// Initialize our state.
+	var (
+		records []record
+		ids     = map[uuid.UUID]struct{}{}
+	)
+
+	// Each reader is decoded on its own, so that a record missing a trailing
+	// newline isn't joined with the first record of the next reader.
+	for _, reader := range readers {
+		if reader == nil {
+			continue
+		}
+
+		dec := NewDecoder(reader)
+		for {
+			rec, err := dec.Decode()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+
+			if _, ok := ids[rec.ID]; !ok {
+				// Records are kept as they were encoded, so that merging
+				// never changes the format of a record.
+				records = append(records, record{rec.ID, dec.Bytes()})
+				ids[rec.ID] = struct{}{}
+			}
+		}
+	}
+
+	// Order the records by their uuid, which for time ordered uuids is the
+	// order they were created in.
+	sort.SliceStable(records, func(i, j int) bool {
+		return uuid.Compare(records[i].id, records[j].id) < 0
+	})
+
+	sw := sizedWriter{w, 0}
+	for _, v := range records {
+		if _, err := sw.Write(v.data); err != nil {
+			return n, err
+		}
+	}
+
+	return sw.n, nil
+}
+
+type record struct {
+	id   uuid.UUID
+	data []byte
+}
+
+type sizedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (sw *sizedWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if err != nil {
+		return 0, err
+	}
+
+	sw.n += int64(n)
+	return len(p), nil
+}
+
+type invalidUUID interface {
+	InvalidUUID() bool
+}
+
+type errInvalidUUID struct {
+	err error
+}
+
+func (e errInvalidUUID) Error() string {
+	return e.err.Error()
+}
+
+func (e errInvalidUUID) InvalidUUID() bool {
+	return true
+}
+
+// InvalidRecord is true, as a record without a valid uuid is an invalid
+// record.
+func (e errInvalidUUID) InvalidRecord() bool {
+	return true
+}
+
+// ErrInvalidUUID tests to see if the error passed is an invalid uuid error or
+// not.
+func ErrInvalidUUID(err error) bool {
+	if err != nil {
+		if _, ok := err.(invalidUUID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type invalidRecord interface {
+	InvalidRecord() bool
+}
+
+type errInvalidRecord struct {
+	err error
+}
+
+func (e errInvalidRecord) Error() string {
+	return e.err.Error()
+}
+
+func (e errInvalidRecord) InvalidRecord() bool {
+	return true
+}
+
+// ErrInvalidRecord tests to see if the error passed is an invalid record error
+// or not, which includes records with an invalid uuid.
+func ErrInvalidRecord(err error) bool {
+	if err != nil {
+		if _, ok := err.(invalidRecord); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -1,4 +1,4 @@
-package consumer
+package records
 
 import (
 	"bytes"
@@ -20,7 +20,7 @@ func TestMergeRecords(t *testing.T) {
 			t.Fatal("failed if called")
 			return 0, nil
 		}}
-		n, err := mergeRecords(w)
+		n, err := Merge(w)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -35,7 +35,7 @@ func TestMergeRecords(t *testing.T) {
 			t.Fatalf("failed if called")
 			return 0, nil
 		}}
-		n, err := mergeRecords(w, nil)
+		n, err := Merge(w, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -66,7 +66,7 @@ func TestMergeRecords(t *testing.T) {
 				return len(p), nil
 			}}
 
-			n, err := mergeRecords(w, r)
+			n, err := Merge(w, r)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -98,7 +98,7 @@ func TestMergeRecords(t *testing.T) {
 				return len(p), nil
 			}}
 
-			_, err := mergeRecords(w, r)
+			_, err := Merge(w, r)
 			return err != nil
 		}
 
@@ -107,10 +107,26 @@ func TestMergeRecords(t *testing.T) {
 		}
 	})
 
+	t.Run("missing trailing newline", func(t *testing.T) {
+		var (
+			a = uuid.MustNewTime().String()
+			b = uuid.MustNewTime().String()
+		)
+
+		var buf bytes.Buffer
+		if _, err := Merge(&buf, strings.NewReader(a+" A"), strings.NewReader(b+" B")); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := fmt.Sprintf("%s A\n%s B\n", a, b), buf.String(); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
 	// Manual tests
 	ids := make([]string, 10)
 	for k := range ids {
-		ids[k] = uuid.MustNew().String()
+		ids[k] = uuid.MustNewTime().String()
 	}
 
 	testcases := []struct {
@@ -180,7 +196,7 @@ func TestMergeRecords(t *testing.T) {
 				{},
 			},
 			output: []string{
-				ids[0], ids[1], ids[2], ids[3], ids[4], ids[5], ids[7], ids[6], ids[8],
+				ids[0], ids[1], ids[2], ids[3], ids[4], ids[5], ids[6], ids[7], ids[8],
 			},
 		},
 		{
@@ -192,7 +208,17 @@ func TestMergeRecords(t *testing.T) {
 				{ids[6], fmt.Sprintf("%s C", ids[8])},
 			},
 			output: []string{
-				fmt.Sprintf("%s A", ids[0]), ids[1], fmt.Sprintf("%s B", ids[2]), ids[3], ids[4], ids[5], ids[7], ids[6], fmt.Sprintf("%s C", ids[8]),
+				fmt.Sprintf("%s A", ids[0]), ids[1], fmt.Sprintf("%s B", ids[2]), ids[3], ids[4], ids[5], ids[6], ids[7], fmt.Sprintf("%s C", ids[8]),
+			},
+		},
+		{
+			name: "ordered by id",
+			input: [][]string{
+				{fmt.Sprintf("%s C", ids[2]), fmt.Sprintf("%s A", ids[0])},
+				{fmt.Sprintf("%s D", ids[3]), fmt.Sprintf("%s B", ids[1])},
+			},
+			output: []string{
+				fmt.Sprintf("%s A", ids[0]), fmt.Sprintf("%s B", ids[1]), fmt.Sprintf("%s C", ids[2]), fmt.Sprintf("%s D", ids[3]),
 			},
 		},
 		{
@@ -220,7 +246,7 @@ func TestMergeRecords(t *testing.T) {
 			}
 
 			var buf bytes.Buffer
-			if _, err := mergeRecords(&buf, readers...); err != nil {
+			if _, err := Merge(&buf, readers...); err != nil {
 				t.Error(err)
 				return
 			}
@@ -1,25 +1,59 @@
 package store
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/clients"
+	"github.com/SimonRichardson/cluster/pkg/cluster"
+	"github.com/SimonRichardson/cluster/pkg/compression"
 	"github.com/SimonRichardson/cluster/pkg/members"
 	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/SimonRichardson/cluster/pkg/records"
 	"github.com/SimonRichardson/cluster/pkg/uuid"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 )
 
+// Every path takes the topic of the segments, which is the default topic if
+// none is given. Each topic is held in its own log.
 const (
 
-	// APIPathReplicate represents a way to replicate a segment by id.
+	// APIPathReplicate represents a way to replicate a segment by id, optionally
+	// compressed with the content encoding.
 	APIPathReplicate = "/replicate"
+
+	// APIPathQuery represents a way to query the records of stored segments.
+	APIPathQuery = "/query"
+
+	// APIPathInventory represents a way to list the stored segments, along
+	// with their checksums.
+	APIPathInventory = "/inventory"
+)
+
+const (
+
+	// httpHeaderFailedPeers lists the peers that failed to answer a fan-out
+	// query.
+	httpHeaderFailedPeers = "X-Cluster-Failed-Peers"
+)
+
+const (
+
+	// defaultMaxPeerQueryBytes caps the result read from each peer of a
+	// fan-out query, as every result is held in memory to be merged.
+	defaultMaxPeerQueryBytes = 128 * 1024 * 1024
 )
 
 // ClusterPeer models cluster.Peer.
@@ -31,25 +65,42 @@ type ClusterPeer interface {
 // API serves the store API
 type API struct {
 	peer               ClusterPeer
+	client             clients.Client
+	logs               map[string]Log
+	inventories        map[string]*inventory
 	replicatedSegments metrics.Counter
 	replicatedBytes    metrics.Counter
+	corruptSegments    metrics.Counter
 	duration           metrics.HistogramVec
 	logger             log.Logger
+	maxPeerQueryBytes  int64
 }
 
-// NewAPI returns a usable API.
+// NewAPI returns a usable API, serving the log of each topic.
 func NewAPI(
 	peer ClusterPeer,
+	client clients.Client,
+	logs map[string]Log,
 	replicatedSegments, replicatedBytes metrics.Counter,
+	corruptSegments metrics.Counter,
 	duration metrics.HistogramVec,
 	logger log.Logger,
 ) *API {
+	inventories := make(map[string]*inventory, len(logs))
+	for name, l := range logs {
+		inventories[name] = newInventory(l)
+	}
 	return &API{
 		peer:               peer,
+		client:             client,
+		logs:               logs,
+		inventories:        inventories,
 		replicatedSegments: replicatedSegments,
 		replicatedBytes:    replicatedBytes,
+		corruptSegments:    corruptSegments,
 		duration:           duration,
 		logger:             logger,
+		maxPeerQueryBytes:  defaultMaxPeerQueryBytes,
 	}
 }
 
@@ -74,6 +125,10 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case method == "POST" && path == APIPathReplicate:
 		a.handleReplicate(w, r)
+	case method == "GET" && path == APIPathQuery:
+		a.handleQuery(w, r)
+	case method == "GET" && path == APIPathInventory:
+		a.handleInventory(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -81,15 +136,59 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (a *API) handleReplicate(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	segment, err := a.log.Create()
+
+	// Segments are created with the id given by the consumer, so that the
+	// placement of a segment is known and retries replace the segment instead
+	// of duplicating it.
+	id, err := segmentIDFrom(r.URL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := a.topicLog(r.URL.Query().Get("topic"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	var buf bytes.Buffer
-	n, err := teeRecords(r.Body, segment, &buf)
+	body, err := compression.RequestBody(r)
+	if compression.ErrUnsupportedEncoding(err) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The segment is verified against the checksum of the sender if one was
+	// given, so that it can't be corrupted on its way to the store. The
+	// checksum is of the segment once it's decompressed.
+	if v := r.URL.Query().Get("checksum"); v != "" {
+		sum, err := checksum.Parse(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = checksum.NewReader(body, sum)
+	}
+
+	segment, err := l.Create(id)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n, err := teeRecords(body, segment)
+	if checksum.ErrMismatch(err) {
+		segment.Delete()
+		a.corruptSegments.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if records.ErrInvalidRecord(err) {
+		segment.Delete()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		segment.Delete()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -109,83 +208,249 @@ func (a *API) handleReplicate(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-type interceptingWriter struct {
-	code int
-	http.ResponseWriter
-}
+func (a *API) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var qp QueryParams
+	if err := qp.DecodeFrom(r.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	match, err := qp.matcher()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	codec := records.Negotiate(r.Header.Get("Accept"))
+	l, err := a.topicLog(qp.Topic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-func (iw *interceptingWriter) WriteHeader(code int) {
-	iw.code = code
-	iw.ResponseWriter.WriteHeader(code)
-}
+	if fanout := r.URL.Query().Get("fanout"); fanout != "" {
+		ok, err := strconv.ParseBool(fanout)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "parsing fanout").Error(), http.StatusBadRequest)
+			return
+		}
+		if ok {
+			a.handleFanoutQuery(w, qp, codec)
+			return
+		}
+	}
 
-func teeRecords(src io.Reader, dst ...io.Writer) (n int, err error) {
+	segments, err := l.Segments()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.WriteHeader(http.StatusOK)
+
+	// The status has already been sent, so any errors from here on abort the
+	// response, making sure that a partial result isn't taken as complete.
 	var (
-		w = io.MultiWriter(dst...)
-		s = bufio.NewScanner(src)
+		flusher, _ = w.(http.Flusher)
+		enc        = codec.NewEncoder(w)
 	)
-	s.Split(scanLinesPreserveNewline)
-	for s.Scan() {
-		record := s.Bytes()
-		if len(record) == 0 {
+	for _, info := range segments {
+		if !qp.Overlaps(info) {
 			continue
 		}
 
-		fields := bytes.Fields(record)
-		if len(fields) == 0 {
-			return 0, errInvalidUUID{errors.Errorf("missing uuid")}
+		segment, err := l.Open(info.ID)
+		if ErrNotFound(err) {
+			// The segment was removed during the query.
+			continue
+		} else if err != nil {
+			level.Warn(a.logger).Log("state", "query", "id", info.ID, "err", err)
+			panic(http.ErrAbortHandler)
 		}
 
-		_, err := uuid.ParseBytes(fields[0])
+		_, err = queryRecords(enc, segment, func(record records.Record) bool {
+			return qp.Contains(record, info) && match(record.Payload)
+		}, a.logger)
+		segment.Close()
 		if err != nil {
-			return 0, errInvalidUUID{errors.Errorf("invalid uuid")}
+			if checksum.ErrMismatch(err) {
+				a.corruptSegments.Inc()
+			}
+			level.Warn(a.logger).Log("state", "query", "id", info.ID, "err", err)
+			panic(http.ErrAbortHandler)
 		}
 
-		n0, err := w.Write(record)
-		if err != nil {
-			return 0, err
+		if flusher != nil {
+			flusher.Flush()
 		}
-		n += n0
 	}
-	return n, s.Err()
 }
 
-type invalidUUID interface {
-	InvalidUUID() bool
-}
+// handleFanoutQuery scatters the query to every store in the cluster, as each
+// store only holds a subset of the segments. The results are then merged and
+// de-duplicated, with any peers that failed to answer reported in the header.
+// Peers answer in whichever format the client prefers, before the results are
+// encoded with the codec.
+func (a *API) handleFanoutQuery(w http.ResponseWriter, qp QueryParams, codec records.Codec) {
+	peers, err := a.peer.Current(cluster.PeerTypeStore)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type result struct {
+		peer string
+		data []byte
+		err  error
+	}
+	results := make(chan result, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			data, err := a.queryPeer(peer, qp)
+			results <- result{peer, data, err}
+		}(peer)
+	}
 
-type errInvalidUUID struct {
-	err error
+	var (
+		readers []io.Reader
+		failed  []string
+	)
+	for range peers {
+		res := <-results
+		if res.err != nil {
+			level.Warn(a.logger).Log("state", "query", "peer", res.peer, "err", res.err)
+			failed = append(failed, res.peer)
+			continue
+		}
+		readers = append(readers, bytes.NewReader(res.data))
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		w.Header().Set(httpHeaderFailedPeers, strings.Join(failed, ","))
+	}
+	if len(peers) > 0 && len(failed) == len(peers) {
+		http.Error(w, "No peers answered the query", http.StatusServiceUnavailable)
+		return
+	}
+
+	var merged, buf bytes.Buffer
+	if _, err := records.Merge(&merged, readers...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = queryRecords(codec.NewEncoder(&buf), &merged, func(records.Record) bool {
+		return true
+	}, a.logger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	buf.WriteTo(w)
 }
 
-func (e errInvalidUUID) Error() string {
-	return e.err.Error()
+func (a *API) handleInventory(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("topic")
+	inv, ok := a.inventories[name]
+	if !ok {
+		http.Error(w, errors.Errorf("unknown topic %q", name).Error(), http.StatusNotFound)
+		return
+	}
+
+	entries, err := inv.entries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entries)
 }
 
-func (e errInvalidUUID) InvalidUUID() bool {
-	return true
+// topicLog returns the log holding the segments of the topic.
+func (a *API) topicLog(name string) (Log, error) {
+	l, ok := a.logs[name]
+	if !ok {
+		return nil, errNotFound{errors.Errorf("unknown topic %q", name)}
+	}
+	return l, nil
 }
 
-// ErrInvalidUUID tests to see if the error passed is a not found error or not.
-func ErrInvalidUUID(err error) bool {
+// queryPeer sends the query to a single store, with fan-out disabled. Results
+// that are cut short, or that are larger than the cap, fail the peer.
+func (a *API) queryPeer(peer string, qp QueryParams) ([]byte, error) {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   peer,
+		Path:   fmt.Sprintf("/store%s", APIPathQuery),
+	}
+	qp.EncodeTo(u)
+
+	resp, err := a.client.Get(u.String())
 	if err != nil {
-		if _, ok := err.(invalidUUID); ok {
-			return true
-		}
+		return nil, err
+	}
+	defer resp.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Reader(), a.maxPeerQueryBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > a.maxPeerQueryBytes {
+		return nil, errors.Errorf("result is larger than %d bytes", a.maxPeerQueryBytes)
 	}
-	return false
+	return data, nil
 }
 
-// Like bufio.ScanLines, but retain the \n.
-func scanLinesPreserveNewline(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+// segmentIDFrom reads the segment id from the url, generating a new id if
+// none was given.
+func segmentIDFrom(u *url.URL) (uuid.UUID, error) {
+	id := u.Query().Get("id")
+	if id == "" {
+		return uuid.NewTime()
+	}
+	res, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Empty, errors.Wrapf(err, "parse id %q", id)
 	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		return i + 1, data[0 : i+1], nil
+	return res, nil
+}
+
+type interceptingWriter struct {
+	code int
+	http.ResponseWriter
+}
+
+func (iw *interceptingWriter) WriteHeader(code int) {
+	iw.code = code
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *interceptingWriter) Flush() {
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
-	if atEOF {
-		return len(data), data, nil
+}
+
+// teeRecords validates each record from the reader, before writing them to
+// the writers as they were encoded. It returns the number of bytes written.
+func teeRecords(src io.Reader, dst ...io.Writer) (n int, err error) {
+	var (
+		w   = io.MultiWriter(dst...)
+		dec = records.NewDecoder(src)
+	)
+	for {
+		if _, err := dec.Decode(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		n0, err := w.Write(dec.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		n += n0
 	}
-	return 0, nil, nil
 }
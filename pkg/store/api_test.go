@@ -0,0 +1,692 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	clientsMocks "github.com/SimonRichardson/cluster/pkg/clients/mocks"
+	"github.com/SimonRichardson/cluster/pkg/cluster"
+	clusterMocks "github.com/SimonRichardson/cluster/pkg/cluster/mocks"
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/records"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+func TestAPIFanoutQuery(t *testing.T) {
+	t.Parallel()
+
+	newAPI := func(ctrl *gomock.Controller,
+		peer *clusterMocks.MockPeer,
+		client *clientsMocks.MockClient,
+	) *API {
+		var (
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			corruptSegments    = metricMocks.NewMockCounter(ctrl)
+			duration           = metricMocks.NewMockHistogramVec(ctrl)
+			observer           = metricMocks.NewMockObserver(ctrl)
+		)
+
+		duration.EXPECT().
+			WithLabelValues("GET", APIPathQuery, gomock.Any()).
+			Return(observer).Times(1)
+		observer.EXPECT().
+			Observe(gomock.Any()).Times(1)
+
+		return NewAPI(
+			peer,
+			client,
+			map[string]Log{topic.Default: newVirtualLog()},
+			replicatedSegments, replicatedBytes,
+			corruptSegments,
+			duration,
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer   = clusterMocks.NewMockPeer(ctrl)
+			client = clientsMocks.NewMockClient(ctrl)
+			resp0  = clientsMocks.NewMockResponse(ctrl)
+			resp1  = clientsMocks.NewMockResponse(ctrl)
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return([]string{"a", "b"}, nil)
+
+		client.EXPECT().
+			Get(Host("a")).
+			Return(resp0, nil)
+		resp0.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(bytes.NewReader([]byte("01234567-89ab-cdef-0123-456789abcdef A\n11234567-89ab-cdef-0123-456789abcdef B\n"))))
+		resp0.EXPECT().
+			Close().
+			Return(nil)
+
+		client.EXPECT().
+			Get(Host("b")).
+			Return(resp1, nil)
+		resp1.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(bytes.NewReader([]byte("11234567-89ab-cdef-0123-456789abcdef B\n21234567-89ab-cdef-0123-456789abcdef C\n"))))
+		resp1.EXPECT().
+			Close().
+			Return(nil)
+
+		api := newAPI(ctrl, peer, client)
+
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/query?fanout=true", nil))
+
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "", w.Header().Get(httpHeaderFailedPeers); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+
+		expected := "01234567-89ab-cdef-0123-456789abcdef A\n" +
+			"11234567-89ab-cdef-0123-456789abcdef B\n" +
+			"21234567-89ab-cdef-0123-456789abcdef C\n"
+		if actual := w.Body.String(); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer   = clusterMocks.NewMockPeer(ctrl)
+			client = clientsMocks.NewMockClient(ctrl)
+			resp0  = clientsMocks.NewMockResponse(ctrl)
+			resp1  = clientsMocks.NewMockResponse(ctrl)
+
+			multiline = records.NewRecord(uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"), []byte("A\nA"))
+			buf       bytes.Buffer
+		)
+		if err := records.Binary.NewEncoder(&buf).Encode(multiline); err != nil {
+			t.Fatal(err)
+		}
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return([]string{"a", "b"}, nil)
+
+		client.EXPECT().
+			Get(Host("a")).
+			Return(resp0, nil)
+		resp0.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
+		resp0.EXPECT().
+			Close().
+			Return(nil)
+
+		client.EXPECT().
+			Get(Host("b")).
+			Return(resp1, nil)
+		resp1.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(bytes.NewReader([]byte("11234567-89ab-cdef-0123-456789abcdef B\n"))))
+		resp1.EXPECT().
+			Close().
+			Return(nil)
+
+		api := newAPI(ctrl, peer, client)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/query?fanout=true", nil)
+		r.Header.Set("Accept", records.BinaryContentType)
+		api.ServeHTTP(w, r)
+
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := records.BinaryContentType, w.Header().Get("Content-Type"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+
+		var payloads []string
+		dec := records.Binary.NewDecoder(w.Body)
+		for {
+			record, err := dec.Decode()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			payloads = append(payloads, string(record.Payload))
+		}
+		if expected, actual := "A\nA,B", strings.Join(payloads, ","); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("failed peers", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer   = clusterMocks.NewMockPeer(ctrl)
+			client = clientsMocks.NewMockClient(ctrl)
+			resp   = clientsMocks.NewMockResponse(ctrl)
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return([]string{"a", "b", "c"}, nil)
+
+		client.EXPECT().
+			Get(Host("a")).
+			Return(resp, nil)
+		resp.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(bytes.NewReader([]byte("01234567-89ab-cdef-0123-456789abcdef A\n"))))
+		resp.EXPECT().
+			Close().
+			Return(nil)
+
+		client.EXPECT().
+			Get(Host("b")).
+			Return(nil, errors.New("bad"))
+		client.EXPECT().
+			Get(Host("c")).
+			Return(nil, errors.New("bad"))
+
+		api := newAPI(ctrl, peer, client)
+
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/query?fanout=true", nil))
+
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "b,c", w.Header().Get(httpHeaderFailedPeers); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "01234567-89ab-cdef-0123-456789abcdef A\n", w.Body.String(); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("truncated peers", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer   = clusterMocks.NewMockPeer(ctrl)
+			client = clientsMocks.NewMockClient(ctrl)
+			resp0  = clientsMocks.NewMockResponse(ctrl)
+			resp1  = clientsMocks.NewMockResponse(ctrl)
+			resp2  = clientsMocks.NewMockResponse(ctrl)
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return([]string{"a", "b", "c"}, nil)
+
+		client.EXPECT().
+			Get(Host("a")).
+			Return(resp0, nil)
+		resp0.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(strings.NewReader("01234567-89ab-cdef-0123-456789abcdef A\n")))
+		resp0.EXPECT().
+			Close().
+			Return(nil)
+
+		// The peer aborted its response part way through.
+		client.EXPECT().
+			Get(Host("b")).
+			Return(resp1, nil)
+		resp1.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(io.MultiReader(
+				strings.NewReader("11234567-89ab-cdef-0123-456789abcdef B\n"),
+				errReader{io.ErrUnexpectedEOF},
+			)))
+		resp1.EXPECT().
+			Close().
+			Return(nil)
+
+		// The peer answered with more than the cap.
+		client.EXPECT().
+			Get(Host("c")).
+			Return(resp2, nil)
+		resp2.EXPECT().
+			Reader().
+			Return(ioutil.NopCloser(strings.NewReader(strings.Repeat("21234567-89ab-cdef-0123-456789abcdef C\n", 10))))
+		resp2.EXPECT().
+			Close().
+			Return(nil)
+
+		api := newAPI(ctrl, peer, client)
+		api.maxPeerQueryBytes = 64
+
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/query?fanout=true", nil))
+
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "b,c", w.Header().Get(httpHeaderFailedPeers); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "01234567-89ab-cdef-0123-456789abcdef A\n", w.Body.String(); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("all peers failed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer   = clusterMocks.NewMockPeer(ctrl)
+			client = clientsMocks.NewMockClient(ctrl)
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return([]string{"a"}, nil)
+
+		client.EXPECT().
+			Get(Host("a")).
+			Return(nil, errors.New("bad"))
+
+		api := newAPI(ctrl, peer, client)
+
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/query?fanout=true", nil))
+
+		if expected, actual := http.StatusServiceUnavailable, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "a", w.Header().Get(httpHeaderFailedPeers); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+}
+
+func TestAPIReplicate(t *testing.T) {
+	t.Parallel()
+
+	newAPI := func(ctrl *gomock.Controller, l Log, code int) *API {
+		var (
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			corruptSegments    = metricMocks.NewMockCounter(ctrl)
+			duration           = metricMocks.NewMockHistogramVec(ctrl)
+			observer           = metricMocks.NewMockObserver(ctrl)
+		)
+
+		switch code {
+		case http.StatusOK:
+			replicatedSegments.EXPECT().Inc().AnyTimes()
+			replicatedBytes.EXPECT().Add(gomock.Any()).AnyTimes()
+		case http.StatusBadRequest:
+			corruptSegments.EXPECT().Inc().AnyTimes()
+		}
+		duration.EXPECT().
+			WithLabelValues("POST", APIPathReplicate, fmt.Sprintf("%d", code)).
+			Return(observer).AnyTimes()
+		observer.EXPECT().
+			Observe(gomock.Any()).AnyTimes()
+
+		return NewAPI(
+			clusterMocks.NewMockPeer(ctrl),
+			clientsMocks.NewMockClient(ctrl),
+			map[string]Log{topic.Default: l},
+			replicatedSegments, replicatedBytes,
+			corruptSegments,
+			duration,
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("id", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			l      = newVirtualLog()
+			api    = newAPI(ctrl, l, http.StatusOK)
+			id     = uuid.MustNewTime()
+			record = fmt.Sprintf("%s A\n", uuid.MustNewTime())
+		)
+
+		// Replicating the same segment twice replaces it.
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/replicate?id=%s", id), strings.NewReader(record)))
+
+			if expected, actual := http.StatusOK, w.Code; expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := id.String(), segments[0].ID; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		for _, testcase := range []struct {
+			name  string
+			valid bool
+			code  int
+		}{
+			{"valid", true, http.StatusOK},
+			{"mismatch", false, http.StatusBadRequest},
+		} {
+			t.Run(testcase.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				var (
+					l      = newVirtualLog()
+					api    = newAPI(ctrl, l, testcase.code)
+					record = fmt.Sprintf("%s A\n", uuid.MustNewTime())
+					sum    = checksum.Checksum([]byte(record))
+				)
+				if !testcase.valid {
+					sum++
+				}
+
+				w := httptest.NewRecorder()
+				api.ServeHTTP(w, httptest.NewRequest("POST", "/replicate?checksum="+checksum.Format(sum), strings.NewReader(record)))
+
+				if expected, actual := testcase.code, w.Code; expected != actual {
+					t.Fatalf("expected: %d, actual: %d", expected, actual)
+				}
+
+				segments, err := l.Segments()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected, actual := testcase.valid, len(segments) == 1; expected != actual {
+					t.Errorf("expected: %t, actual: %t", expected, actual)
+				}
+			})
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			l   = newVirtualLog()
+			api = newAPI(ctrl, l, http.StatusBadRequest)
+		)
+
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("POST", "/replicate?id=bad", strings.NewReader("")))
+
+		if expected, actual := http.StatusBadRequest, w.Code; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestAPIQuery(t *testing.T) {
+	t.Parallel()
+
+	t.Run("corrupt segment", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			corruptSegments = metricMocks.NewMockCounter(ctrl)
+			duration        = metricMocks.NewMockHistogramVec(ctrl)
+			observer        = metricMocks.NewMockObserver(ctrl)
+
+			fsys = fs.NewVirtualFilesystem()
+			id   = uuid.MustNewTime()
+		)
+
+		l, err := newRealLog(fsys, "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment, err := l.Create(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fmt.Fprintf(segment, "%s A\n", id); err != nil {
+			t.Fatal(err)
+		}
+		if err := segment.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Overwrite the flushed segment, without updating the sidecar.
+		f, err := fsys.Create(l.(*realLog).filename(id.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fmt.Fprintf(f, "%s B\n", id); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		corruptSegments.EXPECT().Inc().Times(1)
+		duration.EXPECT().
+			WithLabelValues(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(observer).AnyTimes()
+		observer.EXPECT().
+			Observe(gomock.Any()).AnyTimes()
+
+		api := NewAPI(
+			clusterMocks.NewMockPeer(ctrl),
+			clientsMocks.NewMockClient(ctrl),
+			map[string]Log{topic.Default: l},
+			metricMocks.NewMockCounter(ctrl), metricMocks.NewMockCounter(ctrl),
+			corruptSegments,
+			duration,
+			log.NewNopLogger(),
+		)
+
+		// The status has already been sent, so the response is aborted
+		// rather than ending as if it were complete.
+		defer func() {
+			if expected, actual := http.ErrAbortHandler, recover(); expected != actual {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		}()
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/query", nil))
+	})
+
+	t.Run("binary payloads queried as text", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+
+			l   = newVirtualLog()
+			ids = []uuid.UUID{uuid.MustNewTime(), uuid.MustNewTime()}
+		)
+
+		segment, err := l.Create(ids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := records.Binary.NewEncoder(segment)
+		for _, record := range []records.Record{
+			{ID: ids[0], Payload: []byte("A\nB")},
+			{ID: ids[1], Payload: []byte("C")},
+		} {
+			if err := enc.Encode(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := segment.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		duration.EXPECT().
+			WithLabelValues(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(observer).AnyTimes()
+		observer.EXPECT().
+			Observe(gomock.Any()).AnyTimes()
+
+		api := NewAPI(
+			clusterMocks.NewMockPeer(ctrl),
+			clientsMocks.NewMockClient(ctrl),
+			map[string]Log{topic.Default: l},
+			metricMocks.NewMockCounter(ctrl), metricMocks.NewMockCounter(ctrl),
+			metricMocks.NewMockCounter(ctrl),
+			duration,
+			log.NewNopLogger(),
+		)
+
+		// Payloads holding newlines can't be encoded as text, so they're
+		// skipped rather than failing the query.
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/query", nil))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := fmt.Sprintf("%s C\n", ids[1]), w.Body.String(); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+}
+
+func TestAPITopics(t *testing.T) {
+	t.Parallel()
+
+	newAPI := func(ctrl *gomock.Controller, logs map[string]Log) *API {
+		var (
+			replicatedSegments = metricMocks.NewMockCounter(ctrl)
+			replicatedBytes    = metricMocks.NewMockCounter(ctrl)
+			duration           = metricMocks.NewMockHistogramVec(ctrl)
+			observer           = metricMocks.NewMockObserver(ctrl)
+		)
+
+		replicatedSegments.EXPECT().Inc().AnyTimes()
+		replicatedBytes.EXPECT().Add(gomock.Any()).AnyTimes()
+		duration.EXPECT().
+			WithLabelValues(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(observer).AnyTimes()
+		observer.EXPECT().
+			Observe(gomock.Any()).AnyTimes()
+
+		return NewAPI(
+			clusterMocks.NewMockPeer(ctrl),
+			clientsMocks.NewMockClient(ctrl),
+			logs,
+			replicatedSegments, replicatedBytes,
+			metricMocks.NewMockCounter(ctrl),
+			duration,
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("replicate then query", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			logs   = map[string]Log{topic.Default: newVirtualLog(), "audit": newVirtualLog()}
+			api    = newAPI(ctrl, logs)
+			record = fmt.Sprintf("%s A\n", uuid.MustNewTime())
+		)
+
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("POST", "/replicate?topic=audit", strings.NewReader(record)))
+		if expected, actual := http.StatusOK, w.Code; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		for name, expected := range map[string]string{topic.Default: "", "audit": record} {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", "/query?topic="+name, nil))
+			if actual := w.Body.String(); expected != actual {
+				t.Errorf("%q: expected: %q, actual: %q", name, expected, actual)
+			}
+		}
+	})
+
+	t.Run("unknown topic", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		api := newAPI(ctrl, map[string]Log{topic.Default: newVirtualLog()})
+		for _, r := range []*http.Request{
+			httptest.NewRequest("POST", "/replicate?topic=audit", strings.NewReader("")),
+			httptest.NewRequest("GET", "/query?topic=audit", nil),
+			httptest.NewRequest("GET", "/inventory?topic=audit", nil),
+		} {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if expected, actual := http.StatusNotFound, w.Code; expected != actual {
+				t.Errorf("%s: expected: %d, actual: %d", r.URL.Path, expected, actual)
+			}
+		}
+	})
+}
+
+type hostMatcher struct {
+	host string
+}
+
+func (m hostMatcher) Matches(x interface{}) bool {
+	if p, ok := x.(string); ok {
+		u, err := url.Parse(p)
+		if err != nil {
+			return false
+		}
+		// Fan-out must be disabled downstream, otherwise the query would
+		// recurse.
+		return u.Host == m.host &&
+			u.Path == fmt.Sprintf("/store%s", APIPathQuery) &&
+			u.Query().Get("fanout") == ""
+	}
+	return false
+}
+
+func (m hostMatcher) String() string {
+	return fmt.Sprintf("%s is host", m.host)
+}
+
+func Host(h string) gomock.Matcher { return hostMatcher{h} }
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/SimonRichardson/cluster/pkg/records"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// Compactor merges adjacent small segments of the log into larger segments,
+// removing duplicate records and keeping the records ordered by id.
+type Compactor struct {
+	log            Log
+	targetSize     int64
+	concurrency    int
+	interval       time.Duration
+	stop           chan chan struct{}
+	compactions    metrics.Counter
+	reclaimedBytes metrics.Counter
+	logger         log.Logger
+}
+
+// NewCompactor creates a Compactor for the log. Segments are merged until
+// they reach the targetSize, as they're held on disk, with at most concurrency
+// compactions happening at the same time.
+func NewCompactor(
+	log Log,
+	targetSize int64,
+	concurrency int,
+	interval time.Duration,
+	compactions, reclaimedBytes metrics.Counter,
+	logger log.Logger,
+) *Compactor {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Compactor{
+		log:            log,
+		targetSize:     targetSize,
+		concurrency:    concurrency,
+		interval:       interval,
+		stop:           make(chan chan struct{}),
+		compactions:    compactions,
+		reclaimedBytes: reclaimedBytes,
+		logger:         logger,
+	}
+}
+
+// Run compacts the log every interval. Run returns when Stop is invoked.
+func (c *Compactor) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.compact(); err != nil {
+				level.Warn(c.logger).Log("state", "compact", "err", err)
+			}
+
+		case q := <-c.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the compactor, waiting for any compactions to finish.
+func (c *Compactor) Stop() {
+	q := make(chan struct{})
+	c.stop <- q
+	<-q
+}
+
+// compact merges every group of adjacent small segments, returning the first
+// error encountered.
+func (c *Compactor) compact() error {
+	segments, err := c.log.Segments()
+	if err != nil {
+		return errors.Wrap(err, "segments")
+	}
+
+	var (
+		wg        sync.WaitGroup
+		once      sync.Once
+		res       error
+		semaphore = make(chan struct{}, c.concurrency)
+	)
+	for _, group := range c.groups(segments) {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(group []SegmentInfo) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if err := c.compactGroup(group); err != nil {
+				once.Do(func() { res = err })
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	return res
+}
+
+// groups returns adjacent segments that are smaller than the target size,
+// grouped so that each group is at most the target size. Sizes are those of
+// the segments as they're held on disk, which is also the basis the merged
+// segment is held on, compressed or not. Groups of a single segment are
+// dropped, as there's nothing to merge.
+func (c *Compactor) groups(segments []SegmentInfo) [][]SegmentInfo {
+	var (
+		res   [][]SegmentInfo
+		group []SegmentInfo
+		size  int64
+	)
+	flush := func() {
+		if len(group) > 1 {
+			res = append(res, group)
+		}
+		group, size = nil, 0
+	}
+	for _, segment := range segments {
+		if segment.Size >= c.targetSize {
+			flush()
+			continue
+		}
+		if size+segment.Size > c.targetSize {
+			flush()
+		}
+		group = append(group, segment)
+		size += segment.Size
+	}
+	flush()
+	return res
+}
+
+// compactGroup merges the group of segments into the last segment of the
+// group, before replacing the rest of the original segments with tombstones.
+func (c *Compactor) compactGroup(group []SegmentInfo) error {
+	var (
+		readers []io.Reader
+		size    int64
+	)
+	for _, info := range group {
+		segment, err := c.log.Open(info.ID)
+		if err != nil {
+			return errors.Wrapf(err, "open %s", info.ID)
+		}
+		defer segment.Close()
+
+		readers = append(readers, segment)
+		size += info.Size
+	}
+
+	// The merged segment replaces the last segment of the group, keeping its
+	// id, so that peers holding the same segments still recognise it when
+	// comparing inventories. Taking the newest id means the merged segment
+	// isn't aged before the newest records merged into it.
+	last := group[len(group)-1]
+	id, err := uuid.Parse(last.ID)
+	if err != nil {
+		return errors.Wrapf(err, "parse %s", last.ID)
+	}
+	segment, err := c.log.Create(id)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	n, err := records.Merge(segment, readers...)
+	if err != nil {
+		segment.Delete()
+		return errors.Wrap(err, "merge")
+	}
+	if err := segment.Close(); err != nil {
+		return errors.Wrap(err, "close")
+	}
+
+	for _, info := range group[:len(group)-1] {
+		if err := c.log.Tombstone(info.ID); err != nil && !ErrNotFound(err) {
+			return errors.Wrapf(err, "tombstone %s", info.ID)
+		}
+	}
+
+	// The bytes reclaimed are counted against the merged segment as it's held
+	// on disk, same as the segments merged into it, as the bytes merged are
+	// those of the uncompressed records.
+	merged, err := c.size(id.String())
+	if err != nil {
+		return errors.Wrap(err, "size")
+	}
+	var reclaimed int64
+	if size > merged {
+		reclaimed = size - merged
+	}
+
+	c.compactions.Inc()
+	c.reclaimedBytes.Add(float64(reclaimed))
+
+	level.Debug(c.logger).Log("state", "compact", "segments", len(group), "bytes", n, "reclaimed", reclaimed)
+	return nil
+}
+
+// size returns the size of the flushed segment as it's held on disk.
+func (c *Compactor) size(id string) (int64, error) {
+	segment, err := c.log.Open(id)
+	if err != nil {
+		return 0, err
+	}
+	defer segment.Close()
+
+	return segment.Size(), nil
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+)
+
+func TestCompactorGroups(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name     string
+		sizes    []int64
+		expected [][]int64
+	}{
+		{"empty", nil, nil},
+		{"single", []int64{1}, nil},
+		{"adjacent", []int64{1, 2, 3}, [][]int64{{1, 2, 3}}},
+		{"target size", []int64{5, 5, 5, 5, 5}, [][]int64{{5, 5}, {5, 5}}},
+		{"large segment breaks adjacency", []int64{1, 10, 2, 3}, [][]int64{{2, 3}}},
+		{"only large segments", []int64{10, 20, 30}, nil},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			c := NewCompactor(nil, 10, 1, 0, nil, nil, log.NewNopLogger())
+
+			var segments []SegmentInfo
+			for i, size := range testcase.sizes {
+				segments = append(segments, SegmentInfo{
+					ID:   fmt.Sprintf("%d", i),
+					Size: size,
+				})
+			}
+
+			var actual [][]int64
+			for _, group := range c.groups(segments) {
+				var sizes []int64
+				for _, segment := range group {
+					sizes = append(sizes, segment.Size)
+				}
+				actual = append(actual, sizes)
+			}
+
+			if expected := testcase.expected; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestCompactorCompact(t *testing.T) {
+	t.Parallel()
+
+	write := func(t *testing.T, l Log, records ...string) {
+		segment, err := l.Create(uuid.MustNewTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range records {
+			if _, err := segment.Write([]byte(record)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := segment.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("compact", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			compactions    = metricMocks.NewMockCounter(ctrl)
+			reclaimedBytes = metricMocks.NewMockCounter(ctrl)
+
+			l   = newVirtualLog()
+			ids = []uuid.UUID{uuid.MustNewTime(), uuid.MustNewTime(), uuid.MustNewTime()}
+			a   = fmt.Sprintf("%s A\n", ids[0])
+			b   = fmt.Sprintf("%s B\n", ids[1])
+			c   = fmt.Sprintf("%s C\n", ids[2])
+		)
+
+		write(t, l, c, a)
+		write(t, l, b, a)
+		write(t, l, c)
+
+		before, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compactions.EXPECT().Inc().Times(1)
+		reclaimedBytes.EXPECT().Add(float64(len(a) + len(c))).Times(1)
+
+		compactor := NewCompactor(l, 1024, 2, 0, compactions, reclaimedBytes, log.NewNopLogger())
+		if err := compactor.compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := before[2].ID, segments[0].ID; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		segment, err := l.Open(segments[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer segment.Close()
+
+		b0, err := ioutil.ReadAll(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := a+b+c, string(b0); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+
+		// The segments merged away are left as tombstones, so that peers
+		// don't copy them back.
+		tombstones, err := l.Tombstones()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 2, len(tombstones); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for i, tombstone := range tombstones {
+			if expected, actual := before[i].ID, tombstone.ID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			compactions    = metricMocks.NewMockCounter(ctrl)
+			reclaimedBytes = metricMocks.NewMockCounter(ctrl)
+
+			reclaimed float64
+		)
+
+		l, err := newRealLog(fs.NewVirtualFilesystem(), "/root", compression.Gzip, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []string
+		for i := 0; i < 32; i++ {
+			records = append(records, fmt.Sprintf("%s %s\n", uuid.MustNewTime(), strings.Repeat("A", 32)))
+		}
+		for i := 0; i < 3; i++ {
+			write(t, l, records...)
+		}
+
+		before, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var size int64
+		for _, segment := range before {
+			size += segment.Size
+		}
+
+		compactions.EXPECT().Inc().Times(1)
+		reclaimedBytes.EXPECT().Add(gomock.Any()).Do(func(v float64) { reclaimed = v }).Times(1)
+
+		compactor := NewCompactor(l, 1024*1024, 1, 0, compactions, reclaimedBytes, log.NewNopLogger())
+		if err := compactor.compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Bytes reclaimed are counted as the segments are held on disk,
+		// rather than against the uncompressed records merged.
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := float64(size-segments[0].Size), reclaimed; expected != actual {
+			t.Errorf("expected: %f, actual: %f", expected, actual)
+		}
+	})
+
+	t.Run("nothing to compact", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			compactions    = metricMocks.NewMockCounter(ctrl)
+			reclaimedBytes = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+
+		write(t, l, fmt.Sprintf("%s A\n", uuid.MustNewTime()))
+
+		compactor := NewCompactor(l, 1024, 1, 0, compactions, reclaimedBytes, log.NewNopLogger())
+		if err := compactor.compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/pkg/errors"
+)
+
+// Inventory describes a flushed segment held by a store, so that stores can
+// compare what they hold with each other. Tombstones describe segments that
+// were merged into another segment by compaction, so they hold no size or
+// checksum of their own.
+type Inventory struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	Checksum  uint32 `json:"checksum"`
+	Tombstone bool   `json:"tombstone,omitempty"`
+}
+
+// inventory lists the flushed segments of a log along with their checksums.
+// Checksumming a segment means reading all of it, so checksums are cached for
+// as long as the segment keeps the same size and modification time.
+type inventory struct {
+	mutex sync.Mutex
+	log   Log
+	cache map[string]cachedChecksum
+}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sum     uint32
+}
+
+func newInventory(log Log) *inventory {
+	return &inventory{
+		log:   log,
+		cache: map[string]cachedChecksum{},
+	}
+}
+
+// entries returns the inventory of every flushed segment in the log, ordered
+// from the oldest to the newest, followed by the tombstones of the log.
+func (i *inventory) entries() ([]Inventory, error) {
+	segments, err := i.log.Segments()
+	if err != nil {
+		return nil, errors.Wrap(err, "segments")
+	}
+	tombstones, err := i.log.Tombstones()
+	if err != nil {
+		return nil, errors.Wrap(err, "tombstones")
+	}
+
+	var (
+		res  = make([]Inventory, 0, len(segments))
+		seen = make(map[string]struct{}, len(segments))
+	)
+	for _, info := range segments {
+		sum, err := i.checksum(info)
+		if ErrNotFound(err) {
+			// Removed since listing, for example by compaction.
+			continue
+		} else if checksum.ErrMismatch(err) {
+			// Corrupt segments are left out, so that they're seen as missing
+			// and repaired from the copy of another store.
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "checksum %s", info.ID)
+		}
+
+		res = append(res, Inventory{
+			ID:       info.ID,
+			Size:     info.Size,
+			Checksum: sum,
+		})
+		seen[info.ID] = struct{}{}
+	}
+	for _, info := range tombstones {
+		if _, ok := seen[info.ID]; ok {
+			continue
+		}
+		res = append(res, Inventory{
+			ID:        info.ID,
+			Tombstone: true,
+		})
+	}
+
+	// Forget about the segments that are no longer in the log.
+	i.mutex.Lock()
+	for id := range i.cache {
+		if _, ok := seen[id]; !ok {
+			delete(i.cache, id)
+		}
+	}
+	i.mutex.Unlock()
+
+	return res, nil
+}
+
+func (i *inventory) checksum(info SegmentInfo) (uint32, error) {
+	i.mutex.Lock()
+	cached, ok := i.cache[info.ID]
+	i.mutex.Unlock()
+
+	if ok && cached.size == info.Size && cached.modTime.Equal(info.ModTime) {
+		return cached.sum, nil
+	}
+
+	segment, err := i.log.Open(info.ID)
+	if err != nil {
+		return 0, err
+	}
+	defer segment.Close()
+
+	h := checksum.New()
+	if _, err := io.Copy(h, segment); err != nil {
+		return 0, err
+	}
+	sum := h.Sum32()
+
+	i.mutex.Lock()
+	i.cache[info.ID] = cachedChecksum{
+		size:    info.Size,
+		modTime: info.ModTime,
+		sum:     sum,
+	}
+	i.mutex.Unlock()
+
+	return sum, nil
+}
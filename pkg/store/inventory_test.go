@@ -0,0 +1,119 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestInventory(t *testing.T) {
+	t.Parallel()
+
+	create := func(t *testing.T, l Log, id uuid.UUID, data string) {
+		segment, err := l.Create(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := segment.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := segment.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		var (
+			l  = newVirtualLog()
+			id = uuid.MustNewTime()
+		)
+		create(t, l, id, "aaaa")
+
+		entries, err := newInventory(l).entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		expected := Inventory{
+			ID:       id.String(),
+			Size:     4,
+			Checksum: checksum.Checksum([]byte("aaaa")),
+		}
+		if actual := entries[0]; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("replaced segment", func(t *testing.T) {
+		var (
+			l   = newVirtualLog()
+			inv = newInventory(l)
+			id  = uuid.MustNewTime()
+		)
+		create(t, l, id, "aaaa")
+		if _, err := inv.entries(); err != nil {
+			t.Fatal(err)
+		}
+
+		create(t, l, id, "bbbbbb")
+		entries, err := inv.entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := checksum.Checksum([]byte("bbbbbb")), entries[0].Checksum; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("tombstone", func(t *testing.T) {
+		var (
+			l  = newVirtualLog()
+			id = uuid.MustNewTime()
+		)
+		create(t, l, id, "aaaa")
+		if err := l.Tombstone(id.String()); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := newInventory(l).entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := (Inventory{ID: id.String(), Tombstone: true}), entries[0]; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("deleted segment", func(t *testing.T) {
+		var (
+			l   = newVirtualLog()
+			inv = newInventory(l)
+			id  = uuid.MustNewTime()
+		)
+		create(t, l, id, "aaaa")
+		if _, err := inv.entries(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Delete(id.String()); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := inv.entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(entries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(inv.cache); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
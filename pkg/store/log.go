@@ -0,0 +1,204 @@
+package store
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Log is an abstraction for segments on a store node.
+type Log interface {
+
+	// Create returns a new segment for the id that can be written to. Creating
+	// a segment with the id of an existing segment replaces it once flushed.
+	Create(id uuid.UUID) (WriteSegment, error)
+
+	// Segments returns information about all the flushed segments, ordered from
+	// the oldest to the newest by when they were created.
+	Segments() ([]SegmentInfo, error)
+
+	// Open returns the flushed segment for the id, which can then be read from.
+	Open(id string) (ReadSegment, error)
+
+	// Delete removes the flushed segment, or the tombstone, for the id.
+	Delete(id string) error
+
+	// Tombstone removes the flushed segment for the id, as it was merged into
+	// another segment, leaving a tombstone in its place. Peers see tombstones
+	// as holding the records of the segment, so that it's not copied back.
+	Tombstone(id string) error
+
+	// Tombstones returns information about all the tombstones, ordered from
+	// the oldest to the newest by when their segments were created.
+	Tombstones() ([]SegmentInfo, error)
+
+	// Close the log.
+	Close() error
+}
+
+// WriteSegment is a segment that can be written to. It may be optionally synced
+// for persistence manually. When writing is complete, it may be closed and
+// flushed.
+type WriteSegment interface {
+	io.Writer
+
+	// Sync the data for persistence or fails with an error
+	Sync() error
+
+	// Close the writer, flushing the segment or fails with an error
+	Close() error
+
+	// Delete the written segment or fails with an error
+	Delete() error
+
+	// Size gets the size of the written segment.
+	Size() int64
+}
+
+// ReadSegment is a flushed segment that can be read from.
+type ReadSegment interface {
+	io.Reader
+	io.Closer
+
+	// ID returns the id of the segment
+	ID() string
+
+	// Size gets the size of the read segment.
+	Size() int64
+}
+
+// SegmentInfo describes a flushed segment with in the log.
+type SegmentInfo struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+// Created returns when the segment was first stored. Segment ids are time
+// ordered, so unlike the modification time, it's kept when the segment is
+// rewritten by compaction, which merges into the id of the newest segment.
+// Segments without a time ordered id fall back to their modification time.
+func (s SegmentInfo) Created() time.Time {
+	if u, err := uuid.Parse(s.ID); err == nil {
+		if t, ok := u.Time(); ok {
+			return t
+		}
+	}
+	return s.ModTime
+}
+
+type notFound interface {
+	NotFound() bool
+}
+
+type errNotFound struct {
+	err error
+}
+
+func (e errNotFound) Error() string {
+	return e.err.Error()
+}
+
+func (e errNotFound) NotFound() bool {
+	return true
+}
+
+// ErrNotFound tests to see if the error passed is a not found error or not.
+func ErrNotFound(err error) bool {
+	if err != nil {
+		if _, ok := err.(notFound); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Config encapsulates the requirements for generating a Log
+type Config struct {
+	name        string
+	filesystem  fs.Filesystem
+	root        string
+	compression compression.Encoding
+	ratio       prometheus.Observer
+}
+
+// Option defines a option for generating a log Config
+type Option func(*Config) error
+
+// Build ingests configuration options to then yield a Config and return an
+// error if it fails during setup.
+func Build(opts ...Option) (*Config, error) {
+	var config Config
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// With adds a type of log to use for the configuration.
+func With(name string) Option {
+	return func(config *Config) error {
+		config.name = name
+		return nil
+	}
+}
+
+// WithFilesystem adds a filesystem to the configuration, which is used by the
+// real log to persist segments.
+func WithFilesystem(filesystem fs.Filesystem) Option {
+	return func(config *Config) error {
+		config.filesystem = filesystem
+		return nil
+	}
+}
+
+// WithRoot adds a root path to the configuration, where all the segments for
+// the real log are located.
+func WithRoot(root string) Option {
+	return func(config *Config) error {
+		config.root = root
+		return nil
+	}
+}
+
+// WithCompression adds the encoding used by the real log to compress the
+// segments it persists at rest, observing the compression ratio of each
+// segment. Segments are read back regardless of how they were compressed.
+func WithCompression(encoding compression.Encoding, ratio prometheus.Observer) Option {
+	return func(config *Config) error {
+		config.compression = encoding
+		config.ratio = ratio
+		return nil
+	}
+}
+
+// New creates a log from a configuration or returns error if on failure.
+func New(config *Config) (l Log, err error) {
+	switch strings.ToLower(config.name) {
+	case "real":
+		if config.filesystem == nil {
+			return nil, errors.New("missing filesystem")
+		}
+		encoding, ratio := config.compression, config.ratio
+		if encoding == nil || encoding == compression.Identity {
+			encoding, ratio = compression.Identity, nil
+		}
+		l, err = newRealLog(config.filesystem, config.root, encoding, ratio)
+	case "virtual":
+		l = newVirtualLog()
+	case "nop":
+		l = newNopLog()
+	default:
+		err = errors.Errorf("unexpected log type %q", config.name)
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+)
+
+func TestBuildingLog(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(name, root string) bool {
+			config, err := Build(
+				With(name),
+				WithRoot(root),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected, actual := name, config.name; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := root, config.root; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+
+			return true
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		_, err := Build(
+			func(config *Config) error {
+				return errors.Errorf("bad")
+			},
+		)
+
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"real", []Option{With("real"), WithFilesystem(fs.NewVirtualFilesystem()), WithRoot("/root")}, true},
+		{"real without filesystem", []Option{With("real")}, false},
+		{"virtual", []Option{With("virtual")}, true},
+		{"nop", []Option{With("nop")}, true},
+		{"invalid", []Option{With("invalid")}, false},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			config, err := Build(testcase.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = New(config)
+			if expected, actual := testcase.valid, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t, err: %v", expected, actual, err)
+			}
+		})
+	}
+}
+
+func testLogCreate(newLog func() Log, t *testing.T) {
+	fn := func(b []byte) bool {
+		if len(b) == 0 {
+			return true
+		}
+
+		l := newLog()
+		w, err := l.Create(uuid.MustNewTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := int64(len(b)), w.Size(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		r, err := l.Open(segments[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		res, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return segments[0].ID == r.ID() && bytes.Equal(b, res)
+	}
+
+	if err := quick.Check(fn, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func testLogCreateDelete(l Log, t *testing.T) {
+	w, err := l.Create(uuid.MustNewTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := 0, len(segments); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+}
+
+func testLogDelete(l Log, t *testing.T) {
+	w, err := l.Create(uuid.MustNewTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := l.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := 1, len(segments); expected != actual {
+		t.Fatalf("expected: %d, actual: %d", expected, actual)
+	}
+
+	id := segments[0].ID
+	if err := l.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open(id); !ErrNotFound(err) {
+		t.Errorf("expected: not found error, actual: %v", err)
+	}
+	if err := l.Delete(id); !ErrNotFound(err) {
+		t.Errorf("expected: not found error, actual: %v", err)
+	}
+}
+
+func testLogTombstone(l Log, t *testing.T) {
+	id := uuid.MustNewTime()
+	write := func() {
+		w, err := l.Create(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tombstones := func() []string {
+		infos, err := l.Tombstones()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+		}
+		return ids
+	}
+
+	write()
+	if err := l.Tombstone(id.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Open(id.String()); !ErrNotFound(err) {
+		t.Errorf("expected: not found error, actual: %v", err)
+	}
+	if expected, actual := []string{id.String()}, tombstones(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+
+	// Flushing the segment again replaces the tombstone.
+	write()
+	if expected, actual := 0, len(tombstones()); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+
+	if err := l.Tombstone(id.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete(id.String()); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := 0, len(tombstones()); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+	if err := l.Tombstone(id.String()); !ErrNotFound(err) {
+		t.Errorf("expected: not found error, actual: %v", err)
+	}
+}
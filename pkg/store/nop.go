@@ -0,0 +1,31 @@
+package store
+
+import (
+	"io"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+type nopLog struct{}
+
+func newNopLog() Log {
+	return nopLog{}
+}
+
+func (l nopLog) Create(id uuid.UUID) (WriteSegment, error) { return nopSegment{}, nil }
+func (l nopLog) Segments() ([]SegmentInfo, error)          { return nil, nil }
+func (l nopLog) Open(id string) (ReadSegment, error)       { return nopSegment{}, nil }
+func (l nopLog) Delete(id string) error                    { return nil }
+func (l nopLog) Tombstone(id string) error                 { return nil }
+func (l nopLog) Tombstones() ([]SegmentInfo, error)        { return nil, nil }
+func (l nopLog) Close() error                              { return nil }
+
+type nopSegment struct{}
+
+func (v nopSegment) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (v nopSegment) Write(b []byte) (int, error) { return 0, nil }
+func (v nopSegment) Sync() error                 { return nil }
+func (v nopSegment) Close() error                { return nil }
+func (v nopSegment) Delete() error               { return nil }
+func (v nopSegment) ID() string                  { return "" }
+func (v nopSegment) Size() int64                 { return 0 }
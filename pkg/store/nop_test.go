@@ -0,0 +1,73 @@
+package store
+
+import (
+	"io/ioutil"
+	"testing"
+	"testing/quick"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestNopLog(t *testing.T) {
+	t.Parallel()
+
+	t.Run("create", func(t *testing.T) {
+		fn := func(b []byte) bool {
+			l := newNopLog()
+			w, err := l.Create(uuid.MustNewTime())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := w.Write(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return n == 0 && w.Close() == nil
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("segments", func(t *testing.T) {
+		segments, err := newNopLog().Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(segments); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		fn := func(id string) bool {
+			r, err := newNopLog().Open(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(b) == 0
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		fn := func(id string) bool {
+			return newNopLog().Delete(id) == nil
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
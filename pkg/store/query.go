@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/records"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// QueryParams defines all the dimensions of a query to the store.
+type QueryParams struct {
+	Topic string
+	From  time.Time
+	To    time.Time
+	Q     string
+	Regex bool
+}
+
+// DecodeFrom populates a QueryParams from a URL. Times are expected to be in
+// RFC3339 format, a missing from queries from the beginning of time and a
+// missing to queries up until now. A missing topic queries the default topic.
+func (qp *QueryParams) DecodeFrom(u *url.URL) error {
+	var (
+		values = u.Query()
+		err    error
+	)
+
+	qp.Topic = values.Get("topic")
+
+	qp.From, qp.To = time.Time{}, time.Now()
+	if from := values.Get("from"); from != "" {
+		if qp.From, err = time.Parse(time.RFC3339Nano, from); err != nil {
+			return errors.Wrap(err, "parsing from")
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if qp.To, err = time.Parse(time.RFC3339Nano, to); err != nil {
+			return errors.Wrap(err, "parsing to")
+		}
+	}
+	if qp.To.Before(qp.From) {
+		return errors.New("to is before from")
+	}
+
+	qp.Q = values.Get("q")
+
+	qp.Regex = false
+	if regex := values.Get("regex"); regex != "" {
+		if qp.Regex, err = strconv.ParseBool(regex); err != nil {
+			return errors.Wrap(err, "parsing regex")
+		}
+	}
+	return nil
+}
+
+// EncodeTo encodes the QueryParams into the URL query.
+func (qp QueryParams) EncodeTo(u *url.URL) {
+	values := u.Query()
+	if qp.Topic != topic.Default {
+		values.Set("topic", qp.Topic)
+	}
+	values.Set("from", qp.From.Format(time.RFC3339Nano))
+	values.Set("to", qp.To.Format(time.RFC3339Nano))
+	values.Set("q", qp.Q)
+	values.Set("regex", strconv.FormatBool(qp.Regex))
+	u.RawQuery = values.Encode()
+}
+
+// Overlaps checks to see if the segment could hold records with in the time
+// range of the query. Records are always created before they're stored, so any
+// segment stored before the start of the range can be skipped.
+func (qp QueryParams) Overlaps(info SegmentInfo) bool {
+	return !info.ModTime.Before(qp.From)
+}
+
+// Contains checks to see if the record is with in the time range of the query.
+// Records are ranged by their timestamp, otherwise it falls back to when the
+// segment holding the record was stored.
+func (qp QueryParams) Contains(record records.Record, info SegmentInfo) bool {
+	t := record.Timestamp
+	if t.IsZero() {
+		t = info.ModTime
+	}
+	return !t.Before(qp.From) && !t.After(qp.To)
+}
+
+// matcher returns a function for matching record payloads against the query.
+func (qp QueryParams) matcher() (func([]byte) bool, error) {
+	if qp.Q == "" {
+		return func([]byte) bool { return true }, nil
+	}
+	if qp.Regex {
+		re, err := regexp.Compile(qp.Q)
+		if err != nil {
+			return nil, errors.Wrap(err, "compiling regex")
+		}
+		return re.Match, nil
+	}
+	q := []byte(qp.Q)
+	return func(b []byte) bool { return bytes.Contains(b, q) }, nil
+}
+
+// queryRecords encodes every record from the reader, where the record matches,
+// with the encoder. Records the encoder can't encode, such as binary payloads
+// holding newlines encoded as text, are skipped with a warning rather than
+// failing the query. It returns the number of records written.
+func queryRecords(enc records.Encoder, src io.Reader, match func(records.Record) bool, logger log.Logger) (n int, err error) {
+	dec := records.NewDecoder(src)
+	for {
+		record, err := dec.Decode()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if !match(record) {
+			continue
+		}
+		if err := enc.Encode(record); records.ErrInvalidRecord(err) {
+			level.Warn(logger).Log("state", "query", "id", record.ID, "err", err)
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/records"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+)
+
+func TestQueryParams(t *testing.T) {
+	t.Parallel()
+
+	t.Run("decode", func(t *testing.T) {
+		u, err := url.Parse("/query?from=2018-01-01T00:00:00Z&to=2018-01-02T00:00:00Z&q=abc&regex=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var qp QueryParams
+		if err := qp.DecodeFrom(u); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), qp.From; !expected.Equal(actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC), qp.To; !expected.Equal(actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := "abc", qp.Q; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := true, qp.Regex; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("decode defaults", func(t *testing.T) {
+		var qp QueryParams
+		if err := qp.DecodeFrom(&url.URL{Path: "/query"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := true, qp.From.IsZero(); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := false, qp.To.IsZero(); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := false, qp.Regex; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("decode invalid", func(t *testing.T) {
+		for _, query := range []string{
+			"from=bad",
+			"to=bad",
+			"regex=bad",
+			"from=2018-01-02T00:00:00Z&to=2018-01-01T00:00:00Z",
+		} {
+			var qp QueryParams
+			err := qp.DecodeFrom(&url.URL{Path: "/query", RawQuery: query})
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t, query: %s", expected, actual, query)
+			}
+		}
+	})
+
+	t.Run("encode then decode", func(t *testing.T) {
+		qp := QueryParams{
+			Topic: "audit",
+			From:  time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			To:    time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC),
+			Q:     "a b&c",
+			Regex: true,
+		}
+
+		u := &url.URL{Path: "/query"}
+		qp.EncodeTo(u)
+
+		var res QueryParams
+		if err := res.DecodeFrom(u); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := qp, res; expected.Topic != actual.Topic ||
+			!expected.From.Equal(actual.From) ||
+			!expected.To.Equal(actual.To) ||
+			expected.Q != actual.Q ||
+			expected.Regex != actual.Regex {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("overlaps", func(t *testing.T) {
+		var (
+			from = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+			qp   = QueryParams{From: from, To: from.Add(time.Hour)}
+		)
+
+		for _, testcase := range []struct {
+			modTime  time.Time
+			expected bool
+		}{
+			{from.Add(-time.Second), false},
+			{from, true},
+			{from.Add(time.Minute), true},
+			{from.Add(2 * time.Hour), true},
+		} {
+			if expected, actual := testcase.expected, qp.Overlaps(SegmentInfo{ModTime: testcase.modTime}); expected != actual {
+				t.Errorf("expected: %t, actual: %t, time: %v", expected, actual, testcase.modTime)
+			}
+		}
+	})
+
+	t.Run("contains", func(t *testing.T) {
+		var (
+			from = time.Now().Add(-time.Hour)
+			to   = time.Now().Add(time.Hour)
+			qp   = QueryParams{From: from, To: to}
+		)
+
+		for _, testcase := range []struct {
+			name     string
+			id       uuid.UUID
+			modTime  time.Time
+			expected bool
+		}{
+			{"time id", uuid.MustNewTime(), from.Add(-time.Minute), true},
+			{"time id stored later", uuid.MustNewTime(), to.Add(time.Minute), true},
+			{"random id", uuid.MustNew(), from.Add(time.Minute), true},
+			{"random id stored before", uuid.MustNew(), from.Add(-time.Minute), false},
+			{"random id stored after", uuid.MustNew(), to.Add(time.Minute), false},
+		} {
+			if expected, actual := testcase.expected, qp.Contains(records.NewRecord(testcase.id, nil), SegmentInfo{ModTime: testcase.modTime}); expected != actual {
+				t.Errorf("expected: %t, actual: %t, %s", expected, actual, testcase.name)
+			}
+		}
+
+		before := QueryParams{From: from.Add(-time.Hour), To: from}
+		if expected, actual := false, before.Contains(records.NewRecord(uuid.MustNewTime(), nil), SegmentInfo{ModTime: from}); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestQueryRecords(t *testing.T) {
+	t.Parallel()
+
+	input := strings.Join([]string{
+		"01234567-89ab-cdef-0123-456789abcdef hello world\n",
+		"11234567-89ab-cdef-0123-456789abcdef goodbye world\n",
+		"\n",
+		"21234567-89ab-cdef-0123-456789abcdef hello again",
+	}, "")
+
+	for _, testcase := range []struct {
+		name     string
+		qp       QueryParams
+		expected []string
+	}{
+		{"all", QueryParams{}, []string{
+			"01234567-89ab-cdef-0123-456789abcdef hello world\n",
+			"11234567-89ab-cdef-0123-456789abcdef goodbye world\n",
+			"21234567-89ab-cdef-0123-456789abcdef hello again\n",
+		}},
+		{"substring", QueryParams{Q: "hello"}, []string{
+			"01234567-89ab-cdef-0123-456789abcdef hello world\n",
+			"21234567-89ab-cdef-0123-456789abcdef hello again\n",
+		}},
+		{"substring ignores uuid", QueryParams{Q: "0123"}, nil},
+		{"regex", QueryParams{Q: "^good.*d$", Regex: true}, []string{
+			"11234567-89ab-cdef-0123-456789abcdef goodbye world\n",
+		}},
+		{"no match", QueryParams{Q: "nothing"}, nil},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			match, err := testcase.qp.matcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			n, err := queryRecords(records.Text.NewEncoder(&buf), strings.NewReader(input), func(record records.Record) bool {
+				return match(record.Payload)
+			}, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected, actual := len(testcase.expected), n; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := strings.Join(testcase.expected, ""), buf.String(); expected != actual {
+				t.Errorf("expected: %q, actual: %q", expected, actual)
+			}
+		})
+	}
+
+	t.Run("invalid uuid", func(t *testing.T) {
+		_, err := queryRecords(records.Text.NewEncoder(ioutil.Discard), strings.NewReader("bad record\n"), func(records.Record) bool {
+			return true
+		}, log.NewNopLogger())
+		if expected, actual := true, records.ErrInvalidRecord(err); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("invalid regex", func(t *testing.T) {
+		_, err := QueryParams{Q: "(", Regex: true}.matcher()
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,408 @@
+package store
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Extension describe differing types of persisted segment types
+type Extension string
+
+const (
+
+	// Active states which segments are currently actively being written to
+	Active Extension = ".active"
+
+	// Flushed states which segments have been flushed
+	Flushed Extension = ".flushed"
+
+	// Checksum states the sidecar holding the checksum of a flushed segment
+	Checksum Extension = ".crc"
+
+	// Tombstone states which segments were merged into another segment
+	Tombstone Extension = ".tombstone"
+)
+
+// Ext returns the extension of the constant extension
+func (e Extension) Ext() string {
+	return string(e)
+}
+
+const (
+	lockFile = "LOCK"
+)
+
+type realLog struct {
+	mutex    sync.Mutex
+	root     string
+	filesys  fs.Filesystem
+	encoding compression.Encoding
+	ratio    prometheus.Observer
+	releaser fs.Releaser
+}
+
+func newRealLog(filesys fs.Filesystem, root string, encoding compression.Encoding, ratio prometheus.Observer) (Log, error) {
+	if err := filesys.MkdirAll(root); err != nil {
+		return nil, errors.Wrapf(err, "creating path %s", root)
+	}
+
+	lock := filepath.Join(root, lockFile)
+	r, _, err := filesys.Lock(lock)
+	if err != nil {
+		return nil, errors.Wrapf(err, "locking %s", lock)
+	}
+	if err := recoverSegments(filesys, root); err != nil {
+		return nil, errors.Wrap(err, "during recovery")
+	}
+
+	return &realLog{
+		root:     root,
+		filesys:  filesys,
+		encoding: encoding,
+		ratio:    ratio,
+		releaser: r,
+	}, nil
+}
+
+// Create writes the segment to a file of its own, even if the id is being
+// written to elsewhere, for example by a retried replication. Whichever segment
+// is flushed last replaces the others.
+func (l *realLog) Create(id uuid.UUID) (WriteSegment, error) {
+	token, err := uuid.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "create")
+	}
+	filename := filepath.Join(l.root, fmt.Sprintf("%s.%s%s", id, token, Active))
+
+	f, err := l.filesys.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &realWriteSegment{
+		log:   l,
+		id:    id.String(),
+		fs:    l.filesys,
+		f:     f,
+		w:     l.encoding.NewWriter(f),
+		hash:  checksum.New(),
+		ratio: l.ratio,
+	}, nil
+}
+
+func (l *realLog) Segments() ([]SegmentInfo, error) {
+	var segments []SegmentInfo
+	if err := walkSegments(l.filesys, l.root, func(path string, info os.FileInfo) error {
+		if filepath.Ext(path) != Flushed.Ext() {
+			return nil
+		}
+		segments = append(segments, SegmentInfo{
+			ID:      segmentID(path),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if a, b := segments[i].Created(), segments[j].Created(); !a.Equal(b) {
+			return a.Before(b)
+		}
+		return segments[i].ID < segments[j].ID
+	})
+	return segments, nil
+}
+
+func (l *realLog) Open(id string) (ReadSegment, error) {
+	filename := l.filename(id)
+	if !l.filesys.Exists(filename) {
+		return nil, errNotFound{errors.Errorf("segment %q not found", id)}
+	}
+
+	f, err := l.filesys.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &realReadSegment{id: id, fs: l.filesys, f: f}, nil
+}
+
+func (l *realLog) Delete(id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	filename := l.filename(id)
+	if !l.filesys.Exists(filename) {
+		if tombstone := modifyExtension(filename, Tombstone.Ext()); l.filesys.Exists(tombstone) {
+			return l.filesys.Remove(tombstone)
+		}
+		return errNotFound{errors.Errorf("segment %q not found", id)}
+	}
+	return l.remove(filename)
+}
+
+// Tombstone leaves an empty file in place of the segment, which is created
+// before the segment is removed, so that the records are never seen as
+// missing.
+func (l *realLog) Tombstone(id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	filename := l.filename(id)
+	if !l.filesys.Exists(filename) {
+		return errNotFound{errors.Errorf("segment %q not found", id)}
+	}
+	f, err := l.filesys.Create(modifyExtension(filename, Tombstone.Ext()))
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return l.remove(filename)
+}
+
+func (l *realLog) Tombstones() ([]SegmentInfo, error) {
+	var tombstones []SegmentInfo
+	if err := walkSegments(l.filesys, l.root, func(path string, info os.FileInfo) error {
+		if filepath.Ext(path) != Tombstone.Ext() {
+			return nil
+		}
+		tombstones = append(tombstones, SegmentInfo{
+			ID:      segmentID(path),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tombstones, func(i, j int) bool {
+		if a, b := tombstones[i].Created(), tombstones[j].Created(); !a.Equal(b) {
+			return a.Before(b)
+		}
+		return tombstones[i].ID < tombstones[j].ID
+	})
+	return tombstones, nil
+}
+
+// remove removes the flushed segment along with its sidecar. The caller must
+// hold the mutex.
+func (l *realLog) remove(filename string) error {
+	if sidecar := modifyExtension(filename, Checksum.Ext()); l.filesys.Exists(sidecar) {
+		if err := l.filesys.Remove(sidecar); err != nil {
+			return err
+		}
+	}
+	return l.filesys.Remove(filename)
+}
+
+func (l *realLog) Close() error {
+	return l.releaser.Release()
+}
+
+func (l *realLog) filename(id string) string {
+	return filepath.Join(l.root, fmt.Sprintf("%s%s", id, Flushed))
+}
+
+// flush moves the written segment and its sidecar in place of any segment
+// with the same id, so that the sidecar always matches the segment.
+func (l *realLog) flush(id, segment, sidecar string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	filename := l.filename(id)
+	if err := l.filesys.Rename(sidecar, modifyExtension(filename, Checksum.Ext())); err != nil {
+		return err
+	}
+	if err := l.filesys.Rename(segment, filename); err != nil {
+		return err
+	}
+	// The segment is held again, so it's no longer a tombstone.
+	if tombstone := modifyExtension(filename, Tombstone.Ext()); l.filesys.Exists(tombstone) {
+		return l.filesys.Remove(tombstone)
+	}
+	return nil
+}
+
+// realWriteSegment compresses the segment as it's written. The checksum and
+// the size of the segment are those of the uncompressed segment.
+type realWriteSegment struct {
+	log   *realLog
+	id    string
+	fs    fs.Filesystem
+	f     fs.File
+	w     compression.Writer
+	hash  hash.Hash32
+	size  int64
+	ratio prometheus.Observer
+}
+
+func (w *realWriteSegment) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *realWriteSegment) Sync() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *realWriteSegment) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	if w.ratio != nil && w.size > 0 {
+		w.ratio.Observe(float64(w.f.Size()) / float64(w.size))
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	// The sidecar is written before the segment is flushed, so that every
+	// flushed segment can be verified when it's read. Until then it's active,
+	// so that it's removed on recovery.
+	sidecar := modifyExtension(w.f.Name(), Checksum.Ext()+Active.Ext())
+	if err := checksum.WriteSidecar(w.fs, sidecar, w.hash.Sum32()); err != nil {
+		return err
+	}
+	return w.log.flush(w.id, w.f.Name(), sidecar)
+}
+
+func (w *realWriteSegment) Delete() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	return w.fs.Remove(w.f.Name())
+}
+
+func (w *realWriteSegment) Size() int64 {
+	return w.size
+}
+
+type realReadSegment struct {
+	id string
+	fs fs.Filesystem
+	f  fs.File
+	r  io.Reader
+}
+
+// Read decompresses the segment, regardless of how the log compresses
+// segments now, and verifies it against the checksum held in its sidecar. If
+// the segment is corrupt, it fails with a checksum mismatch error once read.
+// Segments flushed without a sidecar can't be verified.
+func (r *realReadSegment) Read(p []byte) (int, error) {
+	if r.r == nil {
+		sum, ok, err := checksum.ReadSidecar(r.fs, modifyExtension(r.f.Name(), Checksum.Ext()))
+		if err != nil {
+			return 0, err
+		}
+		dr, err := compression.Detect(r.f)
+		if err != nil {
+			return 0, err
+		}
+		r.r = dr
+		if ok {
+			r.r = checksum.NewReader(dr, sum)
+		}
+	}
+	return r.r.Read(p)
+}
+
+func (r *realReadSegment) Close() error {
+	return r.f.Close()
+}
+
+func (r *realReadSegment) ID() string {
+	return r.id
+}
+
+// Size returns the size of the segment as it's held on disk, which for
+// compressed segments is less than the size of the segment once read.
+func (r *realReadSegment) Size() int64 {
+	return r.f.Size()
+}
+
+// recoverSegments removes any segments, and their sidecars, that were still
+// actively being written to, as they can't be known to be complete. Sidecars
+// left without a flushed segment, by a flush that didn't finish, are removed
+// too.
+func recoverSegments(filesys fs.Filesystem, root string) error {
+	var (
+		toRemove []string
+		sidecars []string
+		flushed  = map[string]struct{}{}
+	)
+	if err := walkSegments(filesys, root, func(path string, info os.FileInfo) error {
+		switch filepath.Ext(path) {
+		case Active.Ext():
+			toRemove = append(toRemove, path)
+		case Checksum.Ext():
+			sidecars = append(sidecars, path)
+		case Flushed.Ext():
+			flushed[segmentID(path)] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, path := range sidecars {
+		if _, ok := flushed[segmentID(path)]; !ok {
+			toRemove = append(toRemove, path)
+		}
+	}
+
+	for _, path := range toRemove {
+		if err := filesys.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSegments walks the files held directly in the root, skipping the
+// directories of any topics nested within it.
+func walkSegments(filesys fs.Filesystem, root string, fn func(string, os.FileInfo) error) error {
+	root = filepath.Clean(root)
+	return filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filepath.Clean(path) != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(path) != root {
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+func segmentID(filename string) string {
+	base := filepath.Base(filename)
+	return base[:len(base)-len(filepath.Ext(base))]
+}
+
+func modifyExtension(filename, newExt string) string {
+	return filename[:len(filename)-len(filepath.Ext(filename))] + newExt
+}
@@ -0,0 +1,314 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/compression"
+	"github.com/SimonRichardson/cluster/pkg/fs"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+)
+
+func TestRealLog(t *testing.T) {
+	t.Parallel()
+
+	newLog := func(t *testing.T) Log {
+		l, err := newRealLog(fs.NewVirtualFilesystem(), "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	t.Run("create", func(t *testing.T) {
+		testLogCreate(func() Log { return newLog(t) }, t)
+	})
+
+	t.Run("create then delete", func(t *testing.T) {
+		testLogCreateDelete(newLog(t), t)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		testLogDelete(newLog(t), t)
+	})
+
+	t.Run("tombstone", func(t *testing.T) {
+		testLogTombstone(newLog(t), t)
+	})
+
+	t.Run("recover removes active segments", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		l, err := newRealLog(fsys, "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := l.Create(uuid.MustNewTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := newRealLog(fsys, "/root", compression.Identity, nil); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := false, fsys.Exists(w.(*realWriteSegment).f.Name()); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("recover removes sidecars without segments", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		l, err := newRealLog(fsys, "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		sidecar := "/root/" + uuid.MustNewTime().String() + Checksum.Ext()
+		if err := checksum.WriteSidecar(fsys, sidecar, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newRealLog(fsys, "/root", compression.Identity, nil); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := false, fsys.Exists(sidecar); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("concurrent writes of the same id", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		l, err := newRealLog(fsys, "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			id      = uuid.MustNewTime()
+			writers []WriteSegment
+		)
+		for i := 0; i < 2; i++ {
+			w, err := l.Create(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writers = append(writers, w)
+		}
+
+		// Writes interleave, without either writer seeing the other.
+		for _, data := range []string{"aaaa", "bbbb"} {
+			for _, w := range writers {
+				if _, err := w.Write([]byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, w := range writers {
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r, err := l.Open(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "aaaabbbb", string(b); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(segments); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("topics are kept apart", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		l, err := newRealLog(fsys, topic.Root("/root", topic.Default), compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		audit, err := newRealLog(fsys, topic.Root("/root", "audit"), compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		flushed, err := audit.Create(uuid.MustNewTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushed.Write([]byte("data"))
+		if err := flushed.Close(); err != nil {
+			t.Fatal(err)
+		}
+		active, err := audit.Create(uuid.MustNewTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Recovering the default topic leaves the active segments of other
+		// topics alone.
+		if l, err = newRealLog(fsys, topic.Root("/root", topic.Default), compression.Identity, nil); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := true, fsys.Exists(active.(*realWriteSegment).f.Name()); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+
+		for _, testcase := range []struct {
+			log      Log
+			expected int
+		}{
+			{l, 0},
+			{audit, 1},
+		} {
+			segments, err := testcase.log.Segments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := testcase.expected, len(segments); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+	})
+
+	t.Run("corrupt segment", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		l, err := newRealLog(fsys, "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := uuid.MustNewTime()
+		w, err := l.Create(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Overwrite the flushed segment, without updating the sidecar.
+		f, err := fsys.Create(l.(*realLog).filename(id.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("dada")); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		r, err := l.Open(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		if _, err := ioutil.ReadAll(r); !checksum.ErrMismatch(err) {
+			t.Errorf("expected checksum mismatch, actual: %v", err)
+		}
+	})
+
+	t.Run("delete removes checksum", func(t *testing.T) {
+		fsys := fs.NewVirtualFilesystem()
+		l, err := newRealLog(fsys, "/root", compression.Identity, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := uuid.MustNewTime()
+		w, err := l.Create(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Delete(id.String()); err != nil {
+			t.Fatal(err)
+		}
+
+		sidecar := modifyExtension(l.(*realLog).filename(id.String()), Checksum.Ext())
+		if expected, actual := false, fsys.Exists(sidecar); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+	t.Run("compressed segments", func(t *testing.T) {
+		for _, encoding := range []compression.Encoding{compression.Gzip, compression.Snappy} {
+			fsys := fs.NewVirtualFilesystem()
+			l, err := newRealLog(fsys, "/root", encoding, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				id    = uuid.MustNewTime()
+				input = bytes.Repeat([]byte("data\n"), 1024)
+			)
+			w, err := l.Create(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(input); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := int64(len(input)), w.Size(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Segments are read back even once the log no longer compresses.
+			l, err = newRealLog(fsys, "/root", compression.Identity, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := l.Open(id.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() >= int64(len(input)) {
+				t.Errorf("%s: expected: %d to be compressed", encoding.Name(), r.Size())
+			}
+
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+			if expected, actual := input, b; !bytes.Equal(expected, actual) {
+				t.Errorf("%s: expected: %d bytes, actual: %d bytes", encoding.Name(), len(expected), len(actual))
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy defines how long segments are kept in the log. Zero values
+// disable the respective rule.
+type RetentionPolicy struct {
+
+	// MaxAge purges segments once they were stored longer than this ago. The
+	// age of a compacted segment is that of the newest segment merged into it.
+	// Tombstones left by compaction are purged by the same age, and are kept
+	// for as long as the log otherwise.
+	MaxAge time.Duration
+
+	// MaxBytes purges the oldest segments once the log holds more than this
+	// many bytes.
+	MaxBytes int64
+}
+
+// Reaper purges the oldest segments of the log according to the retention
+// policy.
+type Reaper struct {
+	log            Log
+	policy         RetentionPolicy
+	interval       time.Duration
+	stop           chan chan struct{}
+	purgedSegments metrics.Counter
+	purgedBytes    metrics.Counter
+	logger         log.Logger
+}
+
+// NewReaper creates a Reaper for the log.
+func NewReaper(
+	log Log,
+	policy RetentionPolicy,
+	interval time.Duration,
+	purgedSegments, purgedBytes metrics.Counter,
+	logger log.Logger,
+) *Reaper {
+	return &Reaper{
+		log:            log,
+		policy:         policy,
+		interval:       interval,
+		stop:           make(chan chan struct{}),
+		purgedSegments: purgedSegments,
+		purgedBytes:    purgedBytes,
+		logger:         logger,
+	}
+}
+
+// Run purges expired segments every interval. Run returns when Stop is
+// invoked.
+func (r *Reaper) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := r.reap(now); err != nil {
+				level.Warn(r.logger).Log("state", "reap", "err", err)
+			}
+
+		case q := <-r.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the reaper.
+func (r *Reaper) Stop() {
+	q := make(chan struct{})
+	r.stop <- q
+	<-q
+}
+
+// reap deletes the oldest segments first, until the log satisfies the
+// retention policy.
+func (r *Reaper) reap(now time.Time) error {
+	segments, err := r.log.Segments()
+	if err != nil {
+		return errors.Wrap(err, "segments")
+	}
+
+	var total int64
+	for _, segment := range segments {
+		total += segment.Size
+	}
+
+	for _, segment := range segments {
+		var (
+			expired  = r.policy.MaxAge > 0 && now.Sub(segment.Created()) > r.policy.MaxAge
+			overflow = r.policy.MaxBytes > 0 && total > r.policy.MaxBytes
+		)
+		if !expired && !overflow {
+			// Segments are ordered from the oldest, so every segment after
+			// this one is also retained.
+			break
+		}
+
+		if err := r.log.Delete(segment.ID); ErrNotFound(err) {
+			// Already removed, for example by compaction.
+			total -= segment.Size
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "delete %s", segment.ID)
+		}
+		total -= segment.Size
+
+		r.purgedSegments.Inc()
+		r.purgedBytes.Add(float64(segment.Size))
+	}
+
+	if r.policy.MaxAge <= 0 {
+		return nil
+	}
+	tombstones, err := r.log.Tombstones()
+	if err != nil {
+		return errors.Wrap(err, "tombstones")
+	}
+	for _, tombstone := range tombstones {
+		if now.Sub(tombstone.Created()) <= r.policy.MaxAge {
+			break
+		}
+		if err := r.log.Delete(tombstone.ID); err != nil && !ErrNotFound(err) {
+			return errors.Wrapf(err, "delete tombstone %s", tombstone.ID)
+		}
+	}
+	return nil
+}
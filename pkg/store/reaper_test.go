@@ -0,0 +1,243 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+)
+
+func TestReaper(t *testing.T) {
+	t.Parallel()
+
+	remaining := func(t *testing.T, l Log) []string {
+		segments, err := l.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, segment := range segments {
+			ids = append(ids, segment.ID)
+		}
+		return ids
+	}
+
+	create := func(t *testing.T, l Log, data ...string) []string {
+		for _, d := range data {
+			segment, err := l.Create(uuid.MustNewTime())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := segment.Write([]byte(d)); err != nil {
+				t.Fatal(err)
+			}
+			if err := segment.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return remaining(t, l)
+	}
+
+	t.Run("max age", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+		create(t, l, "aaaa", "bbbb")
+
+		purgedSegments.EXPECT().Inc().Times(2)
+		purgedBytes.EXPECT().Add(float64(4)).Times(2)
+
+		reaper := NewReaper(l, RetentionPolicy{MaxAge: time.Minute}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 0, len(remaining(t, l)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("max age retains new segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+		create(t, l, "aaaa", "bbbb")
+
+		reaper := NewReaper(l, RetentionPolicy{MaxAge: time.Minute}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 2, len(remaining(t, l)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("max age of compacted segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l   = newVirtualLog()
+			now = time.Now().Add(time.Hour)
+		)
+		ids := create(t, l, "aaaa")
+
+		// Compaction rewrote the segment just now, keeping its id.
+		l.(*virtualLog).segments[ids[0]].mtime = now
+
+		purgedSegments.EXPECT().Inc()
+		purgedBytes.EXPECT().Add(float64(4))
+
+		reaper := NewReaper(l, RetentionPolicy{MaxAge: time.Minute}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(now); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 0, len(remaining(t, l)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("max age of compacted groups", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			compactions    = metricMocks.NewMockCounter(ctrl)
+			reclaimedBytes = metricMocks.NewMockCounter(ctrl)
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+		create(t, l, fmt.Sprintf("%s A\n", uuid.MustNewTime()))
+		time.Sleep(10 * time.Millisecond)
+		ids := create(t, l, fmt.Sprintf("%s B\n", uuid.MustNewTime()))
+
+		compactions.EXPECT().Inc()
+		reclaimedBytes.EXPECT().Add(float64(0))
+
+		compactor := NewCompactor(l, 1024, 1, 0, compactions, reclaimedBytes, log.NewNopLogger())
+		if err := compactor.compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The oldest segment of the group expired, but the newest didn't.
+		newest, ok := uuid.MustParse(ids[1]).Time()
+		if !ok {
+			t.Fatal("expected a time ordered id")
+		}
+		reaper := NewReaper(l, RetentionPolicy{MaxAge: time.Minute}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(newest.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := ids[1:], remaining(t, l); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("max age of tombstones", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+		ids := create(t, l, "aaaa", "bbbb")
+		if err := l.Tombstone(ids[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		purgedSegments.EXPECT().Inc()
+		purgedBytes.EXPECT().Add(float64(4))
+
+		reaper := NewReaper(l, RetentionPolicy{MaxAge: time.Minute}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		tombstones, err := l.Tombstones()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(tombstones); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+		ids := create(t, l, "aaaa", "bbbb", "cccc")
+
+		purgedSegments.EXPECT().Inc().Times(2)
+		purgedBytes.EXPECT().Add(float64(4)).Times(2)
+
+		reaper := NewReaper(l, RetentionPolicy{MaxBytes: 6}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		res := remaining(t, l)
+		if expected, actual := 1, len(res); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := ids[2], res[0]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			purgedSegments = metricMocks.NewMockCounter(ctrl)
+			purgedBytes    = metricMocks.NewMockCounter(ctrl)
+
+			l = newVirtualLog()
+		)
+		create(t, l, "aaaa", "bbbb")
+
+		reaper := NewReaper(l, RetentionPolicy{}, time.Second, purgedSegments, purgedBytes, log.NewNopLogger())
+		if err := reaper.reap(time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 2, len(remaining(t, l)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	"github.com/SimonRichardson/cluster/pkg/clients"
+	"github.com/SimonRichardson/cluster/pkg/cluster"
+	"github.com/SimonRichardson/cluster/pkg/metrics"
+	"github.com/SimonRichardson/cluster/pkg/placement"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// Repairer restores the replication factor of the segments held by the store,
+// for example after a store peer leaves the cluster. Every interval the
+// inventories of the store peers are compared, and any segment held by fewer
+// peers than the replication factor is copied to the peers chosen by the
+// placement. Each holder of an under-replicated segment repairs it, but as the
+// placement is deterministic and segments are replaced by id, the holders
+// converge on the same peers.
+//
+// Peers compact their segments independently, so a segment merged into another
+// on one peer may still be held on its own by another. Compaction leaves a
+// tombstone in place of the merged segment, which counts as holding it, so
+// that its records aren't copied back to the peer a second time.
+type Repairer struct {
+	peer              ClusterPeer
+	client            clients.Client
+	inventory         *inventory
+	log               Log
+	topic             string
+	placement         placement.Placement
+	replicationFactor int
+	interval          time.Duration
+	stop              chan chan struct{}
+	underReplicated   metrics.Gauge
+	repairedSegments  metrics.Counter
+	logger            log.Logger
+}
+
+// NewRepairer creates a Repairer for the log holding the segments of the
+// topic, which is compared with the same topic of the store peers.
+func NewRepairer(
+	peer ClusterPeer,
+	client clients.Client,
+	log Log,
+	topic string,
+	placement placement.Placement,
+	replicationFactor int,
+	interval time.Duration,
+	underReplicated metrics.Gauge,
+	repairedSegments metrics.Counter,
+	logger log.Logger,
+) *Repairer {
+	return &Repairer{
+		peer:              peer,
+		client:            client,
+		inventory:         newInventory(log),
+		log:               log,
+		topic:             topic,
+		placement:         placement,
+		replicationFactor: replicationFactor,
+		interval:          interval,
+		stop:              make(chan chan struct{}),
+		underReplicated:   underReplicated,
+		repairedSegments:  repairedSegments,
+		logger:            logger,
+	}
+}
+
+// Run repairs the under-replicated segments every interval. Run returns when
+// Stop is invoked.
+func (r *Repairer) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.repair(); err != nil {
+				level.Warn(r.logger).Log("state", "repair", "err", err)
+			}
+
+		case q := <-r.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the repairer.
+func (r *Repairer) Stop() {
+	q := make(chan struct{})
+	r.stop <- q
+	<-q
+}
+
+// repair copies every segment of the log that is held by fewer peers than the
+// replication factor to the peers that don't hold it yet. The peers are those
+// the cluster peer walks the alive members for, as it maps each member to the
+// address of its API.
+func (r *Repairer) repair() error {
+	peers, err := r.peer.Current(cluster.PeerTypeStore)
+	if err != nil {
+		return errors.Wrap(err, "current peers")
+	}
+
+	entries, err := r.inventory.entries()
+	if err != nil {
+		return errors.Wrap(err, "inventory")
+	}
+
+	// Peers that fail to answer are left out of the repair, so that a single
+	// dead or slow peer doesn't hold back repairing every other peer. What
+	// they hold is unknown, so they're never chosen to copy segments to.
+	holders, failed := r.holders(peers)
+	if len(failed) > 0 {
+		level.Warn(r.logger).Log("state", "repair", "failed_peers", strings.Join(failed, ","))
+		peers = without(peers, failed)
+	}
+
+	var underReplicated int
+	for _, entry := range entries {
+		if entry.Tombstone {
+			// The records are held by another segment, which is repaired
+			// on its own.
+			continue
+		}
+
+		held := holders[entry.ID]
+		for peer, inv := range held {
+			if !inv.Tombstone && inv.Checksum != entry.Checksum {
+				// Peers compact their segments independently, so the same
+				// segment may hold a different set of records on each peer.
+				level.Debug(r.logger).Log("state", "repair", "segment", entry.ID, "peer", peer, "err", "divergent checksum")
+			}
+		}
+
+		want := r.replicationFactor - len(held)
+		if want <= 0 {
+			continue
+		}
+		underReplicated++
+
+		var candidates []string
+		for _, peer := range peers {
+			if _, ok := held[peer]; !ok {
+				candidates = append(candidates, peer)
+			}
+		}
+
+		targets := r.placement.Place(entry.ID, candidates)
+		if len(targets) > want {
+			targets = targets[:want]
+		}
+		for _, target := range targets {
+			if err := r.copyTo(entry, target); err != nil {
+				level.Warn(r.logger).Log("state", "repair", "segment", entry.ID, "target", target, "err", err)
+				continue
+			}
+			r.repairedSegments.Inc()
+		}
+	}
+	r.underReplicated.Set(float64(underReplicated))
+
+	return nil
+}
+
+// holders returns the peers holding each segment, along with the inventory of
+// their copy, and the peers whose inventory couldn't be read.
+func (r *Repairer) holders(peers []string) (map[string]map[string]Inventory, []string) {
+	type result struct {
+		peer    string
+		entries []Inventory
+		err     error
+	}
+
+	c := make(chan result, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			entries, err := r.inventoryOf(peer)
+			c <- result{peer, entries, err}
+		}(peer)
+	}
+
+	var (
+		res    = map[string]map[string]Inventory{}
+		failed []string
+	)
+	for range peers {
+		inv := <-c
+		if inv.err != nil {
+			level.Debug(r.logger).Log("state", "repair", "peer", inv.peer, "err", inv.err)
+			failed = append(failed, inv.peer)
+			continue
+		}
+		for _, entry := range inv.entries {
+			if res[entry.ID] == nil {
+				res[entry.ID] = map[string]Inventory{}
+			}
+			res[entry.ID][inv.peer] = entry
+		}
+	}
+	sort.Strings(failed)
+	return res, failed
+}
+
+// without returns the peers, leaving out those that are excluded.
+func without(peers, excluded []string) []string {
+	var res []string
+	for _, peer := range peers {
+		var found bool
+		for _, e := range excluded {
+			if peer == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, peer)
+		}
+	}
+	return res
+}
+
+func (r *Repairer) inventoryOf(peer string) ([]Inventory, error) {
+	u := fmt.Sprintf("http://%s/store%s", peer, APIPathInventory)
+	if r.topic != topic.Default {
+		u += "?topic=" + url.QueryEscape(r.topic)
+	}
+	resp, err := r.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	b, err := resp.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Inventory
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, errors.Wrap(err, "decoding inventory")
+	}
+	return entries, nil
+}
+
+// copyTo replicates the segment to the target, keeping the id of the segment.
+// The target verifies the segment against the checksum of the inventory.
+func (r *Repairer) copyTo(entry Inventory, target string) error {
+	segment, err := r.log.Open(entry.ID)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+
+	u := fmt.Sprintf("http://%s/store%s?id=%s&checksum=%s%s", target, APIPathReplicate, entry.ID, checksum.Format(entry.Checksum), topic.Param(r.topic))
+	resp, err := r.client.PostStream(u, segment)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if status := resp.Status(); status != http.StatusOK {
+		return errors.Errorf("unexpected status %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/SimonRichardson/cluster/pkg/checksum"
+	clientsMocks "github.com/SimonRichardson/cluster/pkg/clients/mocks"
+	"github.com/SimonRichardson/cluster/pkg/cluster"
+	clusterMocks "github.com/SimonRichardson/cluster/pkg/cluster/mocks"
+	metricMocks "github.com/SimonRichardson/cluster/pkg/metrics/mocks"
+	"github.com/SimonRichardson/cluster/pkg/placement"
+	"github.com/SimonRichardson/cluster/pkg/topic"
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+)
+
+func TestRepairer(t *testing.T) {
+	t.Parallel()
+
+	create := func(t *testing.T, l Log, data ...string) []Inventory {
+		for _, d := range data {
+			segment, err := l.Create(uuid.MustNewTime())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := segment.Write([]byte(d)); err != nil {
+				t.Fatal(err)
+			}
+			if err := segment.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := newInventory(l).entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	expectInventory := func(ctrl *gomock.Controller,
+		client *clientsMocks.MockClient,
+		peer string,
+		entries []Inventory,
+	) {
+		b, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := clientsMocks.NewMockResponse(ctrl)
+		client.EXPECT().
+			Get(fmt.Sprintf("http://%s/store%s", peer, APIPathInventory)).
+			Return(resp, nil).Times(1)
+		resp.EXPECT().
+			Bytes().
+			Return(b, nil).Times(1)
+		resp.EXPECT().
+			Close().
+			Return(nil).Times(1)
+	}
+
+	t.Run("repair", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer             = clusterMocks.NewMockPeer(ctrl)
+			client           = clientsMocks.NewMockClient(ctrl)
+			resp             = clientsMocks.NewMockResponse(ctrl)
+			underReplicated  = metricMocks.NewMockGauge(ctrl)
+			repairedSegments = metricMocks.NewMockCounter(ctrl)
+
+			l       = newVirtualLog()
+			placer  = placement.NewRendezvous()
+			peers   = []string{"a", "b", "c"}
+			entries = create(t, l, "aaaa", "bbbb")
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return(peers, nil).Times(1)
+
+		// The first segment is fully replicated, but the second one is only
+		// held by this store.
+		expectInventory(ctrl, client, "a", entries)
+		expectInventory(ctrl, client, "b", entries[:1])
+		expectInventory(ctrl, client, "c", nil)
+
+		target := placer.Place(entries[1].ID, []string{"b", "c"})[0]
+		client.EXPECT().
+			PostStream(fmt.Sprintf("http://%s/store%s?id=%s&checksum=%s", target, APIPathReplicate, entries[1].ID, checksum.Format(entries[1].Checksum)), gomock.Any()).
+			Return(resp, nil).Times(1)
+		resp.EXPECT().
+			Status().
+			Return(http.StatusOK).Times(1)
+		resp.EXPECT().
+			Close().
+			Return(nil).Times(1)
+
+		repairedSegments.EXPECT().Inc().Times(1)
+		underReplicated.EXPECT().Set(float64(1)).Times(1)
+
+		repairer := NewRepairer(peer, client, l, topic.Default, placer, 2, 0, underReplicated, repairedSegments, log.NewNopLogger())
+		if err := repairer.repair(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("replicated", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer             = clusterMocks.NewMockPeer(ctrl)
+			client           = clientsMocks.NewMockClient(ctrl)
+			underReplicated  = metricMocks.NewMockGauge(ctrl)
+			repairedSegments = metricMocks.NewMockCounter(ctrl)
+
+			l       = newVirtualLog()
+			peers   = []string{"a", "b"}
+			entries = create(t, l, "aaaa", "bbbb")
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return(peers, nil).Times(1)
+
+		expectInventory(ctrl, client, "a", entries)
+		expectInventory(ctrl, client, "b", entries)
+
+		underReplicated.EXPECT().Set(float64(0)).Times(1)
+
+		repairer := NewRepairer(peer, client, l, topic.Default, placement.NewRendezvous(), 2, 0, underReplicated, repairedSegments, log.NewNopLogger())
+		if err := repairer.repair(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("topic", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer             = clusterMocks.NewMockPeer(ctrl)
+			client           = clientsMocks.NewMockClient(ctrl)
+			resp             = clientsMocks.NewMockResponse(ctrl)
+			underReplicated  = metricMocks.NewMockGauge(ctrl)
+			repairedSegments = metricMocks.NewMockCounter(ctrl)
+
+			l       = newVirtualLog()
+			peers   = []string{"a", "b"}
+			entries = create(t, l, "aaaa")
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return(peers, nil).Times(1)
+
+		// Only the inventories of the same topic are compared.
+		b, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range peers {
+			data := b
+			if p == "b" {
+				data = []byte("[]")
+			}
+			inv := clientsMocks.NewMockResponse(ctrl)
+			client.EXPECT().
+				Get(fmt.Sprintf("http://%s/store%s?topic=audit", p, APIPathInventory)).
+				Return(inv, nil).Times(1)
+			inv.EXPECT().
+				Bytes().
+				Return(data, nil).Times(1)
+			inv.EXPECT().
+				Close().
+				Return(nil).Times(1)
+		}
+
+		client.EXPECT().
+			PostStream(fmt.Sprintf("http://b/store%s?id=%s&checksum=%s&topic=audit", APIPathReplicate, entries[0].ID, checksum.Format(entries[0].Checksum)), gomock.Any()).
+			Return(resp, nil).Times(1)
+		resp.EXPECT().
+			Status().
+			Return(http.StatusOK).Times(1)
+		resp.EXPECT().
+			Close().
+			Return(nil).Times(1)
+
+		repairedSegments.EXPECT().Inc().Times(1)
+		underReplicated.EXPECT().Set(float64(1)).Times(1)
+
+		repairer := NewRepairer(peer, client, l, "audit", placement.NewRendezvous(), 2, 0, underReplicated, repairedSegments, log.NewNopLogger())
+		if err := repairer.repair(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("compacted segments aren't repaired", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer             = clusterMocks.NewMockPeer(ctrl)
+			client           = clientsMocks.NewMockClient(ctrl)
+			underReplicated  = metricMocks.NewMockGauge(ctrl)
+			repairedSegments = metricMocks.NewMockCounter(ctrl)
+
+			l       = newVirtualLog()
+			peers   = []string{"a", "b"}
+			entries = create(t, l, "aaaa", "bbbb")
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return(peers, nil).Times(1)
+
+		// Peer a merged the second segment into the first one, leaving a
+		// tombstone in its place, so neither segment is under-replicated.
+		expectInventory(ctrl, client, "a", []Inventory{
+			{ID: entries[0].ID, Size: 8, Checksum: checksum.Checksum([]byte("aaaabbbb"))},
+			{ID: entries[1].ID, Tombstone: true},
+		})
+		expectInventory(ctrl, client, "b", entries)
+
+		underReplicated.EXPECT().Set(float64(0)).Times(1)
+
+		repairer := NewRepairer(peer, client, l, topic.Default, placement.NewRendezvous(), 2, 0, underReplicated, repairedSegments, log.NewNopLogger())
+		if err := repairer.repair(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("tombstones aren't repaired", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer             = clusterMocks.NewMockPeer(ctrl)
+			client           = clientsMocks.NewMockClient(ctrl)
+			underReplicated  = metricMocks.NewMockGauge(ctrl)
+			repairedSegments = metricMocks.NewMockCounter(ctrl)
+
+			l       = newVirtualLog()
+			peers   = []string{"a", "b"}
+			entries = create(t, l, "aaaa")
+		)
+		if err := l.Tombstone(entries[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		tombstones, err := newInventory(l).entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return(peers, nil).Times(1)
+
+		expectInventory(ctrl, client, "a", tombstones)
+		expectInventory(ctrl, client, "b", nil)
+
+		underReplicated.EXPECT().Set(float64(0)).Times(1)
+
+		repairer := NewRepairer(peer, client, l, topic.Default, placement.NewRendezvous(), 2, 0, underReplicated, repairedSegments, log.NewNopLogger())
+		if err := repairer.repair(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("peer failure", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			peer             = clusterMocks.NewMockPeer(ctrl)
+			client           = clientsMocks.NewMockClient(ctrl)
+			resp             = clientsMocks.NewMockResponse(ctrl)
+			underReplicated  = metricMocks.NewMockGauge(ctrl)
+			repairedSegments = metricMocks.NewMockCounter(ctrl)
+
+			l       = newVirtualLog()
+			peers   = []string{"a", "b", "c"}
+			entries = create(t, l, "aaaa")
+		)
+
+		peer.EXPECT().
+			Current(cluster.PeerTypeStore).
+			Return(peers, nil).Times(1)
+
+		// The failed peer is left out, so the segment is still repaired, but
+		// never to the failed peer.
+		expectInventory(ctrl, client, "a", entries)
+		expectInventory(ctrl, client, "b", nil)
+		client.EXPECT().
+			Get(fmt.Sprintf("http://c/store%s", APIPathInventory)).
+			Return(nil, errors.New("bad")).Times(1)
+
+		client.EXPECT().
+			PostStream(fmt.Sprintf("http://b/store%s?id=%s&checksum=%s", APIPathReplicate, entries[0].ID, checksum.Format(entries[0].Checksum)), gomock.Any()).
+			Return(resp, nil).Times(1)
+		resp.EXPECT().
+			Status().
+			Return(http.StatusOK).Times(1)
+		resp.EXPECT().
+			Close().
+			Return(nil).Times(1)
+
+		repairedSegments.EXPECT().Inc().Times(1)
+		underReplicated.EXPECT().Set(float64(1)).Times(1)
+
+		repairer := NewRepairer(peer, client, l, topic.Default, placement.NewRendezvous(), 2, 0, underReplicated, repairedSegments, log.NewNopLogger())
+		if err := repairer.repair(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
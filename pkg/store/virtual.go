@@ -0,0 +1,169 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/cluster/pkg/uuid"
+	"github.com/pkg/errors"
+)
+
+type virtualLog struct {
+	mutex      sync.RWMutex
+	segments   map[string]*virtualSegment
+	tombstones map[string]time.Time
+}
+
+func newVirtualLog() Log {
+	return &virtualLog{
+		segments:   map[string]*virtualSegment{},
+		tombstones: map[string]time.Time{},
+	}
+}
+
+func (l *virtualLog) Create(id uuid.UUID) (WriteSegment, error) {
+	return &virtualWriteSegment{
+		log: l,
+		id:  id.String(),
+	}, nil
+}
+
+func (l *virtualLog) Segments() ([]SegmentInfo, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	segments := make([]SegmentInfo, 0, len(l.segments))
+	for id, s := range l.segments {
+		segments = append(segments, SegmentInfo{
+			ID:      id,
+			Size:    int64(len(s.data)),
+			ModTime: s.mtime,
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if a, b := segments[i].Created(), segments[j].Created(); !a.Equal(b) {
+			return a.Before(b)
+		}
+		return segments[i].ID < segments[j].ID
+	})
+	return segments, nil
+}
+
+func (l *virtualLog) Open(id string) (ReadSegment, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	s, ok := l.segments[id]
+	if !ok {
+		return nil, errNotFound{errors.Errorf("segment %q not found", id)}
+	}
+	return &virtualReadSegment{
+		Reader: bytes.NewReader(s.data),
+		id:     id,
+		size:   int64(len(s.data)),
+	}, nil
+}
+
+func (l *virtualLog) Delete(id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.segments[id]; ok {
+		delete(l.segments, id)
+		return nil
+	}
+	if _, ok := l.tombstones[id]; ok {
+		delete(l.tombstones, id)
+		return nil
+	}
+	return errNotFound{errors.Errorf("segment %q not found", id)}
+}
+
+func (l *virtualLog) Tombstone(id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.segments[id]; !ok {
+		return errNotFound{errors.Errorf("segment %q not found", id)}
+	}
+	delete(l.segments, id)
+	l.tombstones[id] = time.Now()
+	return nil
+}
+
+func (l *virtualLog) Tombstones() ([]SegmentInfo, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	res := make([]SegmentInfo, 0, len(l.tombstones))
+	for id, mtime := range l.tombstones {
+		res = append(res, SegmentInfo{
+			ID:      id,
+			ModTime: mtime,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if a, b := res[i].Created(), res[j].Created(); !a.Equal(b) {
+			return a.Before(b)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+func (l *virtualLog) Close() error { return nil }
+
+func (l *virtualLog) flush(id string, data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.segments[id] = &virtualSegment{
+		data:  data,
+		mtime: time.Now(),
+	}
+	delete(l.tombstones, id)
+}
+
+type virtualSegment struct {
+	data  []byte
+	mtime time.Time
+}
+
+type virtualWriteSegment struct {
+	log    *virtualLog
+	id     string
+	buffer bytes.Buffer
+}
+
+func (w *virtualWriteSegment) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+func (w *virtualWriteSegment) Sync() error { return nil }
+
+func (w *virtualWriteSegment) Close() error {
+	w.log.flush(w.id, w.buffer.Bytes())
+	return nil
+}
+
+func (w *virtualWriteSegment) Delete() error {
+	w.buffer.Reset()
+	return nil
+}
+
+func (w *virtualWriteSegment) Size() int64 {
+	return int64(w.buffer.Len())
+}
+
+type virtualReadSegment struct {
+	*bytes.Reader
+	id   string
+	size int64
+}
+
+func (r *virtualReadSegment) Close() error { return nil }
+func (r *virtualReadSegment) ID() string   { return r.id }
+func (r *virtualReadSegment) Size() int64  { return r.size }
@@ -0,0 +1,23 @@
+package store
+
+import "testing"
+
+func TestVirtualLog(t *testing.T) {
+	t.Parallel()
+
+	t.Run("create", func(t *testing.T) {
+		testLogCreate(newVirtualLog, t)
+	})
+
+	t.Run("create then delete", func(t *testing.T) {
+		testLogCreateDelete(newVirtualLog(), t)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		testLogDelete(newVirtualLog(), t)
+	})
+
+	t.Run("tombstone", func(t *testing.T) {
+		testLogTombstone(newVirtualLog(), t)
+	})
+}
@@ -0,0 +1,42 @@
+package topic
+
+import (
+	"net/url"
+	"path/filepath"
+	"regexp"
+)
+
+// Default is the topic of records written without one.
+const Default = ""
+
+const (
+	topicsDir = "topics"
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Valid checks to see if the name can be used for a topic. Topics are held in
+// a directory of the same name, so names are restricted to lower case letters,
+// digits, dashes and underscores.
+func Valid(name string) bool {
+	return name == Default || validName.MatchString(name)
+}
+
+// Root returns the path holding the segments of the topic. The default topic
+// is held directly in the root, so that segments from before topics are still
+// found, with every other topic nested within it.
+func Root(root, name string) string {
+	if name == Default {
+		return root
+	}
+	return filepath.Join(root, topicsDir, name)
+}
+
+// Param returns the topic as a query parameter to append to a url, which is
+// empty for the default topic.
+func Param(name string) string {
+	if name == Default {
+		return ""
+	}
+	return "&topic=" + url.QueryEscape(name)
+}
@@ -0,0 +1,45 @@
+package topic
+
+import (
+	"testing"
+)
+
+func TestTopic(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		for name, expected := range map[string]bool{
+			Default:      true,
+			"audit":      true,
+			"debug-logs": true,
+			"debug_2":    true,
+			"Audit":      false,
+			"-audit":     false,
+			"..":         false,
+			"a/b":        false,
+			"a b":        false,
+		} {
+			if actual := Valid(name); expected != actual {
+				t.Errorf("%q: expected: %t, actual: %t", name, expected, actual)
+			}
+		}
+	})
+
+	t.Run("root", func(t *testing.T) {
+		if expected, actual := "/data", Root("/data", Default); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "/data/topics/audit", Root("/data", "audit"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+
+	t.Run("param", func(t *testing.T) {
+		if expected, actual := "", Param(Default); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "&topic=audit", Param("audit"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package uuid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// versionRandom is the version of UUIDs generated from a random source.
+	versionRandom = 4
+
+	// versionTime is the version of UUIDs prefixed with a timestamp.
+	versionTime = 7
+
+	// maxSequence is the largest sequence that fits in the 12 bits following
+	// the version, used to keep UUIDs generated within the same millisecond
+	// ordered.
+	maxSequence = 0x0fff
+)
+
+// timeGenerator generates time ordered UUIDs, the same layout as UUIDv7. The
+// first 48 bits hold the unix timestamp in milliseconds, followed by a sequence
+// that's incremented for each UUID generated within the same millisecond.
+type timeGenerator struct {
+	mutex    sync.Mutex
+	rnd      *rand.Rand
+	millis   int64
+	sequence uint16
+}
+
+var timeGen = &timeGenerator{
+	rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+}
+
+// NewTime generates a time ordered UUID, so that UUIDs generated later always
+// sort after UUIDs generated earlier. The time can be extracted from the UUID
+// via Time.
+func NewTime() (UUID, error) {
+	return timeGen.generate(time.Now())
+}
+
+// MustNewTime creates a time ordered UUID or panics on error
+func MustNewTime() UUID {
+	id, err := NewTime()
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// Version returns the version of the UUID, which is 4 for random UUIDs and 7
+// for time ordered UUIDs.
+func (u UUID) Version() int {
+	var b [1]byte
+	if _, err := hex.Decode(b[:], u[14:16]); err != nil {
+		return 0
+	}
+	return int(b[0] >> 4)
+}
+
+// Time returns the time the UUID was generated, only if it's a time ordered
+// UUID.
+func (u UUID) Time() (time.Time, bool) {
+	if u.Version() != versionTime {
+		return time.Time{}, false
+	}
+
+	var b [8]byte
+	if _, err := hex.Decode(b[2:6], u[:8]); err != nil {
+		return time.Time{}, false
+	}
+	if _, err := hex.Decode(b[6:], u[9:13]); err != nil {
+		return time.Time{}, false
+	}
+
+	millis := int64(binary.BigEndian.Uint64(b[:]))
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC(), true
+}
+
+// Compare returns an integer comparing two UUIDs lexicographically, which for
+// time ordered UUIDs is the order they were generated in.
+// The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
+func Compare(a, b UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func (g *timeGenerator) generate(now time.Time) (uuid UUID, err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	millis := now.UnixNano() / int64(time.Millisecond)
+	if millis <= g.millis {
+		// Either the clock went backwards or we're still within the same
+		// millisecond, either way keep the ordering by using the last time.
+		millis = g.millis
+		if g.sequence >= maxSequence {
+			millis++
+			g.sequence = 0
+		} else {
+			g.sequence++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.millis = millis
+
+	var (
+		pos int
+		r   = make([]byte, 16)
+	)
+	if pos, err = g.rnd.Read(r[8:]); err != nil {
+		return
+	} else if pos != 8 {
+		err = errors.Errorf("generation failure (length)")
+		return
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(millis))
+	copy(r[:6], b[2:])
+
+	r[6] = byte(versionTime<<4) | byte(g.sequence>>8) // Version 7
+	r[7] = byte(g.sequence)
+	r[8] = (r[8] & 0x3f) | 0x80 // Variant is 10
+
+	encode(uuid[:], r)
+	return
+}
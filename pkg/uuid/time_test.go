@@ -0,0 +1,103 @@
+package uuid
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestTimeUUID(t *testing.T) {
+	t.Parallel()
+
+	t.Run("new", func(t *testing.T) {
+		fn := func() bool {
+			id, err := NewTime()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Parse(id.String())
+			return err == nil
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		if expected, actual := versionTime, MustNewTime().Version(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := versionRandom, MustNew().Version(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("time", func(t *testing.T) {
+		fn := func(millis uint32) bool {
+			var (
+				gen = &timeGenerator{rnd: rand.New(rand.NewSource(1))}
+				now = time.Unix(0, int64(millis)*int64(time.Millisecond))
+			)
+			id, err := gen.generate(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, ok := id.Time()
+			return ok && res.Equal(now)
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("random has no time", func(t *testing.T) {
+		fn := func(id UUID) bool {
+			_, ok := id.Time()
+			return !ok
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ordered", func(t *testing.T) {
+		var (
+			gen  = &timeGenerator{rnd: rand.New(rand.NewSource(1))}
+			now  = time.Now()
+			prev UUID
+		)
+		// Generate enough within the same millisecond to overflow the sequence,
+		// and then also go back in time.
+		for i := 0; i < maxSequence*2; i++ {
+			at := now
+			if i%100 == 0 {
+				at = now.Add(-time.Second)
+			}
+
+			id, err := gen.generate(at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected, actual := 1, Compare(id, prev); expected != actual {
+				t.Fatalf("expected: %d, actual: %d, %s <= %s", expected, actual, id, prev)
+			}
+			prev = id
+		}
+	})
+
+	t.Run("compare", func(t *testing.T) {
+		fn := func(a UUID) bool {
+			return Compare(a, a) == 0
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
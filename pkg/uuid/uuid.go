@@ -170,18 +170,22 @@ func generate(rnd *rand.Rand) (uuid [36]byte, err error) {
 		return
 	}
 
-	r[6] = (r[6] & 0x0f) | 0x40 // Version 4
-	r[8] = (r[8] & 0x3f) | 0x80 // Variant is 10
-
-	hex.Encode(uuid[:], r[:4])
-	uuid[8] = '-'
-	hex.Encode(uuid[9:13], r[4:6])
-	uuid[13] = '-'
-	hex.Encode(uuid[14:18], r[6:8])
-	uuid[18] = '-'
-	hex.Encode(uuid[19:23], r[8:10])
-	uuid[23] = '-'
-	hex.Encode(uuid[24:], r[10:])
+	r[6] = (r[6] & 0x0f) | (versionRandom << 4) // Version 4
+	r[8] = (r[8] & 0x3f) | 0x80                 // Variant is 10
 
+	encode(uuid[:], r)
 	return
 }
+
+// encode writes the 16 bytes of r into the 36 byte layout of dst.
+func encode(dst, r []byte) {
+	hex.Encode(dst, r[:4])
+	dst[8] = '-'
+	hex.Encode(dst[9:13], r[4:6])
+	dst[13] = '-'
+	hex.Encode(dst[14:18], r[6:8])
+	dst[18] = '-'
+	hex.Encode(dst[19:23], r[8:10])
+	dst[23] = '-'
+	hex.Encode(dst[24:], r[10:])
+}